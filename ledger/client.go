@@ -0,0 +1,43 @@
+package ledger
+
+import (
+	dfinity "github.com/csanti/dfinity_experiments/service"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber"
+)
+
+// Client submits transfers and queries balances through the dfinity service
+type Client struct {
+	*dfinity.Client
+}
+
+// NewClient returns a client using the given suite to talk to the nodes
+func NewClient(s network.Suite) *Client {
+	return &Client{Client: dfinity.NewClient(s)}
+}
+
+// Transfer signs a transfer of amount tokens to the given public key and
+// submits it through the node. The nonce must be the one of the sender's
+// account, see Balance.
+func (c *Client) Transfer(si *network.ServerIdentity, priv kyber.Scalar, to kyber.Point, amount, nonce uint64) error {
+	t, err := NewTransfer(priv, to, amount, nonce)
+	if err != nil {
+		return err
+	}
+	return c.SubmitTx(si, t.Encode())
+}
+
+// Balance returns the account of the public key as seen by the node, along
+// with the round of the last block the node executed
+func (c *Client) Balance(si *network.ServerIdentity, pub kyber.Point) (*Account, int, error) {
+	buff, err := pub.MarshalBinary()
+	if err != nil {
+		return nil, 0, err
+	}
+	reply, err := c.Query(si, QueryBalance, buff)
+	if err != nil {
+		return nil, 0, err
+	}
+	acc, err := DecodeAccount(reply.Data)
+	return acc, reply.Round, err
+}
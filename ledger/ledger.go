@@ -0,0 +1,397 @@
+// Package ledger is an example application running on top of the dfinity
+// consensus: an account based token ledger with signed transfers.
+package ledger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	dfinity "github.com/csanti/dfinity_experiments/service"
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/group/edwards25519"
+	"go.dedis.ch/kyber/sign/schnorr"
+)
+
+// Name is the name under which the ledger is registered as an application
+const Name = "ledger"
+
+// QueryBalance is the query path returning the account of a public key
+const QueryBalance = "balance"
+
+// transferDomain separates transfer signatures from any other message
+const transferDomain = "dfinity-ledger-transfer"
+
+// Suite is used for the keys of the accounts
+var Suite = edwards25519.NewBlakeSHA256Ed25519()
+
+func init() {
+	dfinity.RegisterApplication(Name, func() dfinity.Application { return New() })
+}
+
+// Account is the state of a public key in the ledger
+type Account struct {
+	Balance uint64
+	// Nonce is the nonce expected for the next transfer from this account
+	Nonce uint64
+}
+
+// Encode returns the binary representation of the account
+func (a *Account) Encode() []byte {
+	buff := make([]byte, 16)
+	binary.BigEndian.PutUint64(buff[:8], a.Balance)
+	binary.BigEndian.PutUint64(buff[8:], a.Nonce)
+	return buff
+}
+
+// DecodeAccount decodes an account out of its binary representation
+func DecodeAccount(buff []byte) (*Account, error) {
+	if len(buff) != 16 {
+		return nil, errors.New("ledger: invalid account encoding")
+	}
+	return &Account{
+		Balance: binary.BigEndian.Uint64(buff[:8]),
+		Nonce:   binary.BigEndian.Uint64(buff[8:]),
+	}, nil
+}
+
+// Transfer moves Amount tokens from one account to another. It must carry the
+// signature of the sender over its other fields and the nonce expected by the
+// sender's account.
+type Transfer struct {
+	From      []byte // marshalled public key of the sender
+	To        []byte // marshalled public key of the receiver
+	Amount    uint64
+	Nonce     uint64
+	Signature []byte
+}
+
+// NewTransfer returns a transfer signed with the private key of the sender
+func NewTransfer(priv kyber.Scalar, to kyber.Point, amount, nonce uint64) (*Transfer, error) {
+	from, err := Suite.Point().Mul(priv, nil).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	t := &Transfer{Amount: amount, Nonce: nonce, From: from}
+	if t.To, err = to.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	t.Signature, err = schnorr.Sign(Suite, priv, t.message())
+	return t, err
+}
+
+// message returns what the sender signs
+func (t *Transfer) message() []byte {
+	var b bytes.Buffer
+	b.WriteString(transferDomain)
+	writeBytes(&b, t.From)
+	writeBytes(&b, t.To)
+	writeUint64(&b, t.Amount)
+	writeUint64(&b, t.Nonce)
+	return b.Bytes()
+}
+
+// Encode returns the binary representation of the transfer
+func (t *Transfer) Encode() []byte {
+	var b bytes.Buffer
+	writeBytes(&b, t.From)
+	writeBytes(&b, t.To)
+	writeUint64(&b, t.Amount)
+	writeUint64(&b, t.Nonce)
+	writeBytes(&b, t.Signature)
+	return b.Bytes()
+}
+
+// DecodeTransfer decodes a transfer and checks its signature
+func DecodeTransfer(buff []byte) (*Transfer, error) {
+	r := &reader{buff: buff}
+	t := &Transfer{
+		From:      r.bytes(),
+		To:        r.bytes(),
+		Amount:    r.uint64(),
+		Nonce:     r.uint64(),
+		Signature: r.bytes(),
+	}
+	if r.err != nil || len(r.buff) > 0 {
+		return nil, errors.New("ledger: invalid transfer encoding")
+	}
+	from := Suite.Point()
+	if err := from.UnmarshalBinary(t.From); err != nil {
+		return nil, fmt.Errorf("ledger: invalid sender: %s", err)
+	}
+	if err := Suite.Point().UnmarshalBinary(t.To); err != nil {
+		return nil, fmt.Errorf("ledger: invalid receiver: %s", err)
+	}
+	if err := schnorr.Verify(Suite, from, t.message(), t.Signature); err != nil {
+		return nil, fmt.Errorf("ledger: invalid signature: %s", err)
+	}
+	return t, nil
+}
+
+// GenesisState returns the initial application state funding the given public
+// keys with the given balances
+func GenesisState(keys []kyber.Point, balances []uint64) ([]byte, error) {
+	if len(keys) != len(balances) {
+		return nil, errors.New("ledger: as many balances as keys needed")
+	}
+	entries := make([][]byte, len(keys))
+	for i, key := range keys {
+		buff, err := key.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		var b bytes.Buffer
+		writeBytes(&b, buff)
+		writeUint64(&b, balances[i])
+		entries[i] = b.Bytes()
+	}
+	return dfinity.EncodeTxs(entries), nil
+}
+
+// Ledger implements the dfinity Application interface
+type Ledger struct {
+	sync.Mutex
+	accounts map[string]*Account
+	root     []byte
+}
+
+// New returns an empty ledger
+func New() *Ledger {
+	return &Ledger{accounts: make(map[string]*Account)}
+}
+
+// InitChain loads the balances given by GenesisState
+func (l *Ledger) InitChain(state []byte) error {
+	l.Lock()
+	defer l.Unlock()
+	entries, err := dfinity.DecodeTxs(state)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		r := &reader{buff: entry}
+		key, balance := r.bytes(), r.uint64()
+		if r.err != nil || len(r.buff) > 0 {
+			return errors.New("ledger: invalid genesis entry")
+		}
+		l.accounts[string(key)] = &Account{Balance: balance}
+	}
+	return nil
+}
+
+// CheckTx accepts transfers that are correctly signed, do not go below the
+// account nonce and are covered by the current balance
+func (l *Ledger) CheckTx(tx []byte) error {
+	t, err := DecodeTransfer(tx)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	acc, exists := l.accounts[string(t.From)]
+	switch {
+	case !exists:
+		return errors.New("ledger: unknown sender")
+	case t.Nonce < acc.Nonce:
+		return errors.New("ledger: nonce already used")
+	case t.Amount > acc.Balance:
+		return errors.New("ledger: insufficient balance")
+	}
+	if to, exists := l.accounts[string(t.To)]; exists && to != acc && to.Balance > math.MaxUint64-t.Amount {
+		return errors.New("ledger: balance of the receiver would overflow")
+	}
+	return nil
+}
+
+// DeliverBlock executes the transfers of the block. Invalid ones, including
+// replays, are skipped.
+func (l *Ledger) DeliverBlock(b *dfinity.Block) error {
+	l.Lock()
+	defer l.Unlock()
+	return execute(l.accounts, b)
+}
+
+// Commit returns the hash of all accounts sorted by public key
+func (l *Ledger) Commit() ([]byte, error) {
+	l.Lock()
+	defer l.Unlock()
+	l.root = rootOf(l.accounts)
+	return l.root, nil
+}
+
+// Snapshot implements the dfinity Snapshotter interface. Every entry is the
+// public key followed by the encoded account.
+func (l *Ledger) Snapshot() ([]byte, error) {
+	l.Lock()
+	defer l.Unlock()
+	entries := make([][]byte, 0, len(l.accounts))
+	for k, acc := range l.accounts {
+		var b bytes.Buffer
+		writeBytes(&b, []byte(k))
+		b.Write(acc.Encode())
+		entries = append(entries, b.Bytes())
+	}
+	return dfinity.EncodeTxs(entries), nil
+}
+
+// Restore implements the dfinity Snapshotter interface
+func (l *Ledger) Restore(snapshot []byte) error {
+	entries, err := dfinity.DecodeTxs(snapshot)
+	if err != nil {
+		return err
+	}
+	accounts := make(map[string]*Account, len(entries))
+	for _, entry := range entries {
+		r := &reader{buff: entry}
+		key := r.bytes()
+		if r.err != nil {
+			return errors.New("ledger: invalid snapshot entry")
+		}
+		acc, err := DecodeAccount(r.buff)
+		if err != nil {
+			return err
+		}
+		accounts[string(key)] = acc
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.accounts = accounts
+	return nil
+}
+
+// SpeculateRoot implements the dfinity Speculator interface
+func (l *Ledger) SpeculateRoot(blocks []*dfinity.Block) ([]byte, error) {
+	l.Lock()
+	accounts := make(map[string]*Account, len(l.accounts))
+	for k, acc := range l.accounts {
+		cpy := *acc
+		accounts[k] = &cpy
+	}
+	l.Unlock()
+	for _, b := range blocks {
+		if err := execute(accounts, b); err != nil {
+			return nil, err
+		}
+	}
+	return rootOf(accounts), nil
+}
+
+// Query implements the dfinity Querier interface. The balance path takes a
+// marshalled public key and returns its encoded account.
+func (l *Ledger) Query(path string, data []byte) ([]byte, error) {
+	if path != QueryBalance {
+		return nil, fmt.Errorf("ledger: unknown query %q", path)
+	}
+	acc := l.Account(data)
+	return acc.Encode(), nil
+}
+
+// Account returns a copy of the account of the marshalled public key. Unknown
+// accounts are empty.
+func (l *Ledger) Account(key []byte) *Account {
+	l.Lock()
+	defer l.Unlock()
+	acc, exists := l.accounts[string(key)]
+	if !exists {
+		return &Account{}
+	}
+	cpy := *acc
+	return &cpy
+}
+
+func execute(accounts map[string]*Account, b *dfinity.Block) error {
+	txs, err := dfinity.DecodeTxs(b.Blob)
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		t, err := DecodeTransfer(tx)
+		if err != nil {
+			continue
+		}
+		from, exists := accounts[string(t.From)]
+		if !exists || from.Nonce != t.Nonce || from.Balance < t.Amount {
+			continue
+		}
+		to, exists := accounts[string(t.To)]
+		if exists && to != from && to.Balance > math.MaxUint64-t.Amount {
+			// the balance of the receiver would overflow
+			continue
+		}
+		if !exists {
+			to = &Account{}
+			accounts[string(t.To)] = to
+		}
+		from.Balance -= t.Amount
+		from.Nonce++
+		to.Balance += t.Amount
+	}
+	return nil
+}
+
+func rootOf(accounts map[string]*Account) []byte {
+	keys := make([]string, 0, len(accounts))
+	for k := range accounts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		var b bytes.Buffer
+		writeBytes(&b, []byte(k))
+		b.Write(accounts[k].Encode())
+		h.Write(b.Bytes())
+	}
+	return h.Sum(nil)
+}
+
+func writeBytes(b *bytes.Buffer, data []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	b.Write(size[:])
+	b.Write(data)
+}
+
+func writeUint64(b *bytes.Buffer, i uint64) {
+	var buff [8]byte
+	binary.BigEndian.PutUint64(buff[:], i)
+	b.Write(buff[:])
+}
+
+// reader decodes what writeBytes and writeUint64 encode, remembering the first
+// error
+type reader struct {
+	buff []byte
+	err  error
+}
+
+func (r *reader) bytes() []byte {
+	if r.err != nil || len(r.buff) < 4 {
+		r.err = errors.New("truncated")
+		return nil
+	}
+	size := binary.BigEndian.Uint32(r.buff)
+	r.buff = r.buff[4:]
+	if uint64(len(r.buff)) < uint64(size) {
+		r.err = errors.New("truncated")
+		return nil
+	}
+	data := r.buff[:size]
+	r.buff = r.buff[size:]
+	return data
+}
+
+func (r *reader) uint64() uint64 {
+	if r.err != nil || len(r.buff) < 8 {
+		r.err = errors.New("truncated")
+		return 0
+	}
+	i := binary.BigEndian.Uint64(r.buff)
+	r.buff = r.buff[8:]
+	return i
+}
@@ -0,0 +1,106 @@
+package ledger
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	dfinity "github.com/csanti/dfinity_experiments/service"
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/util/key"
+)
+
+func TestLedger(t *testing.T) {
+	alice := key.NewKeyPair(Suite)
+	bob := key.NewKeyPair(Suite)
+	state, err := GenesisState([]kyber.Point{alice.Public}, []uint64{100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New()
+	if err := l.InitChain(state); err != nil {
+		t.Fatal(err)
+	}
+
+	transfer := func(priv kyber.Scalar, to kyber.Point, amount, nonce uint64) []byte {
+		tr, err := NewTransfer(priv, to, amount, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tr.Encode()
+	}
+	valid := transfer(alice.Private, bob.Public, 30, 0)
+	if err := l.CheckTx(valid); err != nil {
+		t.Fatal(err)
+	}
+	if l.CheckTx(transfer(alice.Private, bob.Public, 300, 0)) == nil {
+		t.Fatal("transfer above the balance accepted")
+	}
+	if l.CheckTx(transfer(bob.Private, alice.Public, 1, 0)) == nil {
+		t.Fatal("transfer from an unknown account accepted")
+	}
+	forged := transfer(alice.Private, bob.Public, 30, 0)
+	forged[len(forged)-1] ^= 1
+	if l.CheckTx(forged) == nil {
+		t.Fatal("transfer with an invalid signature accepted")
+	}
+
+	// the replay of the first transfer must be skipped
+	txs := [][]byte{valid, valid, transfer(alice.Private, bob.Public, 20, 1)}
+	block := &dfinity.Block{Blob: dfinity.EncodeTxs(txs)}
+	speculated, err := l.SpeculateRoot([]*dfinity.Block{block})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.DeliverBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	root, err := l.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, speculated) {
+		t.Fatal("speculated root differs from the committed one")
+	}
+
+	alicePub, _ := alice.Public.MarshalBinary()
+	bobPub, _ := bob.Public.MarshalBinary()
+	if acc := l.Account(alicePub); acc.Balance != 50 || acc.Nonce != 2 {
+		t.Fatal("wrong account for alice:", acc)
+	}
+	buff, err := l.Query(QueryBalance, bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc, err := DecodeAccount(buff); err != nil || acc.Balance != 50 || acc.Nonce != 0 {
+		t.Fatal("wrong account for bob:", acc, err)
+	}
+}
+
+func TestLedgerOverflow(t *testing.T) {
+	alice := key.NewKeyPair(Suite)
+	bob := key.NewKeyPair(Suite)
+	state, err := GenesisState([]kyber.Point{alice.Public, bob.Public}, []uint64{10, math.MaxUint64 - 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New()
+	if err := l.InitChain(state); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := NewTransfer(alice.Private, bob.Public, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.CheckTx(tr.Encode()) == nil {
+		t.Fatal("transfer overflowing the receiver accepted")
+	}
+	if err := l.DeliverBlock(&dfinity.Block{Blob: dfinity.EncodeTxs([][]byte{tr.Encode()})}); err != nil {
+		t.Fatal(err)
+	}
+	alicePub, _ := alice.Public.MarshalBinary()
+	bobPub, _ := bob.Public.MarshalBinary()
+	if l.Account(alicePub).Balance != 10 || l.Account(bobPub).Balance != math.MaxUint64-5 {
+		t.Fatal("overflowing transfer executed")
+	}
+}
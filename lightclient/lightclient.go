@@ -0,0 +1,159 @@
+// Package lightclient follows the chain of a dfinity network without running a
+// node: it only downloads block headers with their notarization and checks
+// them against the group public key of the notarizers.
+package lightclient
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	dfinity "github.com/csanti/dfinity_experiments/service"
+	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/share"
+	"go.dedis.ch/kyber/sign/bls"
+)
+
+// LightClient keeps the last verified header of the chain. Every new header
+// must reference it by hash and carry a valid threshold signature of the
+// notarizers.
+type LightClient struct {
+	sync.Mutex
+	client  *dfinity.Client
+	chainID string
+	public  kyber.Point // group public key of the notarizers
+	head    *dfinity.BlockHeader
+}
+
+// New returns a light client trusting the given genesis
+func New(s network.Suite, g *dfinity.Genesis) *LightClient {
+	pub := share.NewPubPoly(dfinity.G2, dfinity.G2.Point().Base(), g.Public)
+	return NewFromHeader(s, g.ChainID, pub.Commit(), &g.Block().BlockHeader)
+}
+
+// NewFromHeader returns a light client trusting the given group public key and
+// header, e.g. a recent one obtained out of band
+func NewFromHeader(s network.Suite, chainID string, public kyber.Point, head *dfinity.BlockHeader) *LightClient {
+	return &LightClient{
+		client:  dfinity.NewClient(s),
+		chainID: chainID,
+		public:  public,
+		head:    head,
+	}
+}
+
+// NewFromCheckpoint returns a light client trusting the header of a signed
+// checkpoint, instead of going through the whole chain from the genesis
+func NewFromCheckpoint(s network.Suite, public []kyber.Point, cp *dfinity.SignedCheckpoint, head *dfinity.BlockHeader) (*LightClient, error) {
+	if err := cp.Verify(public); err != nil {
+		return nil, fmt.Errorf("lightclient: invalid checkpoint: %s", err)
+	}
+	if head.Hash() != cp.Checkpoint.Hash || head.ChainID != cp.Checkpoint.ChainID {
+		return nil, errors.New("lightclient: header does not match the checkpoint")
+	}
+	pub := share.NewPubPoly(dfinity.G2, dfinity.G2.Point().Base(), public)
+	return NewFromHeader(s, head.ChainID, pub.Commit(), head), nil
+}
+
+// Head returns the last verified header
+func (l *LightClient) Head() *dfinity.BlockHeader {
+	l.Lock()
+	defer l.Unlock()
+	return l.head
+}
+
+// Append verifies the headers one after the other on top of the current head
+// and moves the head forward. Headers at or below the head are ignored. It
+// stops at the first invalid header and returns the error, keeping the valid
+// ones before it.
+func (l *LightClient) Append(headers []*dfinity.NotarizedHeader) error {
+	l.Lock()
+	defer l.Unlock()
+	for _, nh := range headers {
+		if nh.Header == nil || nh.Header.Round <= l.head.Round {
+			continue
+		}
+		if err := l.verify(nh); err != nil {
+			return fmt.Errorf("lightclient: header of round %d: %s", nh.Header.Round, err)
+		}
+		l.head = nh.Header
+	}
+	return nil
+}
+
+// verify checks the header extends the current head
+func (l *LightClient) verify(nh *dfinity.NotarizedHeader) error {
+	h := nh.Header
+	if h.ChainID != l.chainID {
+		return errors.New("wrong chain id")
+	}
+	if h.PrvHash != l.head.Hash() {
+		return errors.New("does not reference the head")
+	}
+	// the genesis is not signed, any other parent is and the header must
+	// carry its notarization
+	if l.head.Round > 0 {
+		if err := bls.Verify(dfinity.Suite, l.public, l.head.SigningMessage(), h.PrvSig); err != nil {
+			return fmt.Errorf("invalid previous signature: %s", err)
+		}
+	}
+	if err := bls.Verify(dfinity.Suite, l.public, h.SigningMessage(), nh.Signature); err != nil {
+		return fmt.Errorf("invalid notarization: %s", err)
+	}
+	return nil
+}
+
+// Update downloads and verifies all the headers the node finalized after the
+// head. It returns how many headers were added.
+func (l *LightClient) Update(si *network.ServerIdentity) (int, error) {
+	var added int
+	for {
+		start := l.Head().Round
+		headers, err := l.client.Headers(si, start+1, dfinity.MaxHeaders)
+		if err != nil {
+			return added, err
+		}
+		if err := l.Append(headers); err != nil {
+			return added, err
+		}
+		round := l.Head().Round
+		added += countBetween(headers, start, round)
+		if len(headers) < dfinity.MaxHeaders || round == start {
+			return added, nil
+		}
+	}
+}
+
+func countBetween(headers []*dfinity.NotarizedHeader, start, end int) int {
+	var n int
+	for _, nh := range headers {
+		if nh.Header != nil && nh.Header.Round > start && nh.Header.Round <= end {
+			n++
+		}
+	}
+	return n
+}
+
+// Follow polls the node every period and calls fn with every new head until
+// stop is closed.
+func (l *LightClient) Follow(si *network.ServerIdentity, period time.Duration, stop chan bool, fn func(*dfinity.BlockHeader)) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		n, err := l.Update(si)
+		if err != nil {
+			log.Error("lightclient:", err)
+		}
+		if n > 0 {
+			fn(l.Head())
+		}
+	}
+}
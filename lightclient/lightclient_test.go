@@ -0,0 +1,56 @@
+package lightclient
+
+import (
+	"testing"
+
+	dfinity "github.com/csanti/dfinity_experiments/service"
+	"go.dedis.ch/kyber/sign/bls"
+	"go.dedis.ch/kyber/util/random"
+)
+
+func TestLightClientAppend(t *testing.T) {
+	secret := dfinity.G2.Scalar().Pick(random.New())
+	public := dfinity.G2.Point().Mul(secret, nil)
+	genesis := &dfinity.BlockHeader{ChainID: "test", Owner: -1}
+	l := NewFromHeader(nil, "test", public, genesis)
+
+	var headers []*dfinity.NotarizedHeader
+	prv, prvSig := genesis, []byte(nil)
+	for round := 1; round <= 3; round++ {
+		h := &dfinity.BlockHeader{
+			ChainID: "test",
+			Round:   round,
+			PrvHash: prv.Hash(),
+			PrvSig:  prvSig,
+		}
+		sig, err := bls.Sign(dfinity.Suite, secret, h.SigningMessage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, &dfinity.NotarizedHeader{Header: h, Signature: sig})
+		prv, prvSig = h, sig
+	}
+
+	// a wrong notarization stops the light client before that header
+	forged := *headers[1]
+	forged.Signature = headers[0].Signature
+	if err := l.Append([]*dfinity.NotarizedHeader{headers[0], &forged}); err == nil {
+		t.Fatal("forged notarization accepted")
+	}
+	if l.Head().Round != 1 {
+		t.Fatal("head should stay at the last valid header")
+	}
+	if err := l.Append(headers); err != nil {
+		t.Fatal(err)
+	}
+	if l.Head().Round != 3 {
+		t.Fatal("head should be at round 3")
+	}
+
+	// a header not linked to the head is refused
+	other := &dfinity.BlockHeader{ChainID: "test", Round: 4, PrvHash: genesis.Hash()}
+	sig, _ := bls.Sign(dfinity.Suite, secret, other.SigningMessage())
+	if l.Append([]*dfinity.NotarizedHeader{{Header: other, Signature: sig}}) == nil {
+		t.Fatal("unlinked header accepted")
+	}
+}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber"
+)
+
+func init() {
+	network.RegisterMessages(&KeyRequest{}, &KeyReply{}, &TxRequest{}, &TxReply{},
+		&QueryRequest{}, &QueryReply{}, &HeadersRequest{}, &HeadersReply{},
+		&CheckpointRequest{}, &CheckpointReply{}, &SnapshotRequest{}, &SnapshotReply{},
+		&BlocksRequest{}, &BlocksReply{}, &TreeRequest{}, &TreeReply{},
+		&SubscribeRequest{}, &BlockEventReply{})
+}
+
+// KeyRequest asks a node for the value of a key of its key-value store
+type KeyRequest struct {
+	Key []byte
+}
+
+// KeyReply holds the proof of presence or absence of the requested key
+// against the state root of the given round
+type KeyReply struct {
+	Proof *KVProof
+	Root  []byte
+	Round int
+}
+
+// TxRequest submits a transaction to the block makers through a node
+type TxRequest struct {
+	Tx []byte
+}
+
+// TxReply is returned once the transaction has been accepted by the node
+type TxReply struct{}
+
+// QueryRequest is a read request for the application running on a node
+type QueryRequest struct {
+	Path string
+	Data []byte
+}
+
+// QueryReply holds the answer of the application along with the last round it
+// executed
+type QueryReply struct {
+	Data  []byte
+	Round int
+}
+
+// MaxHeaders is the maximum number of headers a node returns at once
+const MaxHeaders = 256
+
+// HeadersRequest asks for the headers of the finalized chain starting at
+// the given round
+type HeadersRequest struct {
+	From int
+	Max  int
+}
+
+// NotarizedHeader is a block header without its body, along with the threshold
+// signature of the notarizers over it
+type NotarizedHeader struct {
+	Header    *BlockHeader
+	Signature []byte
+}
+
+// HeadersReply holds consecutive headers of the finalized chain
+type HeadersReply struct {
+	Headers []*NotarizedHeader
+}
+
+// CheckpointRequest asks for the signed checkpoint at the given height, or the
+// latest one if 0
+type CheckpointRequest struct {
+	Height int
+}
+
+// CheckpointReply holds the requested checkpoint
+type CheckpointReply struct {
+	Checkpoint *SignedCheckpoint
+}
+
+// SnapshotRequest asks for the application snapshot taken at the given height
+type SnapshotRequest struct {
+	Height int
+}
+
+// SnapshotReply holds the requested snapshot
+type SnapshotReply struct {
+	Snapshot *StateSnapshot
+}
+
+// MaxBlocks is the maximum number of blocks a node returns at once
+const MaxBlocks = 64
+
+// BlocksRequest asks for the blocks of the finalized chain starting at the
+// given round
+type BlocksRequest struct {
+	From int
+	Max  int
+}
+
+// BlocksReply holds consecutive blocks of the finalized chain, along with the
+// notarized blocks the node did not finalize yet
+type BlocksReply struct {
+	Blocks  []*NotarizedBlock
+	Pending []*NotarizedBlock
+}
+
+// TreeRequest asks a node for the tree of the notarized blocks it has seen. It
+// is meant for debugging.
+type TreeRequest struct{}
+
+// TreeReply holds the tree of the notarized blocks of a node
+type TreeReply struct {
+	Tree *BlockTree
+}
+
+// SubscribeRequest streams the block events of a node. With From >= 0, the
+// finalized blocks from that round on are replayed first, see
+// Dfinity.Subscribe.
+type SubscribeRequest struct {
+	From int
+}
+
+// BlockEventReply is a block event streamed to a subscriber. The last reply of
+// a stream ended by the node holds the error, without block.
+type BlockEventReply struct {
+	Block     *NotarizedBlock
+	Finalized bool
+	Error     string
+}
+
+// Client talks to the dfinity service of the nodes
+type Client struct {
+	*onet.Client
+}
+
+// NewClient returns a client using the given suite to talk to the nodes
+func NewClient(s network.Suite) *Client {
+	return &Client{Client: onet.NewClient(s, Name)}
+}
+
+// GetKey asks the node for the given key and checks the proof of the reply
+// against the returned state root. The root itself is only as trustworthy as
+// the node answering.
+func (c *Client) GetKey(si *network.ServerIdentity, key []byte) (*KeyReply, error) {
+	reply := new(KeyReply)
+	if err := c.SendProtobuf(si, &KeyRequest{Key: key}, reply); err != nil {
+		return nil, err
+	}
+	if err := VerifyKVProof(reply.Root, reply.Proof); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// SubmitTx sends the transaction to the node which forwards it to the block
+// makers
+func (c *Client) SubmitTx(si *network.ServerIdentity, tx []byte) error {
+	return c.SendProtobuf(si, &TxRequest{Tx: tx}, &TxReply{})
+}
+
+// Query sends a read request to the application running on the node
+func (c *Client) Query(si *network.ServerIdentity, path string, data []byte) (*QueryReply, error) {
+	reply := new(QueryReply)
+	if err := c.SendProtobuf(si, &QueryRequest{Path: path, Data: data}, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Headers returns at most max headers of the finalized chain of the node
+// starting from the given round. Headers are not verified, see the lightclient
+// package.
+func (c *Client) Headers(si *network.ServerIdentity, from, max int) ([]*NotarizedHeader, error) {
+	reply := new(HeadersReply)
+	if err := c.SendProtobuf(si, &HeadersRequest{From: from, Max: max}, reply); err != nil {
+		return nil, err
+	}
+	return reply.Headers, nil
+}
+
+// Checkpoint returns the signed checkpoint of the node at the given height, or
+// the latest one if 0. Its signature is checked against the given public
+// polynomial of the notarizers.
+func (c *Client) Checkpoint(si *network.ServerIdentity, height int, public []kyber.Point) (*SignedCheckpoint, error) {
+	reply := new(CheckpointReply)
+	if err := c.SendProtobuf(si, &CheckpointRequest{Height: height}, reply); err != nil {
+		return nil, err
+	}
+	if reply.Checkpoint == nil {
+		return nil, errors.New("no checkpoint in reply")
+	}
+	if err := reply.Checkpoint.Verify(public); err != nil {
+		return nil, err
+	}
+	return reply.Checkpoint, nil
+}
+
+// Snapshot returns the application snapshot of the node at the given height.
+// It is not verified, see Dfinity.FastSync.
+func (c *Client) Snapshot(si *network.ServerIdentity, height int) (*StateSnapshot, error) {
+	reply := new(SnapshotReply)
+	if err := c.SendProtobuf(si, &SnapshotRequest{Height: height}, reply); err != nil {
+		return nil, err
+	}
+	if reply.Snapshot == nil {
+		return nil, errors.New("no snapshot in reply")
+	}
+	return reply.Snapshot, nil
+}
+
+// Blocks returns at most max blocks of the finalized chain of the node starting
+// from the given round, and its pending notarized blocks. Blocks are not
+// verified, see Dfinity.FastSync.
+func (c *Client) Blocks(si *network.ServerIdentity, from, max int) (*BlocksReply, error) {
+	reply := new(BlocksReply)
+	if err := c.SendProtobuf(si, &BlocksRequest{From: from, Max: max}, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Tree returns the tree of the notarized blocks seen by the node, to be
+// exported with BlockTree.DOT or BlockTree.JSON
+func (c *Client) Tree(si *network.ServerIdentity) (*BlockTree, error) {
+	reply := new(TreeReply)
+	if err := c.SendProtobuf(si, &TreeRequest{}, reply); err != nil {
+		return nil, err
+	}
+	if reply.Tree == nil {
+		return nil, errors.New("no tree in reply")
+	}
+	return reply.Tree, nil
+}
+
+// Subscribe streams the block events of the node from the given round, or only
+// the new ones if negative. Each BlockEventReply is read from the returned
+// connection with ReadMessage. Slow subscribers are dropped by the node and
+// can subscribe again from the last finalized round they got.
+func (c *Client) Subscribe(si *network.ServerIdentity, from int) (onet.StreamingConn, error) {
+	return c.Stream(si, &SubscribeRequest{From: from})
+}
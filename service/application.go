@@ -0,0 +1,108 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// applications maps application names to their constructor
+var applications = make(map[string]func() Application)
+
+// RegisterApplication makes the application available under the given name,
+// so nodes can start it from their config
+func RegisterApplication(name string, fn func() Application) {
+	applications[name] = fn
+}
+
+// NewApplication returns a fresh instance of the application registered under
+// the given name
+func NewApplication(name string) (Application, error) {
+	fn, exists := applications[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown application %q", name)
+	}
+	return fn(), nil
+}
+
+// Application is a replicated state machine running on top of the consensus.
+// Every node delivers it the finalized blocks, in order, so all instances go
+// through the same sequence of states. Its methods can be called concurrently.
+type Application interface {
+	// InitChain loads the initial application state given by the genesis
+	InitChain(state []byte) error
+	// CheckTx returns an error if the transaction can't be executed against
+	// the current state. Block makers call it before accepting a transaction
+	// in their pool.
+	CheckTx(tx []byte) error
+	// DeliverBlock executes all the transactions of the given finalized
+	// block. The same transaction can show up in several blocks since every
+	// block maker proposes it, the application must reject replays.
+	DeliverBlock(b *Block) error
+	// Commit persists the state reached after the last delivered block and
+	// returns its root.
+	Commit() ([]byte, error)
+}
+
+// Speculator is implemented by applications that can compute the state root
+// resulting from blocks not finalized yet, without modifying their state.
+// Block makers use it to fill BlockHeader.StateRoot with the state root
+// resulting from the block they build on.
+type Speculator interface {
+	// SpeculateRoot returns the state root after executing the given blocks,
+	// in order, on top of the committed state
+	SpeculateRoot(blocks []*Block) ([]byte, error)
+}
+
+// Querier is implemented by applications answering read requests from
+// clients. The path selects the kind of request and data holds its argument,
+// both are application specific.
+type Querier interface {
+	Query(path string, data []byte) ([]byte, error)
+}
+
+// Snapshotter is implemented by applications whose committed state can be
+// exported and restored, so new nodes can start from a checkpoint instead of
+// replaying every block since the genesis.
+type Snapshotter interface {
+	// Snapshot returns the committed state
+	Snapshot() ([]byte, error)
+	// Restore replaces the whole state by the snapshot. Commit is called
+	// right after.
+	Restore(snapshot []byte) error
+}
+
+// EncodeTxs encodes a list of transactions into a block blob. Each
+// transaction is prefixed by its length on 4 bytes.
+func EncodeTxs(txs [][]byte) []byte {
+	var size int
+	for _, tx := range txs {
+		size += 4 + len(tx)
+	}
+	blob := make([]byte, 0, size)
+	var buff [4]byte
+	for _, tx := range txs {
+		binary.BigEndian.PutUint32(buff[:], uint32(len(tx)))
+		blob = append(blob, buff[:]...)
+		blob = append(blob, tx...)
+	}
+	return blob
+}
+
+// DecodeTxs returns the list of transactions contained in a block blob
+func DecodeTxs(blob []byte) ([][]byte, error) {
+	var txs [][]byte
+	for len(blob) > 0 {
+		if len(blob) < 4 {
+			return nil, errors.New("truncated transaction length")
+		}
+		size := binary.BigEndian.Uint32(blob)
+		blob = blob[4:]
+		if uint64(len(blob)) < uint64(size) {
+			return nil, errors.New("truncated transaction")
+		}
+		txs = append(txs, blob[:size])
+		blob = blob[size:]
+	}
+	return txs, nil
+}
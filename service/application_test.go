@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestEncodeTxs(t *testing.T) {
+	txs := [][]byte{[]byte("first"), {}, []byte("third transaction")}
+	decoded, err := DecodeTxs(EncodeTxs(txs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(txs) {
+		t.Fatal("expected", len(txs), "transactions, got", len(decoded))
+	}
+	for i := range txs {
+		if !bytes.Equal(decoded[i], txs[i]) {
+			t.Fatal("wrong transaction at", i)
+		}
+	}
+	if txs, err := DecodeTxs(EncodeTxs(nil)); err != nil || len(txs) != 0 {
+		t.Fatal("empty blob not decoded", err)
+	}
+
+	blob := EncodeTxs(txs)
+	for _, truncated := range [][]byte{blob[:2], blob[:7], blob[:len(blob)-1]} {
+		if _, err := DecodeTxs(truncated); err == nil {
+			t.Fatal("truncated blob of", len(truncated), "bytes accepted")
+		}
+	}
+}
+
+// recordingApp keeps the rounds of the blocks delivered to it
+type recordingApp struct {
+	sync.Mutex
+	rounds []int
+}
+
+func (a *recordingApp) InitChain(state []byte) error { return nil }
+func (a *recordingApp) CheckTx(tx []byte) error      { return nil }
+func (a *recordingApp) Commit() ([]byte, error)      { return []byte{byte(len(a.rounds))}, nil }
+func (a *recordingApp) DeliverBlock(b *Block) error {
+	a.Lock()
+	defer a.Unlock()
+	a.rounds = append(a.rounds, b.Round)
+	return nil
+}
+
+func TestFinalizerDeliver(t *testing.T) {
+	g := &Genesis{ChainID: "deliver", BlockMakerNb: 1, BeaconSeed: 1}
+	c := &Config{ChainID: "deliver", Genesis: g, BlockMakerNb: 1}
+	finalized := make(chan int, 10)
+	f := NewFinalizer(c, new(Chain), func(round int) { finalized <- round })
+	app := new(recordingApp)
+	if err := f.SetApplication(app); err != nil {
+		t.Fatal(err)
+	}
+
+	parent := g.NotarizedBlock()
+	for round := 1; round <= 5; round++ {
+		b := &Block{BlockHeader: BlockHeader{
+			ChainID:    "deliver",
+			Round:      round,
+			Randomness: int64(round),
+			PrvHash:    parent.BlockHeader.Hash(),
+		}}
+		parent = &NotarizedBlock{Block: b, Notarization: &Notarization{Hash: b.BlockHeader.Hash()}}
+		f.Store(parent)
+		<-finalized
+	}
+
+	// the finalization of a round delivers the block of two rounds before
+	app.Lock()
+	defer app.Unlock()
+	if len(app.rounds) != 3 {
+		t.Fatal("expected 3 delivered blocks, got", app.rounds)
+	}
+	for i, round := range app.rounds {
+		if round != i+1 {
+			t.Fatal("blocks delivered out of order:", app.rounds)
+		}
+	}
+	if !bytes.Equal(f.stateRoot, []byte{3}) {
+		t.Fatal("state root not committed after delivery")
+	}
+}
+
+func TestSubmitTxNotConfigured(t *testing.T) {
+	if err := new(Dfinity).SubmitTx([]byte("tx")); err == nil {
+		t.Fatal("transaction accepted by a node without config")
+	}
+}
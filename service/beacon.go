@@ -3,15 +3,19 @@ package service
 import (
 	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/csanti/onet"
 	"github.com/csanti/onet/log"
 	"github.com/csanti/onet/network"
 )
 
-const seed = 1234567890
 const BeaconServiceName = "beacon"
 
+// beaconHistory is the number of past beacons kept to be resent to lagging
+// nodes
+const beaconHistory = 32
+
 // Beacon produces a new random value every new round and broadcasts it
 type Beacon struct {
 	sync.Mutex
@@ -21,19 +25,37 @@ type Beacon struct {
 	round     int
 	broadcast BroadcastFn
 	fin       *Finalizer
+	metrics   *Metrics
+	tracer    *Tracer
+	// beacons of the last rounds mapped from their round
+	beacons map[int]*BeaconPacket
+	// sends a message to a node
+	send func(*network.ServerIdentity, interface{}) error
+	// true once the beacon got replaced after a reconfiguration
+	stopped bool
 }
 
-// NewBeaconProcess returns a fresh Beacon process
+// NewBeaconProcess returns a fresh Beacon process seeded from the genesis
 func NewBeaconProcess(c *onet.Context, conf *Config, b BroadcastFn) *Beacon {
-	return &Beacon{
+	beacon := &Beacon{
 		c:                conf,
-		r:                rand.New(rand.NewSource(seed)),
+		r:                rand.New(rand.NewSource(conf.Seed)),
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		broadcast:        b,
+		metrics:          metricsOf(conf),
+		tracer:           tracerOf(conf),
+		beacons:          make(map[int]*BeaconPacket),
 	}
+	beacon.send = beacon.SendRaw
+	return beacon
 }
 
-// Process analyzes incoming packets
+// Process analyzes incoming packets. A notarized block of a round implies all
+// the previous rounds have been notarized as well, so the beacon does not wait
+// for the notarized blocks it missed: it catches up to the highest round seen,
+// whatever the order in which they arrive. Notarized blocks and skip
+// certificates reach the beacon once verified by the service, see
+// Dfinity.Process.
 func (b *Beacon) Process(e *network.Envelope) {
 	b.Lock()
 	defer b.Unlock()
@@ -41,8 +63,17 @@ func (b *Beacon) Process(e *network.Envelope) {
 	case *BeaconPacket:
 		// special case when we have different randomness beacon and only one is
 		// starting, or when one beacon is late behind
-		b.round++
+		b.catchUp(inner.Round)
 	case *NotarizedBlock:
+		if inner.Round < b.round-1 {
+			// the sender did not see the last beacons
+			b.resend(e.ServerIdentity, inner.Round+1)
+		}
+		b.catchUp(inner.Round)
+		b.NewRound(inner.Round)
+	case *SkipCertificate:
+		// a skipped round ends like a notarized one
+		b.catchUp(inner.Round)
 		b.NewRound(inner.Round)
 	default:
 		panic("beacon: should not happen")
@@ -51,28 +82,107 @@ func (b *Beacon) Process(e *network.Envelope) {
 
 // NewRound generates the new randomness and sends its to all other nodes
 func (b *Beacon) NewRound(r int) {
-	if r > b.c.RoundsToSimulate {
+	if b.stopped || r > b.c.RoundsToSimulate {
 		return
 	}
 	if r != b.round {
 		log.Lvl2("beacon service received different round")
 		return
 	}
+	packet := b.next()
+	nodes := b.nodes()
+	for _, si := range nodes {
+		go b.send(si, packet)
+	}
+	b.metrics.Round.Set(float64(b.round))
+	b.metrics.Sent(packet, len(nodes))
+	b.tracer.Event(EventBeaconSent, b.round, "")
+	log.Lvl1("beacon: new round started ", b.round)
+}
+
+// next draws the randomness of the next round
+func (b *Beacon) next() *BeaconPacket {
 	b.round++
-	nextRandomness := b.r.Int63()
 	packet := &BeaconPacket{
 		Round:      b.round,
-		Randomness: nextRandomness,
+		Randomness: b.r.Int63(),
 	}
-	for _, si := range append(b.c.NotarizerNodes(), b.c.BlockMakerNodes()...) {
-		go b.SendRaw(si, packet)
+	b.beacons[b.round] = packet
+	delete(b.beacons, b.round-beaconHistory)
+	return packet
+}
+
+// catchUp draws the randomness of all rounds up to r without sending it, so
+// the beacon keeps the same sequence as the one which sent them
+func (b *Beacon) catchUp(r int) {
+	if r > b.round {
+		log.Lvl2("beacon: catching up from round", b.round, "to", r)
 	}
-	log.Lvl1("beacon: new round started ", b.round)
+	for b.round < r {
+		b.next()
+	}
+}
+
+// resend sends the beacons from the given round on to a lagging node
+func (b *Beacon) resend(si *network.ServerIdentity, from int) {
+	var sent int
+	for r := from; r <= b.round; r++ {
+		if packet, exists := b.beacons[r]; exists {
+			go b.send(si, packet)
+			sent++
+		}
+	}
+	b.metrics.Sent(b.beacons[b.round], sent)
 }
 
-// Start runs the first round
+// resendLoop resends the latest beacon to all nodes whenever a whole period
+// went by without the round advancing, so nodes which missed it can go on
+func (b *Beacon) resendLoop() {
+	period := b.c.BeaconResend
+	last := -1
+	for range time.Tick(period) {
+		b.Lock()
+		if b.stopped || b.round > b.c.RoundsToSimulate {
+			b.Unlock()
+			return
+		}
+		if packet, exists := b.beacons[b.round]; exists && b.round == last {
+			log.Lvl2("beacon: no progress, resending beacon of round", b.round)
+			nodes := b.nodes()
+			for _, si := range nodes {
+				go b.send(si, packet)
+			}
+			b.metrics.Sent(packet, len(nodes))
+		}
+		last = b.round
+		b.Unlock()
+	}
+}
+
+// Stop makes the beacon stop sending beacons
+func (b *Beacon) Stop() {
+	b.Lock()
+	defer b.Unlock()
+	b.stopped = true
+}
+
+// nodes returns the nodes receiving the beacons
+func (b *Beacon) nodes() []*network.ServerIdentity {
+	return append(b.c.NotarizerNodes(), b.c.BlockMakerNodes()...)
+}
+
+// Start waits for the genesis time and runs the first round
 func (b *Beacon) Start() {
+	if wait := time.Until(b.c.Genesis.Time); wait > 0 {
+		log.Lvl1("beacon: waiting", wait, "for the genesis time")
+		time.Sleep(wait)
+	}
+	b.Lock()
 	b.NewRound(0)
+	b.Unlock()
+	if b.c.BeaconResend > 0 {
+		go b.resendLoop()
+	}
 }
 
 // Permutation returns the mapping from oroginal index to the new index in order
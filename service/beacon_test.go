@@ -0,0 +1,163 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber/sign/tbls"
+	"go.dedis.ch/kyber/util/random"
+)
+
+// testBeacon returns a beacon whose sent packets are kept by destination, and
+// a function notarizing blocks with the key of the notarizers
+func testBeacon(t *testing.T) (*Beacon, map[network.ServerIdentityID][]*BeaconPacket, *sync.Mutex, func(*Block) *NotarizedBlock) {
+	var list []*network.ServerIdentity
+	for i := 0; i < 4; i++ {
+		addr := network.Address(fmt.Sprintf("tcp://127.0.0.1:%d", 7200+i))
+		list = append(list, network.NewServerIdentity(G2.Point().Pick(random.New()), addr))
+	}
+	shares, public := dkg(2, 2)
+	_, commits := public.Info()
+	g := &Genesis{ChainID: "beacon", Roster: onet.NewRoster(list), BeaconNb: 1, BlockMakerNb: 1, NotarizerNb: 2,
+		Threshold: 2, Public: commits, BeaconSeed: 1}
+	c := g.Config(0)
+	c.RoundsToSimulate = 100
+	b := NewBeaconProcess(nil, c, nil)
+	var mut sync.Mutex
+	sent := make(map[network.ServerIdentityID][]*BeaconPacket)
+	b.send = func(si *network.ServerIdentity, msg interface{}) error {
+		mut.Lock()
+		defer mut.Unlock()
+		sent[si.ID] = append(sent[si.ID], msg.(*BeaconPacket))
+		return nil
+	}
+	notarize := func(block *Block) *NotarizedBlock {
+		msg := block.BlockHeader.SigningMessage()
+		var sigs [][]byte
+		for _, s := range shares {
+			sig, err := tbls.Sign(Suite, s, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sigs = append(sigs, sig)
+		}
+		sig, err := tbls.Recover(Suite, public, msg, sigs, 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &NotarizedBlock{Block: block, Notarization: &Notarization{Hash: block.BlockHeader.Hash(), Signature: sig}}
+	}
+	return b, sent, &mut, notarize
+}
+
+// waitFor waits until the condition holds under the lock of the beacon
+func waitFor(t *testing.T, b *Beacon, cond func() bool) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		b.Lock()
+		ok := cond()
+		b.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatal("condition not reached in time")
+}
+
+func TestBeaconCatchUp(t *testing.T) {
+	b, sent, mut, notarize := testBeacon(t)
+	other := NewBeaconProcess(nil, b.c, nil)
+	for i := 0; i < 5; i++ {
+		other.next()
+	}
+	b.catchUp(5)
+	if b.round != 5 || b.beacons[5].Randomness != other.beacons[5].Randomness {
+		t.Fatal("catching up changed the randomness")
+	}
+
+	// a notarized block of a later round moves the beacon to the next round
+	b.Process(&network.Envelope{Msg: notarize(&Block{BlockHeader: BlockHeader{ChainID: "beacon", Round: 8}})})
+	if b.round != 9 {
+		t.Fatal("beacon did not catch up to round 9")
+	}
+	other.catchUp(9)
+	if b.beacons[9].Randomness != other.beacons[9].Randomness {
+		t.Fatal("wrong randomness after catching up")
+	}
+	mut.Lock()
+	defer mut.Unlock()
+	for _, si := range b.nodes() {
+		if packets := sent[si.ID]; len(packets) != 1 || packets[0].Round != 9 {
+			t.Fatal("beacon of round 9 not sent to", si)
+		}
+	}
+}
+
+func TestBeaconLaggingNode(t *testing.T) {
+	b, sent, mut, _ := testBeacon(t)
+	b.catchUp(6)
+	lagging := b.c.NotarizerNodes()[0]
+	// the node saw the notarized block of round 2 only
+	b.Process(&network.Envelope{ServerIdentity: lagging, Msg: &NotarizedBlock{
+		Block: &Block{BlockHeader: BlockHeader{Round: 2}},
+	}})
+	waitFor(t, b, func() bool {
+		mut.Lock()
+		defer mut.Unlock()
+		return len(sent[lagging.ID]) == 4
+	})
+	mut.Lock()
+	defer mut.Unlock()
+	rounds := make(map[int]bool)
+	for _, p := range sent[lagging.ID] {
+		rounds[p.Round] = true
+	}
+	for r := 3; r <= 6; r++ {
+		if !rounds[r] {
+			t.Fatal("beacon of round", r, "not resent")
+		}
+	}
+	if b.round != 6 || len(sent) != 1 {
+		t.Fatal("old notarized block moved the beacon")
+	}
+}
+
+func TestBeaconResendLoop(t *testing.T) {
+	b, sent, mut, _ := testBeacon(t)
+	b.c.BeaconResend = 10 * time.Millisecond
+	b.catchUp(1)
+	done := make(chan bool)
+	go func() {
+		b.resendLoop()
+		done <- true
+	}()
+	// without progress, the latest beacon gets resent to every node
+	waitFor(t, b, func() bool {
+		mut.Lock()
+		defer mut.Unlock()
+		for _, si := range b.nodes() {
+			if len(sent[si.ID]) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	mut.Lock()
+	for _, packets := range sent {
+		for _, p := range packets {
+			if p.Round != 1 {
+				t.Fatal("resent beacon of round", p.Round)
+			}
+		}
+	}
+	mut.Unlock()
+	b.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("resend loop still running after stop")
+	}
+}
@@ -2,8 +2,10 @@ package service
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/csanti/onet"
 	"github.com/csanti/onet/log"
@@ -20,18 +22,37 @@ type BlockMaker struct {
 	broadcast BroadcastFn
 	*sync.Cond
 	highestRound int
+	// application checking the transactions
+	app Application
+	// transactions waiting to be included in a block
+	mempool [][]byte
+	metrics *Metrics
+	tracer  *Tracer
+	// true once the block maker got replaced after a reconfiguration
+	stopped bool
 }
 
 // NewBlockMakerProcess returns a fresh block maker
 func NewBlockMakerProcess(c *onet.Context, conf *Config, b BroadcastFn) *BlockMaker {
-	chain := new(Chain)
+	return newBlockMaker(c, conf, b, nil)
+}
+
+// newBlockMaker returns a block maker going on with the given finalizer, or a
+// fresh one if nil
+func newBlockMaker(c *onet.Context, conf *Config, b BroadcastFn, fin *Finalizer) *BlockMaker {
+	if fin == nil {
+		fin = NewFinalizer(conf, NewChain(conf), nil)
+	}
+	fin.Reconfigure(conf, nil)
 	return &BlockMaker{
 		c:                conf,
 		ServiceProcessor: onet.NewServiceProcessor(c),
-		fin:              NewFinalizer(conf, chain, nil),
-		chain:            chain,
+		fin:              fin,
+		chain:            fin.chain,
 		broadcast:        b,
 		Cond:             sync.NewCond(new(sync.Mutex)),
+		metrics:          metricsOf(conf),
+		tracer:           tracerOf(conf),
 	}
 }
 
@@ -41,11 +62,26 @@ func (b *BlockMaker) Process(e *network.Envelope) {
 	defer b.Unlock()
 	switch inner := e.Msg.(type) {
 	case *BeaconPacket:
+		if inner.Round <= b.highestRound {
+			// beacon resent by the randomness beacon
+			return
+		}
+		b.highestRound = inner.Round
+		b.tracer.Event(EventBeaconReceived, inner.Round, "")
 		go b.NewRound(inner)
 	case *NotarizedBlock:
 		log.Lvl1("BlockMaker received notarized block for round", inner.Round)
+		b.tracer.Event(EventNotarizedReceived, inner.Round, inner.BlockHeader.Hash())
 		b.fin.Store(inner)
 		b.Cond.Broadcast()
+	case *SkipCertificate:
+		log.Lvl1("BlockMaker received skip certificate for round", inner.Round)
+		if err := verifySkip(b.c, inner); err != nil {
+			log.Lvl2("blockmaker: invalid skip certificate for round", inner.Round, ":", err)
+			return
+		}
+		b.fin.StoreSkip(inner)
+		b.Cond.Broadcast()
 	}
 }
 
@@ -54,35 +90,153 @@ func (b *BlockMaker) Process(e *network.Envelope) {
 func (b *BlockMaker) NewRound(p *BeaconPacket) {
 	b.Cond.L.Lock()
 	defer b.Cond.L.Unlock()
-	for b.fin.HighestRound() < p.Round-1 {
+	for !b.stopped && b.fin.HighestRound() < p.Round-1 {
 		log.Lvl1("blockmaker: waiting highest round go to ", p.Round-1)
 		b.Cond.Wait()
 	}
+	if b.stopped {
+		return
+	}
 	newRound := p.Round
+	b.metrics.Round.Set(float64(newRound))
 	oldBlock, err := b.fin.HighestChainHead(newRound - 1)
 	if err != nil {
 		fmt.Println(b.fin.notarized)
 		panic(err)
 	}
 	//blob := []byte(fmt.Sprintf("block data round %d owner %d", p.Round, b.c.Index))
-	blob := make([]byte, b.c.BlockSize)
-	rand.Read(blob)
+	var blob []byte
+	txs := b.nextTxs()
+	if b.app != nil {
+		blob = EncodeTxs(txs)
+	} else {
+		blob = make([]byte, b.c.BlockSize)
+		rand.Read(blob)
+		if len(txs) > 0 {
+			// reconfigurations go first, the random data after them
+			blob = EncodeTxs(append(txs, blob))
+		}
+	}
+
+	stateRoot, err := b.fin.StateRootAfter(oldBlock)
+	if err != nil {
+		log.Error("blockmaker: can't compute state root:", err)
+	}
 
 	hash := rootHash(blob)
 	header := BlockHeader{
+		ChainID:    b.c.ChainID,
 		Round:      newRound,
 		Owner:      b.c.Index - b.c.BeaconNb,
 		Root:       hash,
 		Randomness: p.Randomness,
 		PrvHash:    oldBlock.Block.BlockHeader.Hash(),
 		PrvSig:     oldBlock.Notarization.Signature,
+		StateRoot:  stateRoot,
 	}
 	blockProposal := &BlockProposal{
 		BlockHeader: header,
 		Blob:        blob,
 	}
+	// lower ranked makers wait before proposing and give up if a block of
+	// the round gets notarized in the meantime
+	weights := b.c.Weights(p.Randomness)
+	rank := b.c.BlockMakerNb - weights[header.Owner]
+	if delay := time.Duration(rank) * b.c.ProposalDelay; delay > 0 {
+		deadline := time.Now().Add(delay)
+		timer := time.AfterFunc(delay, b.wakeUp)
+		for time.Now().Before(deadline) && b.fin.HighestRound() < newRound {
+			b.Cond.Wait()
+		}
+		timer.Stop()
+		if b.fin.HighestRound() >= newRound {
+			log.Lvl2("blockmaker: round", newRound, "already notarized, dropping proposal of rank", rank)
+			b.metrics.Saved(blockProposal, len(b.c.NotarizerNodes()))
+			b.requeue(txs)
+			return
+		}
+	}
+
 	go b.broadcast(b.c.NotarizerNodes(), blockProposal)
+	b.tracer.Event(EventProposalSent, newRound, header.Hash())
 
-	weights := Weights(b.c.BlockMakerNb, p.Randomness)
 	log.Lvl1("blockmaker broadcasted block (weight", weights[header.Owner], ") ", header.Hash(), "on top of ", oldBlock.BlockHeader.Hash())
 }
+
+// Stop makes the rounds waiting on a notarized block return
+func (b *BlockMaker) Stop() {
+	b.Cond.L.Lock()
+	defer b.Cond.L.Unlock()
+	b.stopped = true
+	b.Cond.Broadcast()
+}
+
+// wakeUp wakes up the rounds waiting on a notarized block
+func (b *BlockMaker) wakeUp() {
+	b.Cond.L.Lock()
+	defer b.Cond.L.Unlock()
+	b.Cond.Broadcast()
+}
+
+// SetApplication sets the application checking incoming transactions and
+// executing the blocks finalized by this block maker. Blocks are then filled
+// with transactions instead of random data.
+func (b *BlockMaker) SetApplication(app Application) error {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.fin.SetApplication(app); err != nil {
+		return err
+	}
+	b.app = app
+	return nil
+}
+
+// AddTx checks the transaction against the application and adds it to the pool
+// of transactions to propose. A transaction leaves the pool as soon as it is
+// proposed, whether the block gets finalized or not. Transactions of proposals
+// dropped by lower ranked makers go back to the pool. Reconfigurations of the
+// roster are expected to be verified already and don't need an application.
+func (b *BlockMaker) AddTx(tx []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	if IsReconfigTx(tx) {
+		b.mempool = append(b.mempool, tx)
+		return nil
+	}
+	if b.app == nil {
+		return errors.New("blockmaker: no application set")
+	}
+	if 4+len(tx) > b.c.BlockSize {
+		return errors.New("blockmaker: transaction bigger than a block")
+	}
+	if err := b.app.CheckTx(tx); err != nil {
+		return err
+	}
+	b.mempool = append(b.mempool, tx)
+	return nil
+}
+
+// nextTxs pops the transactions of the pool that fit in a block
+func (b *BlockMaker) nextTxs() [][]byte {
+	b.Lock()
+	defer b.Unlock()
+	var size, i int
+	for ; i < len(b.mempool); i++ {
+		size += 4 + len(b.mempool[i])
+		if size > b.c.BlockSize {
+			break
+		}
+	}
+	txs := make([][]byte, i)
+	copy(txs, b.mempool)
+	b.mempool = b.mempool[i:]
+	return txs
+}
+
+// requeue puts the transactions of a dropped proposal back at the head of the
+// pool
+func (b *BlockMaker) requeue(txs [][]byte) {
+	b.Lock()
+	defer b.Unlock()
+	b.mempool = append(txs, b.mempool...)
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber/util/random"
+)
+
+func TestBlockMakerDroppedProposal(t *testing.T) {
+	var list []*network.ServerIdentity
+	for i := 0; i < 4; i++ {
+		addr := network.Address(fmt.Sprintf("tcp://127.0.0.1:%d", 7100+i))
+		list = append(list, network.NewServerIdentity(G2.Point().Pick(random.New()), addr))
+	}
+	g := &Genesis{ChainID: "dropped", Roster: onet.NewRoster(list), BeaconNb: 1, BlockMakerNb: 2, NotarizerNb: 1, BeaconSeed: 1}
+	beacon := &BeaconPacket{Round: 1, Randomness: 42}
+	// the lower ranked block maker of the round
+	c := g.Config(0)
+	for owner, w := range c.Weights(beacon.Randomness) {
+		if c.BlockMakerNb-w == 1 {
+			c = g.Config(g.BeaconNb + owner)
+		}
+	}
+	c.BlockSize = 1024
+	c.ProposalDelay = time.Hour
+	c.FinalizeTime = time.Hour
+
+	proposals := make(chan *BlockProposal, 1)
+	b := newBlockMaker(nil, c, func(sis []*network.ServerIdentity, msg interface{}) {
+		proposals <- msg.(*BlockProposal)
+	}, nil)
+	if err := b.SetApplication(new(recordingApp)); err != nil {
+		t.Fatal(err)
+	}
+	tx := []byte("transaction")
+	if err := b.AddTx(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the round is notarized before the delay of its rank is over
+	genesis := g.NotarizedBlock()
+	n := &Block{BlockHeader: BlockHeader{ChainID: "dropped", Round: 1, PrvHash: genesis.BlockHeader.Hash()}}
+	b.fin.Store(&NotarizedBlock{Block: n, Notarization: &Notarization{Hash: n.BlockHeader.Hash()}})
+	b.NewRound(beacon)
+	select {
+	case <-proposals:
+		t.Fatal("proposal of a notarized round sent")
+	default:
+	}
+	if len(b.mempool) != 1 {
+		t.Fatal("transaction of the dropped proposal lost")
+	}
+
+	// the next proposal carries it
+	c.ProposalDelay = 0
+	b.NewRound(&BeaconPacket{Round: 2, Randomness: 43})
+	p := <-proposals
+	txs, err := DecodeTxs(p.Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || string(txs[0]) != string(tx) || len(b.mempool) != 0 {
+		t.Fatal("transaction not proposed again")
+	}
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dedis/protobuf"
+)
+
+// ErrNotStored is returned by a BlockStore which holds no block for a round
+var ErrNotStored = errors.New("block not stored")
+
+// ErrEvicted is returned when blocks evicted from memory are requested from a
+// chain without store
+var ErrEvicted = errors.New("blocks evicted from memory and not stored")
+
+// BlockStore keeps the finalized blocks the chain does not hold in memory
+// anymore
+type BlockStore interface {
+	// Put stores the finalized block
+	Put(n *NotarizedBlock) error
+	// Get returns the finalized block of the round or ErrNotStored
+	Get(round int) (*NotarizedBlock, error)
+}
+
+// fileStore writes each block to its own file named after its round
+type fileStore struct {
+	dir string
+}
+
+// NewFileStore returns a block store writing to the given directory
+func NewFileStore(dir string) (BlockStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(round int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%010d.blk", round))
+}
+
+// Put implements the BlockStore interface
+func (s *fileStore) Put(n *NotarizedBlock) error {
+	buff, err := protobuf.Encode(n)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path(n.Round), buff, 0644)
+}
+
+// Get implements the BlockStore interface
+func (s *fileStore) Get(round int) (*NotarizedBlock, error) {
+	buff, err := ioutil.ReadFile(s.path(round))
+	if os.IsNotExist(err) {
+		return nil, ErrNotStored
+	} else if err != nil {
+		return nil, err
+	}
+	n := new(NotarizedBlock)
+	if err := protobuf.Decode(buff, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
@@ -0,0 +1,288 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/network"
+	"github.com/dedis/protobuf"
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/share"
+	"go.dedis.ch/kyber/sign/bls"
+	"go.dedis.ch/kyber/sign/tbls"
+)
+
+var CheckpointProposalType network.MessageTypeID
+var SignedCheckpointType network.MessageTypeID
+
+func init() {
+	CheckpointProposalType = network.RegisterMessage(&CheckpointProposal{})
+	SignedCheckpointType = network.RegisterMessage(&SignedCheckpoint{})
+}
+
+// CheckpointDomain is the domain separation tag of the message signed for a
+// checkpoint
+const CheckpointDomain = "dfinity-checkpoint"
+
+// Checkpoint summarizes the finalized chain at a given height
+type Checkpoint struct {
+	ChainID   string
+	Height    int    // number of finalized blocks, genesis included
+	Round     int    // round of the last finalized block
+	Hash      string // hash of the last finalized block
+	StateRoot []byte // application state root after the last finalized block
+}
+
+// CheckpointProposal is the partial signature of a notarizer over a checkpoint
+type CheckpointProposal struct {
+	Checkpoint *Checkpoint
+	Partial    []byte
+}
+
+// SignedCheckpoint is a checkpoint along with the threshold signature of the
+// notarizers. It can be used as a trust anchor instead of the genesis.
+type SignedCheckpoint struct {
+	Checkpoint *Checkpoint
+	Signature  []byte
+}
+
+// SigningMessage returns the message signed by the notarizers:
+//
+//	domain tag || chain id || height (8) || round (8) || hash || state root
+func (c *Checkpoint) SigningMessage() []byte {
+	var b bytes.Buffer
+	var buff [8]byte
+	writeBytes := func(data []byte) {
+		binary.BigEndian.PutUint32(buff[:4], uint32(len(data)))
+		b.Write(buff[:4])
+		b.Write(data)
+	}
+	writeInt := func(i int64) {
+		binary.BigEndian.PutUint64(buff[:], uint64(i))
+		b.Write(buff[:])
+	}
+	b.WriteString(CheckpointDomain)
+	writeBytes([]byte(c.ChainID))
+	writeInt(int64(c.Height))
+	writeInt(int64(c.Round))
+	writeBytes([]byte(c.Hash))
+	writeBytes(c.StateRoot)
+	return b.Bytes()
+}
+
+// Verify checks the signature of the checkpoint against the public polynomial
+// of the notarizers
+func (s *SignedCheckpoint) Verify(public []kyber.Point) error {
+	if s.Checkpoint == nil {
+		return errors.New("checkpoint: empty checkpoint")
+	}
+	pub := share.NewPubPoly(G2, G2.Point().Base(), public)
+	return bls.Verify(Suite, pub.Commit(), s.Checkpoint.SigningMessage(), s.Signature)
+}
+
+// checkpoints signs the checkpoints of the finalized chain together with the
+// other notarizers and keeps the signed ones. Nodes which are not notarizers
+// only keep the signed checkpoints they receive.
+type checkpoints struct {
+	sync.Mutex
+	c         *Config
+	keys      *keyring // nil if the node is not a notarizer
+	broadcast BroadcastFn
+	// partial signatures of the checkpoints being signed, mapped from their
+	// height, signing message and share index
+	partials map[int]map[string]map[int][]byte
+	// signed checkpoints mapped from their height
+	signed map[int]*SignedCheckpoint
+	latest *SignedCheckpoint
+	// where the signed checkpoints are written, none if empty
+	dir string
+}
+
+func newCheckpoints(c *Config, k *keyring, b BroadcastFn) *checkpoints {
+	cp := &checkpoints{
+		c:         c,
+		keys:      k,
+		broadcast: b,
+		partials:  make(map[int]map[string]map[int][]byte),
+		signed:    make(map[int]*SignedCheckpoint),
+	}
+	if c.BlockDir != "" {
+		cp.dir = filepath.Join(c.BlockDir, nodeFile(c))
+		if err := os.MkdirAll(cp.dir, 0755); err != nil {
+			log.Error("checkpoints: can't store checkpoints:", err)
+			cp.dir = ""
+		}
+		cp.load()
+	}
+	return cp
+}
+
+// load reads back the signed checkpoints of the chain this node wrote in its
+// directory, so they are still served after a restart
+func (cp *checkpoints) load() {
+	paths, err := filepath.Glob(filepath.Join(cp.dir, "checkpoint-*.cp"))
+	if err != nil {
+		log.Error("checkpoints: can't list checkpoints:", err)
+		return
+	}
+	for _, path := range paths {
+		s := new(SignedCheckpoint)
+		buff, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = protobuf.Decode(buff, s)
+		}
+		if err != nil {
+			log.Error("checkpoints: can't read", path, ":", err)
+			continue
+		}
+		if s.Checkpoint != nil && s.Checkpoint.ChainID == cp.c.ChainID {
+			cp.keep(s)
+		}
+	}
+}
+
+// carry takes the signed checkpoints of the previous process of this node,
+// which still hold once the roster changed
+func (cp *checkpoints) carry(old *checkpoints) {
+	if old == nil {
+		return
+	}
+	old.Lock()
+	defer old.Unlock()
+	cp.Lock()
+	defer cp.Unlock()
+	for height, s := range old.signed {
+		if _, exists := cp.signed[height]; !exists {
+			cp.keep(s)
+		}
+	}
+}
+
+// Sign signs the checkpoint with the share of this notarizer for the round of
+// the checkpoint and sends the partial signature to the other notarizers. It is
+// called by the finalizer every CheckpointInterval finalized blocks.
+func (cp *checkpoints) Sign(ckpt *Checkpoint) {
+	sig, err := tbls.Sign(Suite, cp.keys.At(ckpt.Round).c.Share, ckpt.SigningMessage())
+	if err != nil {
+		log.Error("checkpoints: can't sign:", err)
+		return
+	}
+	p := &CheckpointProposal{Checkpoint: ckpt, Partial: sig}
+	cp.AddPartial(p)
+	go cp.broadcast(cp.c.NotarizerNodes(), p)
+}
+
+// AddPartial stores a valid partial signature over a checkpoint. Once there
+// are enough of them for the same checkpoint, the signed checkpoint is kept and
+// sent to the nodes which are not notarizers.
+func (cp *checkpoints) AddPartial(p *CheckpointProposal) {
+	if cp.keys == nil || p.Checkpoint == nil || p.Checkpoint.ChainID != cp.c.ChainID {
+		return
+	}
+	key := cp.keys.At(p.Checkpoint.Round)
+	msg := p.Checkpoint.SigningMessage()
+	if err := key.verifier.Verify(msg, p.Partial); err != nil {
+		log.Lvl2("checkpoints: invalid partial signature:", err)
+		return
+	}
+	i, err := tbls.SigShare(p.Partial).Index()
+	if err != nil {
+		return
+	}
+	height := p.Checkpoint.Height
+
+	cp.Lock()
+	defer cp.Unlock()
+	if _, done := cp.signed[height]; done {
+		return
+	}
+	if cp.partials[height] == nil {
+		cp.partials[height] = make(map[string]map[int][]byte)
+	}
+	sigs := cp.partials[height][string(msg)]
+	if sigs == nil {
+		sigs = make(map[int][]byte)
+		cp.partials[height][string(msg)] = sigs
+	}
+	sigs[i] = p.Partial
+	if len(sigs) < key.c.Threshold {
+		return
+	}
+	signature, _, err := key.verifier.Recover(msg, sigs)
+	if err != nil {
+		log.Error("checkpoints: can't recover signature of height", height, ":", err)
+		return
+	}
+	s := &SignedCheckpoint{Checkpoint: p.Checkpoint, Signature: signature}
+	cp.store(s)
+	log.Lvl1("checkpoints: checkpoint signed at height", height, "round", p.Checkpoint.Round)
+	others := cp.c.Roster.List[:cp.c.BeaconNb+cp.c.BlockMakerNb]
+	go cp.broadcast(others, s)
+}
+
+// Add keeps a signed checkpoint received from a notarizer if it verifies
+// against the group key
+func (cp *checkpoints) Add(s *SignedCheckpoint) error {
+	if err := s.Verify(cp.c.Public); err != nil {
+		return err
+	}
+	if s.Checkpoint.ChainID != cp.c.ChainID {
+		return errors.New("checkpoints: checkpoint of another chain")
+	}
+	cp.Lock()
+	defer cp.Unlock()
+	if _, exists := cp.signed[s.Checkpoint.Height]; !exists {
+		cp.store(s)
+	}
+	return nil
+}
+
+// store keeps the signed checkpoint and forgets the partial signatures of the
+// heights up to it
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (cp *checkpoints) store(s *SignedCheckpoint) {
+	height := s.Checkpoint.Height
+	cp.keep(s)
+	for h := range cp.partials {
+		if h <= height {
+			delete(cp.partials, h)
+		}
+	}
+	if cp.dir == "" {
+		return
+	}
+	buff, err := protobuf.Encode(s)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(cp.dir, fmt.Sprintf("checkpoint-%010d.cp", height)), buff, 0644)
+	}
+	if err != nil {
+		log.Error("checkpoints: can't write checkpoint of height", height, ":", err)
+	}
+}
+
+// keep adds the signed checkpoint to the ones served
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (cp *checkpoints) keep(s *SignedCheckpoint) {
+	cp.signed[s.Checkpoint.Height] = s
+	if cp.latest == nil || cp.latest.Checkpoint.Height < s.Checkpoint.Height {
+		cp.latest = s
+	}
+}
+
+// Get returns the signed checkpoint at the given height, or the latest one if
+// height is 0. It is nil if there is none.
+func (cp *checkpoints) Get(height int) *SignedCheckpoint {
+	cp.Lock()
+	defer cp.Unlock()
+	if height == 0 {
+		return cp.latest
+	}
+	return cp.signed[height]
+}
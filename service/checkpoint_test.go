@@ -0,0 +1,89 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber/sign/tbls"
+)
+
+func TestCheckpointsSign(t *testing.T) {
+	n := 4
+	threshold := 3
+	shares, public := dkg(threshold, n)
+	_, commits := public.Info()
+	c := &Config{
+		ChainID:     "ckpt",
+		Roster:      &onet.Roster{},
+		N:           n,
+		NotarizerNb: n,
+		Threshold:   threshold,
+		Public:      commits,
+		Share:       shares[0],
+	}
+	noop := func([]*network.ServerIdentity, interface{}) {}
+	cp := newCheckpoints(c, newKeyring(c, newSigVerifier(c)), noop)
+	ckpt := &Checkpoint{ChainID: "ckpt", Height: 10, Round: 12, Hash: "abcd", StateRoot: []byte{1}}
+	partial := func(i int, ckpt *Checkpoint) *CheckpointProposal {
+		sig, err := tbls.Sign(Suite, shares[i], ckpt.SigningMessage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &CheckpointProposal{Checkpoint: ckpt, Partial: sig}
+	}
+
+	cp.Sign(ckpt)
+	// a partial over another checkpoint of the same height does not count
+	other := *ckpt
+	other.Hash = "dcba"
+	cp.AddPartial(partial(1, &other))
+	cp.AddPartial(partial(1, ckpt))
+	if cp.Get(0) != nil {
+		t.Fatal("checkpoint signed below the threshold")
+	}
+	cp.AddPartial(partial(2, ckpt))
+	signed := cp.Get(10)
+	if signed == nil || cp.Get(0) != signed {
+		t.Fatal("checkpoint not signed")
+	}
+	if err := signed.Verify(commits); err != nil {
+		t.Fatal(err)
+	}
+
+	// nodes which are not notarizers only keep valid checkpoints
+	tampered := *signed.Checkpoint
+	tampered.Round = 13
+	follower := newCheckpoints(c, nil, noop)
+	if follower.Add(&SignedCheckpoint{Checkpoint: &tampered, Signature: signed.Signature}) == nil {
+		t.Fatal("tampered checkpoint accepted")
+	}
+	if err := follower.Add(signed); err != nil {
+		t.Fatal(err)
+	}
+	if follower.Get(0) != signed {
+		t.Fatal("checkpoint not kept")
+	}
+
+	// the signed checkpoints outlive the process of the node and its restarts
+	carried := newCheckpoints(c, nil, noop)
+	carried.carry(cp)
+	if carried.Get(0) != signed {
+		t.Fatal("checkpoint not carried over")
+	}
+	dir, err := ioutil.TempDir("", "ckpt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stored := *c
+	stored.BlockDir = dir
+	if err := newCheckpoints(&stored, nil, noop).Add(signed); err != nil {
+		t.Fatal(err)
+	}
+	if s := newCheckpoints(&stored, nil, noop).Get(10); s == nil || s.Verify(commits) != nil || s.Checkpoint.Hash != "abcd" {
+		t.Fatal("checkpoint not read back")
+	}
+}
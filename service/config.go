@@ -1,10 +1,20 @@
 package service
 
 import (
-	"go.dedis.ch/kyber"
-	"go.dedis.ch/kyber/share"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
 	"github.com/csanti/onet"
 	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/share"
 )
 
 var ConfigType network.MessageTypeID
@@ -15,6 +25,8 @@ func init() {
 
 // Config holds all the parameters for the consensus protocol
 type Config struct {
+	ChainID      string       // identifier of the chain, part of every header
+	Genesis      *Genesis     // initial state of the network
 	Seed         int64        // seed to construct the PRNG => random beacon
 	Roster       *onet.Roster // participants
 	Index        int          // index of the node receiving this config
@@ -23,13 +35,41 @@ type Config struct {
 	BlockMakerNb int          // how many nodes for the block makers
 	NotarizerNb  int          // how many notarizers in the simulation
 
-	Public       []kyber.Point   // to reconstruct public polynomial
-	Share        *share.PriShare // private share
-	Threshold    int             // threshold of the threshold sharing scheme
-	BlockSize    int             // the size of the block in bytes
-	BlockTime    int             // blocktime in seconds
-	FinalizeTime int             // time T to wait during finalization
-	RoundsToSimulate int
+	Public           []kyber.Point   // to reconstruct public polynomial
+	Share            *share.PriShare // private share
+	Threshold        int             // threshold of the threshold sharing scheme
+	Stakes           StakeRegistry   // stakes of the block makers, all equal if empty
+	BlockSize        int             // the size of the block in bytes
+	BlockTime        time.Duration   // time notarizers wait at the start of a round before signing
+	FinalizeTime     time.Duration   // time T to wait during finalization
+	RankDelay        time.Duration   // extra time a notarizer waits per rank before signing a lower ranked block
+	RoundTimeout     time.Duration   // time after which a round without notarized block is reported stalled, none if 0
+	SkipTimeout      time.Duration   // time after which notarizers sign the skip of a round without notarized block, none if 0
+	ProposalDelay    time.Duration   // time a block maker waits per rank before proposing
+	BeaconResend     time.Duration   // time without progress after which the beacon resends the latest beacon, none if 0
+	RoundsToSimulate int             // rounds produced by the beacon before it stops
+
+	Retention int    // finalized blocks kept in memory, all of them if 0
+	BlockDir  string // directory where older finalized blocks are stored, dropped if empty
+
+	CheckpointInterval int // finalized blocks between two signed checkpoints, none if 0
+	ReshareEpoch       int // rounds between two resharings of the notarizers' key, none if 0
+
+	Operator kyber.Point // key signing the reconfigurations of the roster, none if nil
+
+	Application string // name of the registered application to run
+
+	VerifyWorkers    int  // size of the partial signature verification pool
+	OptimisticVerify bool // recover first, check partials only on failure
+
+	MetricsAddr string // address to export the metrics on, none if empty
+	GatewayAddr string // address of the HTTP/JSON gateway, none if empty
+	TraceDir    string // directory to write the protocol events in, none if empty
+	Monitor     bool   // record measures on the onet monitor of the simulation
+
+	// metrics of the node, shared by all its processes and carried over
+	// reconfigurations, see metricsOf
+	metrics *Metrics
 }
 
 // NotarizerNodes returns the list of notarizers for the given config
@@ -45,6 +85,17 @@ func (c *Config) BlockMakerNodes() []*network.ServerIdentity {
 	return c.Roster.List[start:end]
 }
 
+// Role returns the role of this node, as named in the genesis file
+func (c *Config) Role() string {
+	switch {
+	case c.IsBeacon(c.Index):
+		return RoleBeacon
+	case c.IsBlockMaker(c.Index):
+		return RoleBlockMaker
+	}
+	return RoleNotarizer
+}
+
 func (c *Config) IsBeacon(i int) bool {
 	if i < c.BeaconNb {
 		return true
@@ -66,3 +117,257 @@ func (c *Config) IsNotarizer(i int) bool {
 	}
 	return false
 }
+
+// Defaults applied by SetDefaults to the fields left empty. Timeouts, delays
+// and optional features stay disabled when not given.
+const (
+	DefaultBlockSize     = 1 << 20
+	DefaultBlockTime     = 500 * time.Millisecond
+	DefaultFinalizeTime  = 500 * time.Millisecond
+	DefaultVerifyWorkers = defaultVerifyWorkers
+)
+
+// SetDefaults fills the fields left empty with their default value
+func (c *Config) SetDefaults() {
+	if c.BlockSize == 0 {
+		c.BlockSize = DefaultBlockSize
+	}
+	if c.BlockTime == 0 {
+		c.BlockTime = DefaultBlockTime
+	}
+	if c.FinalizeTime == 0 {
+		c.FinalizeTime = DefaultFinalizeTime
+	}
+	if c.VerifyWorkers == 0 {
+		c.VerifyWorkers = DefaultVerifyWorkers
+	}
+}
+
+// Validate checks the config is consistent and can run a node. A negative
+// index is valid, it is the config of a node waiting to join the roster.
+func (c *Config) Validate() error {
+	switch {
+	case c.ChainID == "":
+		return errors.New("config: empty chain id")
+	case c.Genesis != nil && c.Genesis.ChainID != c.ChainID:
+		return fmt.Errorf("config: chain id %q differs from the genesis one %q", c.ChainID, c.Genesis.ChainID)
+	case c.Roster == nil:
+		return errors.New("config: no roster")
+	case c.N != len(c.Roster.List):
+		return fmt.Errorf("config: N is %d but the roster has %d nodes", c.N, len(c.Roster.List))
+	case c.BeaconNb < 1 || c.BlockMakerNb < 1 || c.NotarizerNb < 1:
+		return fmt.Errorf("config: needs at least one node of each role, got %d beacons, %d block makers and %d notarizers", c.BeaconNb, c.BlockMakerNb, c.NotarizerNb)
+	case c.BeaconNb+c.BlockMakerNb+c.NotarizerNb != c.N:
+		return fmt.Errorf("config: BeaconNb + BlockMakerNb + NotarizerNb is %d, N is %d", c.BeaconNb+c.BlockMakerNb+c.NotarizerNb, c.N)
+	case c.Index >= c.N:
+		return fmt.Errorf("config: index %d out of the roster of %d nodes", c.Index, c.N)
+	case c.Threshold < 1 || c.Threshold > c.NotarizerNb:
+		return fmt.Errorf("config: threshold %d out of range [1, %d]", c.Threshold, c.NotarizerNb)
+	case len(c.Public) != c.Threshold:
+		return fmt.Errorf("config: %d group public keys for a threshold of %d", len(c.Public), c.Threshold)
+	case c.RoundsToSimulate < 1:
+		return errors.New("config: RoundsToSimulate not set")
+	case c.BlockSize < 1:
+		return fmt.Errorf("config: invalid block size %d", c.BlockSize)
+	case c.Retention < 0 || c.CheckpointInterval < 0 || c.ReshareEpoch < 0 || c.VerifyWorkers < 0:
+		return errors.New("config: Retention, CheckpointInterval, ReshareEpoch and VerifyWorkers can't be negative")
+	}
+	durations := map[string]time.Duration{
+		"BlockTime":     c.BlockTime,
+		"FinalizeTime":  c.FinalizeTime,
+		"RankDelay":     c.RankDelay,
+		"RoundTimeout":  c.RoundTimeout,
+		"SkipTimeout":   c.SkipTimeout,
+		"ProposalDelay": c.ProposalDelay,
+		"BeaconResend":  c.BeaconResend,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			return fmt.Errorf("config: negative %s %s", name, d)
+		}
+	}
+	if c.Index >= 0 && c.IsNotarizer(c.Index) {
+		pos := c.Index - c.BeaconNb - c.BlockMakerNb
+		if c.Share == nil {
+			return fmt.Errorf("config: notarizer at index %d without share", c.Index)
+		}
+		if c.Share.I != pos {
+			return fmt.Errorf("config: share index %d does not match the notarizer position %d", c.Share.I, pos)
+		}
+	}
+	for i, s := range c.Stakes {
+		if s == nil || s.Public == nil {
+			return fmt.Errorf("config: stake %d without public key", i)
+		}
+	}
+	if c.Application != "" {
+		if _, exists := applications[c.Application]; !exists {
+			return fmt.Errorf("config: unknown application %q", c.Application)
+		}
+	}
+	return nil
+}
+
+// configFile is the on-disk representation of the config of a node. All
+// fields given by the genesis are read from the genesis file.
+type configFile struct {
+	Genesis  string // path of the genesis file, relative to the config file
+	Public   string // hex encoded public key of this node, finds it in the roster
+	Share    string // hex encoded private share, notarizers only
+	Operator string // hex encoded operator key
+	// the node is not in the roster of the genesis and waits for a
+	// reconfiguration adding it
+	Join bool
+
+	BlockSize        int
+	BlockTime        duration
+	FinalizeTime     duration
+	RankDelay        duration
+	RoundTimeout     duration
+	SkipTimeout      duration
+	ProposalDelay    duration
+	BeaconResend     duration
+	RoundsToSimulate int
+
+	Retention          int
+	BlockDir           string
+	CheckpointInterval int
+	ReshareEpoch       int
+	Application        string
+	VerifyWorkers      int
+	OptimisticVerify   bool
+	MetricsAddr        string
+	GatewayAddr        string
+	TraceDir           string
+}
+
+// duration reads durations written as "500ms", "2s", ...
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// LoadConfig reads the config file at the given path and the genesis file it
+// references. Files ending in .json are read as JSON, others as TOML. Public
+// keys of the nodes are decoded using the given group.
+func LoadConfig(path string, keys kyber.Group) (*Config, error) {
+	buff, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cf, err := decodeConfigFile(buff, strings.HasSuffix(path, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	if cf.Genesis == "" {
+		return nil, errors.New("config: no genesis file")
+	}
+	if !filepath.IsAbs(cf.Genesis) {
+		cf.Genesis = filepath.Join(filepath.Dir(path), cf.Genesis)
+	}
+	g, err := LoadGenesis(cf.Genesis, keys)
+	if err != nil {
+		return nil, err
+	}
+	return cf.config(g, keys)
+}
+
+// ParseConfig decodes the config of a node out of its TOML or JSON
+// representation, for example:
+//
+//	Genesis = "genesis.toml"
+//	Public = "<hex>"
+//	Share = "<hex>"
+//	BlockTime = "500ms"
+//	RoundsToSimulate = 100
+//
+// The genesis file is not read, the given genesis is used instead. Fields not
+// given take their default value and the resulting config is validated.
+func ParseConfig(data []byte, isJSON bool, g *Genesis, keys kyber.Group) (*Config, error) {
+	cf, err := decodeConfigFile(data, isJSON)
+	if err != nil {
+		return nil, err
+	}
+	return cf.config(g, keys)
+}
+
+func decodeConfigFile(data []byte, isJSON bool) (*configFile, error) {
+	cf := new(configFile)
+	var err error
+	if isJSON {
+		err = json.Unmarshal(data, cf)
+	} else {
+		_, err = toml.Decode(string(data), cf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+	return cf, nil
+}
+
+// config returns the config of the node described by the file in the network
+// of the given genesis
+func (cf *configFile) config(g *Genesis, keys kyber.Group) (*Config, error) {
+	public, err := decodePoint(keys, cf.Public)
+	if err != nil {
+		return nil, fmt.Errorf("config: invalid public key: %s", err)
+	}
+	index := -1
+	for i, si := range g.Roster.List {
+		if si.Public.Equal(public) {
+			index = i
+		}
+	}
+	if index < 0 && !cf.Join {
+		return nil, errors.New("config: public key not in the roster of the genesis, set Join to wait for a reconfiguration")
+	}
+	c := g.Config(index)
+	if cf.Share != "" {
+		if index < 0 || !c.IsNotarizer(index) {
+			return nil, errors.New("config: share given to a node which is not a notarizer")
+		}
+		buff, err := hex.DecodeString(cf.Share)
+		if err != nil {
+			return nil, fmt.Errorf("config: invalid share: %s", err)
+		}
+		v := G2.Scalar()
+		if err := v.UnmarshalBinary(buff); err != nil {
+			return nil, fmt.Errorf("config: invalid share: %s", err)
+		}
+		c.Share = &share.PriShare{I: index - g.BeaconNb - g.BlockMakerNb, V: v}
+	}
+	if cf.Operator != "" {
+		if c.Operator, err = decodePoint(G2, cf.Operator); err != nil {
+			return nil, fmt.Errorf("config: invalid operator key: %s", err)
+		}
+	}
+	c.BlockSize = cf.BlockSize
+	c.BlockTime = cf.BlockTime.Duration
+	c.FinalizeTime = cf.FinalizeTime.Duration
+	c.RankDelay = cf.RankDelay.Duration
+	c.RoundTimeout = cf.RoundTimeout.Duration
+	c.SkipTimeout = cf.SkipTimeout.Duration
+	c.ProposalDelay = cf.ProposalDelay.Duration
+	c.BeaconResend = cf.BeaconResend.Duration
+	c.RoundsToSimulate = cf.RoundsToSimulate
+	c.Retention = cf.Retention
+	c.BlockDir = cf.BlockDir
+	c.CheckpointInterval = cf.CheckpointInterval
+	c.ReshareEpoch = cf.ReshareEpoch
+	c.Application = cf.Application
+	c.VerifyWorkers = cf.VerifyWorkers
+	c.OptimisticVerify = cf.OptimisticVerify
+	c.MetricsAddr = cf.MetricsAddr
+	c.GatewayAddr = cf.GatewayAddr
+	c.TraceDir = cf.TraceDir
+	c.SetDefaults()
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber/util/random"
+)
+
+func TestParseConfig(t *testing.T) {
+	shares, public := dkg(2, 2)
+	_, commits := public.Info()
+	var list []*network.ServerIdentity
+	for i := 0; i < 4; i++ {
+		addr := network.Address(fmt.Sprintf("tcp://127.0.0.1:%d", 7000+i))
+		list = append(list, network.NewServerIdentity(G2.Point().Pick(random.New()), addr))
+	}
+	g := &Genesis{ChainID: "config", Roster: onet.NewRoster(list), BeaconNb: 1, BlockMakerNb: 1, NotarizerNb: 2, Threshold: 2, Public: commits}
+	hexOf := func(m interface{ MarshalBinary() ([]byte, error) }) string {
+		buff, _ := m.MarshalBinary()
+		return hex.EncodeToString(buff)
+	}
+
+	c, err := ParseConfig([]byte(`
+Public = "`+hexOf(list[3].Public)+`"
+Share = "`+hexOf(shares[1].V)+`"
+RankDelay = "250ms"
+RoundsToSimulate = 10
+`), false, g, G2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Index != 3 || c.Share.I != 1 || c.RankDelay != 250*time.Millisecond {
+		t.Fatal("config not parsed correctly")
+	}
+	if c.BlockTime != DefaultBlockTime || c.BlockSize != DefaultBlockSize {
+		t.Fatal("defaults not applied")
+	}
+
+	json := `{"Public": "` + hexOf(list[0].Public) + `", "BlockTime": "1s", "RoundsToSimulate": 10}`
+	if c, err = ParseConfig([]byte(json), true, g, G2); err != nil {
+		t.Fatal(err)
+	}
+	if c.Index != 0 || c.BlockTime != time.Second {
+		t.Fatal("json config not parsed correctly")
+	}
+
+	_, err = ParseConfig([]byte(`Public = "`+hexOf(list[2].Public)+`"
+RoundsToSimulate = 10`), false, g, G2)
+	if err == nil || !strings.Contains(err.Error(), "without share") {
+		t.Fatal("notarizer without share accepted:", err)
+	}
+
+	_, err = ParseConfig([]byte(`Public = "`+hexOf(list[1].Public)+`"
+Share = "`+hexOf(shares[1].V)+`"
+RoundsToSimulate = 10`), false, g, G2)
+	if err == nil || !strings.Contains(err.Error(), "not a notarizer") {
+		t.Fatal("share of a block maker accepted:", err)
+	}
+
+	// nodes out of the roster must ask to join
+	unknown := `Public = "` + hexOf(G2.Point().Pick(random.New())) + `"
+RoundsToSimulate = 10`
+	if _, err = ParseConfig([]byte(unknown), false, g, G2); err == nil {
+		t.Fatal("unknown public key accepted")
+	}
+	if c, err = ParseConfig([]byte(unknown+"\nJoin = true"), false, g, G2); err != nil || c.Index != -1 {
+		t.Fatal("joining node refused:", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	shares, public := dkg(2, 3)
+	_, commits := public.Info()
+	var list []*network.ServerIdentity
+	for i := 0; i < 5; i++ {
+		list = append(list, network.NewServerIdentity(G2.Point().Pick(random.New()), network.Address(fmt.Sprintf("tcp://127.0.0.1:%d", 7000+i))))
+	}
+	g := &Genesis{ChainID: "config", Roster: onet.NewRoster(list), BeaconNb: 1, BlockMakerNb: 1, NotarizerNb: 3, Threshold: 2, Public: commits}
+	valid := func() *Config {
+		c := g.Config(3)
+		c.Share = shares[1]
+		c.RoundsToSimulate = 10
+		c.SetDefaults()
+		return c
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]func(c *Config){
+		"roles":     func(c *Config) { c.BlockMakerNb = 2 },
+		"threshold": func(c *Config) { c.Threshold = 4 },
+		"public":    func(c *Config) { c.Public = c.Public[:1] },
+		"share":     func(c *Config) { c.Share = shares[0] },
+		"rounds":    func(c *Config) { c.RoundsToSimulate = 0 },
+		"duration":  func(c *Config) { c.SkipTimeout = -time.Second },
+	}
+	for name, change := range invalid {
+		c := valid()
+		change(c)
+		if err := c.Validate(); err == nil {
+			t.Fatal("invalid", name, "accepted")
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package service
 
 import (
+	"errors"
+	"net/http"
+	"sync"
+
 	"go.dedis.ch/kyber/pairing/bn256"
 	"github.com/csanti/onet"
+	"github.com/csanti/onet/log"
 	"github.com/csanti/onet/network"
 )
 
@@ -23,6 +28,26 @@ type Dfinity struct {
 	not     *Notarizer
 	bm      *BlockMaker
 	fin     *Finalizer
+	app     Application
+	metrics *Metrics
+	// signed checkpoints of the finalized chain
+	checkpoints *checkpoints
+	// key reshared to another set of notarizers, waiting for the
+	// reconfiguration of the roster
+	nextKey *ReshareResult
+	// reconfigurations of the roster mapped from their first round
+	reconfigs map[int]*Reconfig
+	reconfMu  sync.Mutex
+	// first round of the last reconfiguration applied, the ones of before are
+	// replays
+	applied int
+	// guards the config, the processes and the checkpoints, which get
+	// replaced on reconfiguration. See current.
+	procMu sync.RWMutex
+	// HTTP/JSON gateway, nil if not running
+	gateway *http.Server
+	// subscribers to the notarized and finalized blocks
+	subs *subscriptions
 }
 
 // NewDfinityService
@@ -30,75 +55,504 @@ func NewDfinityService(c *onet.Context) (onet.Service, error) {
 	d := &Dfinity{
 		context:          c,
 		ServiceProcessor: onet.NewServiceProcessor(c),
+		reconfigs:        make(map[int]*Reconfig),
+		subs:             newSubscriptions(),
 	}
 	c.RegisterProcessor(d, ConfigType)
 	c.RegisterProcessor(d, BlockProposalType)
 	c.RegisterProcessor(d, NotarizedBlockType)
 	c.RegisterProcessor(d, SignatureProposalType)
 	c.RegisterProcessor(d, BeaconType)
+	c.RegisterProcessor(d, TransactionType)
+	c.RegisterProcessor(d, SkipProposalType)
+	c.RegisterProcessor(d, SkipCertificateType)
+	c.RegisterProcessor(d, CheckpointProposalType)
+	c.RegisterProcessor(d, SignedCheckpointType)
+	c.RegisterProcessor(d, ReconfigType)
+	if err := d.RegisterHandlers(d.GetKey, d.Submit, d.Query, d.Headers, d.Checkpoint,
+		d.Snapshot, d.Blocks, d.Tree); err != nil {
+		return nil, err
+	}
+	if err := d.RegisterStreamingHandler(d.StreamBlocks); err != nil {
+		return nil, err
+	}
+	if _, err := c.ProtocolRegister(ReshareProtocolName, d.newReshareProtocol); err != nil {
+		return nil, err
+	}
 	return d, nil
 }
 
 func (d *Dfinity) SetConfig(c *Config) {
+	if err := c.Validate(); err != nil {
+		log.Error("dfinity: refusing to start:", err)
+		return
+	}
+	d.procMu.Lock()
+	if c.GatewayAddr != "" && d.gateway == nil {
+		d.serveGateway(c.GatewayAddr)
+	}
 	d.c = c
-	if c.IsBeacon(c.Index) {
+	d.metrics = metricsOf(c)
+	if c.Index < 0 {
+		// not part of the roster yet, waits for a reconfiguration
+	} else if c.IsBeacon(c.Index) {
 		d.beacon = NewBeaconProcess(d.context, c, d.broadcast)
 	} else if c.IsBlockMaker(c.Index) {
 		d.bm = NewBlockMakerProcess(d.context, c, d.broadcast)
 	} else if c.IsNotarizer(c.Index) {
 		d.not = NewNotarizerProcess(d.context, c, d.broadcast)
 	}
+	d.wire()
+	d.procMu.Unlock()
+	if d.app == nil && c.Application != "" {
+		app, err := NewApplication(c.Application)
+		if err != nil {
+			log.Error("dfinity:", err)
+		}
+		d.app = app
+	}
+	if d.app != nil {
+		if err := d.setApplication(); err != nil {
+			log.Error("dfinity: can't set application:", err)
+		}
+	}
 }
 
+// wire hooks the checkpoints and the reconfigurations of the roster to the
+// process of this node
+// ONLY CALLED WHEN CALLER HAVE THE PROCESS LOCK
+func (d *Dfinity) wire() {
+	old := d.checkpoints
+	if d.not != nil {
+		d.checkpoints = newCheckpoints(d.c, d.not.keys, d.broadcast)
+		d.not.finalizer.checkpoint = d.checkpoints.Sign
+		d.not.epoch = d.newEpoch
+	} else {
+		d.checkpoints = newCheckpoints(d.c, nil, d.broadcast)
+	}
+	// the chain carries over reconfigurations, its checkpoints too
+	d.checkpoints.carry(old)
+	if f := d.state().finalizer(); f != nil {
+		d.hook(f)
+	}
+}
+
+// hook makes the finalizer report its reconfigurations, rounds and blocks to
+// this node
+func (d *Dfinity) hook(f *Finalizer) {
+	f.reconfig = d.onReconfigTx
+	f.advance = d.applyReconfig
+	f.publish = d.subs.publish
+}
+
+// SetApplication registers the application executing the finalized blocks on
+// this node. It can be called before or after the config is set.
+func (d *Dfinity) SetApplication(app Application) error {
+	d.app = app
+	if d.current().c == nil {
+		return nil
+	}
+	return d.setApplication()
+}
+
+func (d *Dfinity) setApplication() error {
+	s := d.current()
+	switch {
+	case s.not != nil:
+		return s.not.finalizer.SetApplication(d.app)
+	case s.bm != nil:
+		return s.bm.SetApplication(d.app)
+	case s.fin != nil:
+		return s.fin.SetApplication(d.app)
+	}
+	return nil
+}
+
+// SubmitTx hands the transaction to the block makers so it gets included in a
+// future block
+func (d *Dfinity) SubmitTx(tx []byte) error {
+	s := d.current()
+	if s.c == nil {
+		return errors.New("dfinity: node not configured yet")
+	}
+	if IsReconfigTx(tx) {
+		if _, err := d.verifyReconfigTx(tx); err != nil {
+			return err
+		}
+	}
+	if s.bm != nil {
+		if err := s.bm.AddTx(tx); err != nil {
+			return err
+		}
+	}
+	go d.broadcast(s.c.BlockMakerNodes(), &Transaction{Tx: tx})
+	return nil
+}
+
+// AttachCallback starts a finalizer calling fn with the round of each
+// finalized block. See Subscribe to follow the blocks themselves.
 func (d *Dfinity) AttachCallback(fn func(int)) {
-	chain := new(Chain)
-	d.fin = NewFinalizer(d.c, chain, fn)
+	d.procMu.Lock()
+	fin := NewFinalizer(d.c, NewChain(d.c), fn)
+	d.hook(fin)
+	d.fin = fin
+	own := d.not == nil && d.bm == nil
+	d.procMu.Unlock()
+	if d.app != nil && own {
+		if err := fin.SetApplication(d.app); err != nil {
+			log.Error("dfinity: can't set application:", err)
+		}
+	}
 }
 
 func (d *Dfinity) Start() {
-	if d.beacon != nil {
-		d.beacon.Start()
+	if b := d.current().beacon; b != nil {
+		b.Start()
 	} else {
 		panic("that should not happen")
 	}
 }
 
-// Process
+// Process dispatches the packets to the processes of this node. Notarized
+// blocks and skip certificates are verified first, so the rounds reached
+// through them can be trusted.
 func (d *Dfinity) Process(e *network.Envelope) {
+	if c, ok := e.Msg.(*Config); ok {
+		d.SetConfig(c)
+		return
+	}
+	s := d.current()
+	if s.c == nil {
+		return
+	}
 	switch inner := e.Msg.(type) {
-	case *Config:
-		d.SetConfig(inner)
+	case *Reconfig:
+		// nodes following the chain only take the reconfigurations it
+		// finalizes, see onReconfigTx
+		if s.finalizer() != nil {
+			return
+		}
+		if err := inner.Verify(s.c); err != nil {
+			log.Lvl2("dfinity: invalid reconfiguration:", err)
+			return
+		}
+		d.keepReconfig(inner)
 	case *BeaconPacket:
-		if d.not != nil {
-			d.not.Process(e)
-		} else if d.bm != nil {
-			d.bm.Process(e)
-		} else if d.beacon != nil {
-			d.beacon.Process(e)
+		if s.c.Index < 0 {
+			d.join(e.ServerIdentity, inner.Round)
+			s = d.current()
+		}
+		if s.not != nil {
+			s.not.Process(e)
+		} else if s.bm != nil {
+			s.bm.Process(e)
+		} else if s.beacon != nil {
+			s.beacon.Process(e)
 		}
 	case *BlockProposal:
-		if d.not != nil {
-			d.not.Process(e)
+		if s.not != nil {
+			s.not.Process(e)
 		}
 	case *SignatureProposal:
-		if d.not != nil {
-			d.not.Process(e)
+		if s.not != nil {
+			s.not.Process(e)
 		}
 	case *NotarizedBlock:
-		if d.beacon != nil {
-			d.beacon.Process(e)
-		} else if d.bm != nil {
-			d.bm.Process(e)
+		if err := d.verifyNotarized(inner); err != nil {
+			log.Lvl2("dfinity: invalid notarized block for round", inner.Round, ":", err)
+			return
+		}
+		if s.finalizer() == nil {
+			d.applyReconfig(inner.Round)
+			s = d.current()
+		}
+		if s.beacon != nil {
+			s.beacon.Process(e)
+		} else if s.bm != nil {
+			s.bm.Process(e)
+		}
+		if s.fin != nil {
+			s.fin.Store(inner)
+		}
+	case *SkipProposal:
+		if s.not != nil {
+			s.not.Process(e)
+		}
+	case *SkipCertificate:
+		if err := verifySkip(s.c, inner); err != nil {
+			log.Lvl2("dfinity: invalid skip certificate for round", inner.Round, ":", err)
+			return
+		}
+		if s.finalizer() == nil {
+			d.applyReconfig(inner.Round)
+			s = d.current()
+		}
+		if s.beacon != nil {
+			s.beacon.Process(e)
+		} else if s.bm != nil {
+			s.bm.Process(e)
+		} else if s.not != nil {
+			s.not.Process(e)
 		}
-		if d.fin != nil {
-			d.fin.Store(inner)
+		if s.fin != nil {
+			s.fin.StoreSkip(inner)
 		}
+	case *CheckpointProposal:
+		if s.not != nil {
+			s.checkpoints.AddPartial(inner)
+		}
+	case *SignedCheckpoint:
+		if err := s.checkpoints.Add(inner); err != nil {
+			log.Lvl2("dfinity: invalid checkpoint:", err)
+		}
+	case *Transaction:
+		if IsReconfigTx(inner.Tx) {
+			if _, err := d.verifyReconfigTx(inner.Tx); err != nil {
+				log.Lvl2("dfinity: invalid reconfiguration:", err)
+				return
+			}
+		}
+		if s.bm != nil {
+			if err := s.bm.AddTx(inner.Tx); err != nil {
+				log.Lvl2("dfinity: transaction refused:", err)
+			}
+		}
+	}
+}
+
+// GetKey returns the proof of the requested key against the committed state of
+// the key-value store running on this node
+func (d *Dfinity) GetKey(req *KeyRequest) (*KeyReply, error) {
+	kv, ok := d.app.(*KVStore)
+	if !ok {
+		return nil, errors.New("dfinity: no key-value store running")
+	}
+	proof, root, round := kv.Query(req.Key)
+	return &KeyReply{Proof: proof, Root: root, Round: round}, nil
+}
+
+// Submit hands the transaction of the client to the block makers
+func (d *Dfinity) Submit(req *TxRequest) (*TxReply, error) {
+	if err := d.SubmitTx(req.Tx); err != nil {
+		return nil, err
 	}
+	return &TxReply{}, nil
+}
+
+// Query forwards the read request of the client to the application
+func (d *Dfinity) Query(req *QueryRequest) (*QueryReply, error) {
+	q, ok := d.app.(Querier)
+	if !ok {
+		return nil, errors.New("dfinity: application does not answer queries")
+	}
+	data, err := q.Query(req.Path, req.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryReply{Data: data, Round: d.LastRound()}, nil
+}
+
+// Headers returns the headers of the finalized chain requested by the client
+func (d *Dfinity) Headers(req *HeadersRequest) (*HeadersReply, error) {
+	f := d.finalizer()
+	if f == nil {
+		return nil, errors.New("dfinity: no finalized chain on this node")
+	}
+	max := req.Max
+	if max <= 0 || max > MaxHeaders {
+		max = MaxHeaders
+	}
+	headers, err := f.chain.Headers(req.From, max)
+	if err != nil {
+		return nil, err
+	}
+	return &HeadersReply{Headers: headers}, nil
+}
+
+// Checkpoint returns the signed checkpoint at the requested height, or the
+// latest one
+func (d *Dfinity) Checkpoint(req *CheckpointRequest) (*CheckpointReply, error) {
+	checkpoints := d.current().checkpoints
+	if checkpoints == nil {
+		return nil, errors.New("dfinity: node not configured yet")
+	}
+	cp := checkpoints.Get(req.Height)
+	if cp == nil {
+		return nil, errors.New("dfinity: no such checkpoint")
+	}
+	return &CheckpointReply{Checkpoint: cp}, nil
+}
+
+// Snapshot returns the application snapshot taken at the requested height
+func (d *Dfinity) Snapshot(req *SnapshotRequest) (*SnapshotReply, error) {
+	f := d.finalizer()
+	if f == nil {
+		return nil, errors.New("dfinity: no finalized chain on this node")
+	}
+	snap := f.Snapshot(req.Height)
+	if snap == nil {
+		return nil, errors.New("dfinity: no snapshot at this height")
+	}
+	return &SnapshotReply{Snapshot: snap}, nil
+}
+
+// Blocks returns the blocks of the finalized chain requested by the client,
+// along with the notarized blocks not finalized yet
+func (d *Dfinity) Blocks(req *BlocksRequest) (*BlocksReply, error) {
+	f := d.finalizer()
+	if f == nil {
+		return nil, errors.New("dfinity: no finalized chain on this node")
+	}
+	max := req.Max
+	if max <= 0 || max > MaxBlocks {
+		max = MaxBlocks
+	}
+	blocks, err := f.chain.Blocks(req.From, max)
+	if err != nil {
+		return nil, err
+	}
+	return &BlocksReply{
+		Blocks:  blocks,
+		Pending: f.Pending(),
+	}, nil
+}
+
+// StreamBlocks streams the block events of this node to a client until it
+// goes away or the subscription ends, see Subscribe
+func (d *Dfinity) StreamBlocks(req *SubscribeRequest) (chan *BlockEventReply, chan bool, error) {
+	sub := d.Subscribe(req.From)
+	out := make(chan *BlockEventReply)
+	closing := make(chan bool)
+	send := func(reply *BlockEventReply) bool {
+		select {
+		case out <- reply:
+			return true
+		case <-closing:
+			return false
+		}
+	}
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		for {
+			select {
+			case ev, ok := <-sub.C:
+				if !ok {
+					if err := sub.Err(); err != nil {
+						send(&BlockEventReply{Error: err.Error()})
+					}
+					return
+				}
+				if !send(&BlockEventReply{Block: ev.Block, Finalized: ev.Finalized}) {
+					return
+				}
+			case <-closing:
+				return
+			}
+		}
+	}()
+	return out, closing, nil
+}
+
+// Tree returns the tree of the notarized blocks seen by this node, for
+// debugging
+func (d *Dfinity) Tree(req *TreeRequest) (*TreeReply, error) {
+	t := d.BlockTree()
+	if t == nil {
+		return nil, errors.New("dfinity: no finalized chain on this node")
+	}
+	return &TreeReply{Tree: t}, nil
+}
+
+// BlockTree returns the tree of the notarized blocks seen by this node, nil if
+// it runs no finalizer
+func (d *Dfinity) BlockTree() *BlockTree {
+	f := d.finalizer()
+	if f == nil {
+		return nil
+	}
+	return f.Tree()
+}
+
+// LastRound returns the round of the last block finalized by this node
+func (d *Dfinity) LastRound() int {
+	f := d.finalizer()
+	if f == nil {
+		return 0
+	}
+	if b := f.chain.Head(); b != nil {
+		return b.Round
+	}
+	return 0
+}
+
+// finalizer returns the finalizer of the process running on this node
+func (d *Dfinity) finalizer() *Finalizer {
+	return d.current().finalizer()
+}
+
+// nodeState is the config of this node along with the processes running its
+// role, as they were when taken
+type nodeState struct {
+	c           *Config
+	beacon      *Beacon
+	not         *Notarizer
+	bm          *BlockMaker
+	fin         *Finalizer
+	checkpoints *checkpoints
+	metrics     *Metrics
+}
+
+// current returns the config and the processes of this node. They get
+// replaced on reconfiguration, so they are read through it outside of the
+// process lock.
+func (d *Dfinity) current() *nodeState {
+	d.procMu.RLock()
+	defer d.procMu.RUnlock()
+	return d.state()
+}
+
+// state returns the config and the processes of this node
+// ONLY CALLED WHEN CALLER HAVE THE PROCESS LOCK
+func (d *Dfinity) state() *nodeState {
+	return &nodeState{c: d.c, beacon: d.beacon, not: d.not, bm: d.bm, fin: d.fin,
+		checkpoints: d.checkpoints, metrics: d.metrics}
+}
+
+// finalizer returns the finalizer of the process, the one of the callback if
+// the process has none
+func (s *nodeState) finalizer() *Finalizer {
+	switch {
+	case s.not != nil:
+		return s.not.finalizer
+	case s.bm != nil:
+		return s.bm.fin
+	}
+	return s.fin
+}
+
+// round returns the highest round this node has seen
+func (s *nodeState) round() int {
+	if f := s.finalizer(); f != nil {
+		return f.HighestRound()
+	}
+	if s.beacon != nil {
+		s.beacon.Lock()
+		defer s.beacon.Unlock()
+		return s.beacon.round
+	}
+	return 0
+}
+
+// Application returns the application running on this node, if any
+func (d *Dfinity) Application() Application {
+	return d.app
 }
 
 type BroadcastFn func(sis []*network.ServerIdentity, msg interface{})
 
 func (d *Dfinity) broadcast(sis []*network.ServerIdentity, msg interface{}) {
+	var sent int
 	for _, si := range sis {
 		if d.ServerIdentity().Equal(si) {
 			continue
@@ -106,5 +560,118 @@ func (d *Dfinity) broadcast(sis []*network.ServerIdentity, msg interface{}) {
 		if err := d.ServiceProcessor.SendRaw(si, msg); err != nil {
 			panic(err)
 		}
+		sent++
+	}
+	d.current().metrics.Sent(msg, sent)
+}
+
+// Reshare runs the resharing protocol from this node, issuing fresh shares of
+// the notarizers' key to the given nodes with the given threshold. The new
+// shares are used from the activation round on.
+func (d *Dfinity) Reshare(nodes []*network.ServerIdentity, threshold, epoch, activation int) error {
+	c := d.current().c
+	if c == nil {
+		return errors.New("dfinity: node not configured yet")
+	}
+	list := append([]*network.ServerIdentity{d.ServerIdentity()}, c.NotarizerNodes()...)
+	list = append(list, nodes...)
+	roster := onet.NewRoster(unique(list))
+	tree := roster.GenerateNaryTreeWithRoot(len(roster.List), d.ServerIdentity())
+	pi, err := d.CreateProtocol(ReshareProtocolName, tree)
+	if err != nil {
+		return err
+	}
+	key := d.keyConfig()
+	r := pi.(*Reshare)
+	r.Params = &ReshareStart{
+		Epoch:          epoch,
+		Activation:     activation,
+		Nodes:          nodes,
+		Threshold:      threshold,
+		Public:         key.Public,
+		OldThreshold:   key.Threshold,
+		OldNotarizerNb: key.NotarizerNb,
+	}
+	if err := r.Start(); err != nil {
+		return err
+	}
+	return <-r.Finished
+}
+
+// newEpoch refreshes the shares of the current notarizers at the first round
+// of every epoch. Only the first notarizer initiates the resharing.
+func (d *Dfinity) newEpoch(round int) {
+	c := d.current().c
+	nodes := c.NotarizerNodes()
+	if !nodes[0].Equal(d.ServerIdentity()) {
+		return
+	}
+	epoch := round / c.ReshareEpoch
+	log.Lvl1("dfinity: resharing the notarizers' key for epoch", epoch)
+	if err := d.Reshare(nodes, c.Threshold, epoch, round+c.ReshareEpoch); err != nil {
+		log.Error("dfinity: resharing of epoch", epoch, "failed:", err)
+	}
+}
+
+func (d *Dfinity) newReshareProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	c := d.keyConfig()
+	if c == nil {
+		return nil, errors.New("dfinity: node not configured yet")
+	}
+	return NewReshareProtocol(n, c, d.reshared)
+}
+
+// keyConfig returns the config carrying the notarizers' key this node uses at
+// its current round
+func (d *Dfinity) keyConfig() *Config {
+	s := d.current()
+	if s.not != nil {
+		return s.not.keys.Current().c
+	}
+	return s.c
+}
+
+// reshared hands the new key of this node to the notarizer if the set of
+// notarizers stays the same, or keeps it for the reconfiguration of the roster
+func (d *Dfinity) reshared(k *ReshareResult) {
+	d.reconfMu.Lock()
+	defer d.reconfMu.Unlock()
+	s := d.current()
+	if _, reconf := d.reconfigs[k.Activation]; !reconf && s.not != nil && sameNodes(k.Nodes, s.c.NotarizerNodes()) {
+		s.not.SetNextKey(k)
+		return
+	}
+	d.nextKey = k
+}
+
+// unique returns the list without the duplicated identities
+func unique(list []*network.ServerIdentity) []*network.ServerIdentity {
+	var res []*network.ServerIdentity
+	for _, si := range list {
+		var dup bool
+		for _, other := range res {
+			if other.Equal(si) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			res = append(res, si)
+		}
+	}
+	return res
+}
+
+// sameNodes returns whether both lists hold the same identities in the same
+// order
+func sameNodes(a, b []*network.ServerIdentity) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
 	}
+	return true
 }
@@ -3,6 +3,7 @@ package service
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"go.dedis.ch/kyber"
 	"go.dedis.ch/kyber/pairing"
@@ -37,28 +38,31 @@ func TestDfinity(t *testing.T) {
 	threshold := 3
 	var seed int64 = 67912
 	blocksize := 100
-	blockTime := 500
-	finalizeTime := 500
+	blockTime := 500 * time.Millisecond
+	finalizeTime := 500 * time.Millisecond
 
 	log.Lvlf1("=> dfinity test with %d nodes: %d beacon, %d bm, %d notarizers", n, beaconNb, blockMakerNb, notarizerNb)
 	shares, public := dkg(threshold, notarizerNb)
+	_, commits := public.Info()
+	genesis := &Genesis{
+		ChainID:      "dfinity-test",
+		Time:         time.Now(),
+		Roster:       roster,
+		BeaconNb:     beaconNb,
+		BlockMakerNb: blockMakerNb,
+		NotarizerNb:  notarizerNb,
+		Threshold:    threshold,
+		Public:       commits,
+		BeaconSeed:   seed,
+	}
 	notIndex := beaconNb + blockMakerNb
 	dfinities := make([]*Dfinity, n, n)
 	for i := 0; i < n; i++ {
-		c := &Config{
-			Seed:         seed,
-			Roster:       roster,
-			Index:        i,
-			N:            n,
-			BeaconNb:     beaconNb,
-			BlockMakerNb: blockMakerNb,
-			NotarizerNb:  notarizerNb,
-			Public:       public,
-			Threshold:    threshold,
-			BlockSize:    blocksize,
-			BlockTime:    blockTime,
-			FinalizeTime: finalizeTime,
-		}
+		c := genesis.Config(i)
+		c.BlockSize = blocksize
+		c.BlockTime = blockTime
+		c.FinalizeTime = finalizeTime
+		c.RoundsToSimulate = 20
 		if i >= notIndex {
 			c.Share = shares[i-notIndex]
 		}
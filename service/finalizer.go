@@ -1,24 +1,53 @@
 package service
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/csanti/onet/log"
 )
 
 // Chain is the chain that contains only blocks that are final,i.e.
 // no blocks can't get marked as dead.
 type Chain struct {
 	sync.Mutex
-	all    []*Block
+	all    []*Block        // last finalized blocks kept in memory
+	nots   []*Notarization // notarization of each block of all
 	last   *Block
 	length int
+	// number of blocks kept in memory, all of them if 0
+	retention int
+	// where the blocks evicted from memory go, dropped if nil
+	store BlockStore
+	// whether blocks before the first one of all are not held in memory
+	trimmed bool
+}
+
+// NewChain returns an empty chain keeping the number of blocks in memory given
+// by the config and the older ones in the directory of the node in its block
+// directory, if any, see nodeFile
+func NewChain(c *Config) *Chain {
+	chain := &Chain{retention: c.Retention}
+	if c.BlockDir != "" {
+		store, err := NewFileStore(filepath.Join(c.BlockDir, nodeFile(c)))
+		if err != nil {
+			log.Error("chain: can't store blocks:", err)
+		}
+		chain.store = store
+	}
+	return chain
 }
 
 // Appends add a new block to the head of the chain
-func (f *Chain) Append(b *Block) {
+func (f *Chain) Append(n *NotarizedBlock) {
 	f.Lock()
 	defer f.Unlock()
+	b := n.Block
 	if f.length > 0 && b.BlockHeader.PrvHash != f.last.BlockHeader.Hash() {
 		panic("that should never happen")
 	}
@@ -26,6 +55,117 @@ func (f *Chain) Append(b *Block) {
 	f.length++
 
 	f.all = append(f.all, b)
+	f.nots = append(f.nots, n.Notarization)
+	if f.retention > 0 && len(f.all) > f.retention {
+		f.evict()
+	}
+}
+
+// evict moves the oldest block held in memory to the store
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (f *Chain) evict() {
+	if f.store != nil {
+		n := &NotarizedBlock{Block: f.all[0], Notarization: f.nots[0]}
+		if err := f.store.Put(n); err != nil {
+			log.Error("chain: can't store block of round", n.Round, ":", err)
+		}
+	}
+	f.trimmed = true
+	copy(f.all, f.all[1:])
+	f.all[len(f.all)-1] = nil
+	f.all = f.all[:len(f.all)-1]
+	copy(f.nots, f.nots[1:])
+	f.nots[len(f.nots)-1] = nil
+	f.nots = f.nots[:len(f.nots)-1]
+}
+
+// Blocks returns at most max notarized blocks of the chain starting from the
+// given round. Blocks evicted from memory are read from the store, and
+// ErrEvicted is returned when there is none to read them from.
+func (f *Chain) Blocks(from, max int) ([]*NotarizedBlock, error) {
+	f.Lock()
+	store, trimmed := f.store, f.trimmed
+	first := 0
+	if len(f.all) > 0 {
+		first = f.all[0].Round
+	}
+	var held []*NotarizedBlock
+	start := sort.Search(len(f.all), func(i int) bool {
+		return f.all[i].Round >= from
+	})
+	for i := start; i < len(f.all) && len(held) < max; i++ {
+		held = append(held, &NotarizedBlock{Block: f.all[i], Notarization: f.nots[i]})
+	}
+	f.Unlock()
+
+	if from >= first || !trimmed {
+		return held, nil
+	}
+	if store == nil {
+		return nil, ErrEvicted
+	}
+	// the store is read without the lock so finalization isn't held up
+	var blocks []*NotarizedBlock
+	for round := from; round < first && len(blocks) < max; round++ {
+		n, err := store.Get(round)
+		if err == ErrNotStored {
+			// skipped round or not finalized by this node
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("chain: can't read block of round %d: %v", round, err)
+		}
+		blocks = append(blocks, n)
+	}
+	for _, n := range held {
+		if len(blocks) >= max {
+			break
+		}
+		blocks = append(blocks, n)
+	}
+	return blocks, nil
+}
+
+// Find returns the block of the given hash among the blocks of the chain kept
+// in memory, nil if there is none
+func (f *Chain) Find(hash string) *NotarizedBlock {
+	f.Lock()
+	defer f.Unlock()
+	for i, b := range f.all {
+		if b.BlockHeader.Hash() == hash {
+			return &NotarizedBlock{Block: b, Notarization: f.nots[i]}
+		}
+	}
+	return nil
+}
+
+// Headers returns at most max headers of the chain, along with their
+// notarization, starting from the given round.
+func (f *Chain) Headers(from, max int) ([]*NotarizedHeader, error) {
+	blocks, err := f.Blocks(from, max)
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]*NotarizedHeader, len(blocks))
+	for i, n := range blocks {
+		header := n.Block.BlockHeader
+		headers[i] = &NotarizedHeader{
+			Header:    &header,
+			Signature: n.Notarization.Signature,
+		}
+	}
+	return headers, nil
+}
+
+// Reset makes the given block the head of the chain, as its height-th block.
+// The blocks before it are only known through the store, if any.
+func (f *Chain) Reset(n *NotarizedBlock, height int) {
+	f.Lock()
+	defer f.Unlock()
+	f.all = []*Block{n.Block}
+	f.nots = []*Notarization{n.Notarization}
+	f.trimmed = true
+	f.last = n.Block
+	f.length = height
 }
 
 // length returns the length of the finalized chain
@@ -35,7 +175,6 @@ func (f *Chain) Length() int {
 	return f.length
 }
 
-//
 func (f *Chain) Head() *Block {
 	f.Lock()
 	defer f.Unlock()
@@ -69,12 +208,56 @@ type Finalizer struct {
 	chain *Chain
 	// list of notarized blocks
 	notarized map[int][]*NotarizedBlock
+	// skip certificates of the rounds not finalized yet
+	skipped map[int]*SkipCertificate
 	// current round
 	round int
+	// blocks and skip certificates of this round and the ones before are
+	// dropped. It is the round before the current one, except right after a
+	// sync where the rounds following the head are still open.
+	floor int
 	// done callback
 	done func(int)
+	// application executing the finalized blocks
+	app Application
+	// state root after the last delivered block
+	stateRoot []byte
+	metrics   *Metrics
+	tracer    *Tracer
+	// time at which the first notarized block of each round arrived
+	firstNotarized map[int]time.Time
+	// called every CheckpointInterval finalized blocks, if set
+	checkpoint func(*Checkpoint)
+	// application snapshots taken at the last checkpoint heights
+	snapshots map[int]*StateSnapshot
+	// called with every finalized reconfiguration transaction, if set
+	reconfig func(tx []byte, round int)
+	// called with the round of every notarized block and skip certificate
+	// stored, if set. Callers only store verified ones.
+	advance func(round int)
+	// every notarized block seen, mapped from its hash, see Tree
+	tree map[string]*TreeNode
+	// hashes of the blocks of the tree mapped from their round
+	treeRounds map[int][]string
+	// round of the last block of the tree finalized, and lowest round kept
+	treeFinal, treeLow int
+	// called with every new notarized and finalized block, if set. It must
+	// not block.
+	publish func(*BlockEvent)
 }
 
+// StateSnapshot is the application state right after the block of the given
+// round, the height-th block of the chain, got committed
+type StateSnapshot struct {
+	Height int
+	Round  int
+	State  []byte
+}
+
+// snapshotHistory is the number of snapshots kept, so the one of the latest
+// signed checkpoint is still there while the next checkpoint gets signed
+const snapshotHistory = 2
+
 // NewFinalizer returns a fresh new finalizer
 // done is the callback called when the finalizing call has finishedi, i.e. after
 // sleeping T time and purging the chain.
@@ -83,25 +266,124 @@ func NewFinalizer(c *Config, chain *Chain, done func(int)) *Finalizer {
 		c:         c,
 		chain:     chain,
 		notarized: make(map[int][]*NotarizedBlock),
+		skipped:   make(map[int]*SkipCertificate),
 		done:      done,
 		round:     1,
+		metrics:   metricsOf(c),
+		tracer:    tracerOf(c),
+
+		firstNotarized: make(map[int]time.Time),
+		snapshots:      make(map[int]*StateSnapshot),
+		tree:           make(map[string]*TreeNode),
+		treeRounds:     make(map[int][]string),
 	}
-	f.notarized[0] = []*NotarizedBlock{&NotarizedBlock{
-		Block: GenesisBlock,
-		Notarization: &Notarization{
-			Hash:      GenesisBlock.BlockHeader.Hash(),
-			Signature: []byte("who are you old fool"),
-		},
-	}}
+	f.notarized[0] = []*NotarizedBlock{c.Genesis.NotarizedBlock()}
+	f.recordFinalized(f.notarized[0][0])
 	return f
 }
 
+// SetApplication initializes the application with the genesis state. From then
+// on, every finalized block is delivered to it, in order.
+func (f *Finalizer) SetApplication(app Application) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := app.InitChain(f.c.Genesis.AppState); err != nil {
+		return err
+	}
+	root, err := app.Commit()
+	if err != nil {
+		return err
+	}
+	f.app = app
+	f.stateRoot = root
+	return nil
+}
+
+// StateRootAfter returns the application state root resulting from the given
+// notarized block. It is nil if the application can't speculate on blocks not
+// finalized yet.
+func (f *Finalizer) StateRootAfter(n *NotarizedBlock) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.stateRootAfter(n)
+}
+
+// CheckStateRoot returns an error if the state root claimed by the block
+// differs from the one resulting from the block it builds on. Notarizers don't
+// sign such blocks. Nothing is checked if the application can't speculate on
+// blocks not finalized yet.
+func (f *Finalizer) CheckStateRoot(b *Block) error {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.app.(Speculator); !ok {
+		return nil
+	}
+	var root []byte
+	if head := f.chain.Head(); head != nil && head.BlockHeader.Hash() == b.PrvHash {
+		root = f.stateRoot
+	} else {
+		parent := f.parent(b)
+		if parent == nil {
+			return fmt.Errorf("no parent found for block of round %d", b.Round)
+		}
+		var err error
+		if root, err = f.stateRootAfter(parent); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(b.StateRoot, root) {
+		return fmt.Errorf("block of round %d claims state root %x instead of %x", b.Round, b.StateRoot, root)
+	}
+	return nil
+}
+
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (f *Finalizer) stateRootAfter(n *NotarizedBlock) ([]byte, error) {
+	spec, ok := f.app.(Speculator)
+	if !ok {
+		return nil, nil
+	}
+	// walk back to the head of the finalized chain, i.e. the last block
+	// delivered to the application
+	var head string
+	if b := f.chain.Head(); b != nil {
+		head = b.BlockHeader.Hash()
+	}
+	var blocks []*Block
+	for b := n.Block; b.Round > 0 && b.BlockHeader.Hash() != head; {
+		blocks = append([]*Block{b}, blocks...)
+		prv := f.parent(b)
+		if prv == nil {
+			return nil, fmt.Errorf("no parent found for block of round %d", b.Round)
+		}
+		b = prv.Block
+	}
+	return spec.SpeculateRoot(blocks)
+}
+
+// parent returns the notarized block the given block builds on, looking past
+// the skipped rounds
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (f *Finalizer) parent(b *Block) *NotarizedBlock {
+	for round := b.Round - 1; round >= 0; round-- {
+		for _, p := range f.notarized[round] {
+			if p.Block.BlockHeader.Hash() == b.PrvHash {
+				return p
+			}
+		}
+		if _, skipped := f.skipped[round]; !skipped {
+			return nil
+		}
+	}
+	return nil
+}
+
 // Store process the given notarized block and fire up the finalize routine if
 // needed
 func (f *Finalizer) Store(n *NotarizedBlock) {
 	f.Lock()
 	defer f.Unlock()
-	if n.Round < f.round {
+	if n.Round <= f.floor {
 		return
 	}
 	hash := n.Block.Hash()
@@ -114,15 +396,45 @@ func (f *Finalizer) Store(n *NotarizedBlock) {
 		}
 	}
 	f.notarized[key] = append(f.notarized[key], n)
+	f.record(n)
+	if f.advance != nil {
+		go f.advance(key)
+	}
+	if f.publish != nil {
+		f.publish(&BlockEvent{Block: n})
+	}
+	if _, exists := f.firstNotarized[key]; !exists {
+		f.firstNotarized[key] = time.Now()
+	}
 	//log.Lvl1("Finalizer: not. block round", n.Round, " before?", before, " => key", key, " => ", f.notarized[key])
-	if !before && key == f.round {
+	if _, skipped := f.skipped[key]; !before && !skipped && key == f.round {
 		// first time we see a notarized block for the current round
 		go f.finalize(f.round)
 	}
 }
 
+// StoreSkip stores the skip certificate of a round and fires up the finalize
+// routine if the round had no notarized block yet
+func (f *Finalizer) StoreSkip(s *SkipCertificate) {
+	f.Lock()
+	defer f.Unlock()
+	if s.Round <= f.floor {
+		return
+	}
+	if _, exists := f.skipped[s.Round]; exists {
+		return
+	}
+	f.skipped[s.Round] = s
+	if f.advance != nil {
+		go f.advance(s.Round)
+	}
+	if _, notarized := f.notarized[s.Round]; !notarized && s.Round == f.round {
+		go f.finalize(f.round)
+	}
+}
+
 // HighestRound returns the highest round this finalizer has seen
-// so far
+// so far, with a notarized block or skipped
 func (f *Finalizer) HighestRound() int {
 	f.Lock()
 	defer f.Unlock()
@@ -132,6 +444,11 @@ func (f *Finalizer) HighestRound() int {
 			max = round
 		}
 	}
+	for round := range f.skipped {
+		if max < round {
+			max = round
+		}
+	}
 	return max
 }
 
@@ -142,6 +459,10 @@ func (f *Finalizer) HighestRound() int {
 func (f *Finalizer) HighestChainHead(round int) (*NotarizedBlock, error) {
 	f.Lock()
 	defer f.Unlock()
+	// blocks following skipped rounds build on the last notarized round
+	for round > 0 && len(f.notarized[round]) == 0 && f.skipped[round] != nil {
+		round--
+	}
 	if round == 0 {
 		return f.notarized[0][0], nil
 	}
@@ -164,7 +485,7 @@ func (f *Finalizer) HighestChainHead(round int) (*NotarizedBlock, error) {
 	getWeight := func(block *NotarizedBlock) int {
 		weights, exists := allWeights[block.Round]
 		if !exists {
-			weights = Weights(f.c.BlockMakerNb, block.Randomness)
+			weights = f.c.Weights(block.Randomness)
 			allWeights[block.Round] = weights
 		}
 		//fmt.Println("weights: ", weights, " ==> owner: ", block.Owner)
@@ -225,7 +546,7 @@ func (f *Finalizer) HighestChainHead(round int) (*NotarizedBlock, error) {
 
 // finalizes runs the finalization algorithm for the given round
 func (f *Finalizer) finalize(round int) {
-	time.Sleep(time.Duration(f.c.FinalizeTime) * time.Millisecond)
+	time.Sleep(f.c.FinalizeTime)
 	f.Lock()
 	defer func() {
 		if f.done != nil {
@@ -234,19 +555,281 @@ func (f *Finalizer) finalize(round int) {
 	}()
 	defer f.Unlock()
 	if round-1 <= 0 {
-		f.round++
+		f.next()
+		return
+	}
+	if len(f.notarized[round-2]) == 0 {
+		// empty round, nothing to finalize
+		if _, skipped := f.skipped[round-2]; !skipped {
+			log.Lvl2("finalizer: round", round-2, "has neither notarized block nor skip certificate")
+		}
+		f.tracer.Event(EventRoundSkipped, round-2, "")
+		f.prune(round - 2)
+		f.next()
 		return
 	}
+	f.metrics.Forks.Observe(float64(len(f.notarized[round-2])))
+	f.metrics.Record("fork_width", float64(len(f.notarized[round-2])))
 	f.purge(round - 1)
 	// XXX DO the whole r' R* once we're sure
 	// XXX For the moment take the block at round r-2
 	b := f.notarized[round-2][0]
-	f.chain.Append(b.Block)
-	delete(f.notarized, round-2)
+	f.chain.Append(b)
+	f.recordFinalized(b)
+	if f.publish != nil {
+		f.publish(&BlockEvent{Block: b, Finalized: true})
+	}
+	f.metrics.FinalizedHeight.Set(float64(b.Round))
+	if first, exists := f.firstNotarized[b.Round]; exists {
+		f.metrics.Record("notarization_to_finalization", float64(time.Since(first).Nanoseconds())/1e6)
+		delete(f.firstNotarized, b.Round)
+	}
+	if b.Round > 0 {
+		// rank 0 is the block maker with the highest priority
+		weights := f.c.Weights(b.Randomness)
+		f.metrics.Record("finalized_rank", float64(f.c.BlockMakerNb-weights[b.Owner]))
+	}
+	f.metrics.FlushRound()
+	f.tracer.Event(EventFinalized, b.Round, b.BlockHeader.Hash())
+	if f.app != nil && b.Round > 0 {
+		f.deliver(b.Block)
+	}
+	if f.reconfig != nil {
+		f.scanReconfig(b.Block)
+	}
+	if height := f.chain.Length(); f.c.CheckpointInterval > 0 && height%f.c.CheckpointInterval == 0 {
+		f.snapshot(height, b.Round)
+		if f.checkpoint != nil {
+			go f.checkpoint(&Checkpoint{
+				ChainID:   f.c.ChainID,
+				Height:    height,
+				Round:     b.Round,
+				Hash:      b.BlockHeader.Hash(),
+				StateRoot: f.stateRoot,
+			})
+		}
+	}
+	f.prune(round - 2)
+	f.next()
+}
+
+// next moves on to the next round. Its first notarized block or skip
+// certificate may have arrived before, in which case it is finalized right
+// away.
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (f *Finalizer) next() {
+	f.floor = f.round
 	f.round++
+	_, notarized := f.notarized[f.round]
+	_, skipped := f.skipped[f.round]
+	if notarized || skipped {
+		go f.finalize(f.round)
+	}
 }
 
-// purge is the recursive call to the purge the chain
+// snapshot keeps the state of the application, if it can take one, at the
+// given height
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (f *Finalizer) snapshot(height, round int) {
+	snap, ok := f.app.(Snapshotter)
+	if !ok {
+		return
+	}
+	state, err := snap.Snapshot()
+	if err != nil {
+		log.Error("finalizer: can't take snapshot of round", round, ":", err)
+		return
+	}
+	f.snapshots[height] = &StateSnapshot{Height: height, Round: round, State: state}
+	delete(f.snapshots, height-snapshotHistory*f.c.CheckpointInterval)
+}
+
+// Snapshot returns the application snapshot taken at the given height, nil if
+// there is none
+func (f *Finalizer) Snapshot(height int) *StateSnapshot {
+	f.Lock()
+	defer f.Unlock()
+	return f.snapshots[height]
+}
+
+// Pending returns the notarized blocks not finalized yet, by round
+func (f *Finalizer) Pending() []*NotarizedBlock {
+	f.Lock()
+	defer f.Unlock()
+	var head int
+	if b := f.chain.Head(); b != nil {
+		head = b.Round
+	}
+	var pending []*NotarizedBlock
+	for round, blocks := range f.notarized {
+		if round > head {
+			pending = append(pending, blocks...)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Round < pending[j].Round
+	})
+	return pending
+}
+
+// Notarized returns the finalized block of the given round, if any, followed by
+// the notarized blocks of the round not finalized yet
+func (f *Finalizer) Notarized(round int) []*NotarizedBlock {
+	if round == 0 {
+		return []*NotarizedBlock{f.c.Genesis.NotarizedBlock()}
+	}
+	var blocks []*NotarizedBlock
+	if final, err := f.chain.Blocks(round, 1); err == nil && len(final) > 0 && final[0].Round == round {
+		blocks = append(blocks, final[0])
+	}
+	for _, n := range f.Pending() {
+		if n.Round == round {
+			blocks = append(blocks, n)
+		}
+	}
+	return blocks
+}
+
+// Find returns the notarized block of the given hash, finalized or not, nil if
+// the node does not hold it in memory
+func (f *Finalizer) Find(hash string) *NotarizedBlock {
+	if n := f.chain.Find(hash); n != nil {
+		return n
+	}
+	for _, n := range f.Pending() {
+		if n.Block.BlockHeader.Hash() == hash {
+			return n
+		}
+	}
+	return nil
+}
+
+// Sync restarts the finalizer from a checkpoint instead of the genesis. The
+// application state is restored from the snapshot and must match the state
+// root of the checkpoint. Without snapshot, the application is left in its
+// current state, the one of the genesis when syncing from it. The blocks must
+// be verified already: the finalized blocks start with the one of the
+// checkpoint and follow each other, the pending ones are notarized blocks not
+// finalized yet.
+func (f *Finalizer) Sync(ckpt *Checkpoint, state []byte, blocks, pending []*NotarizedBlock) error {
+	f.Lock()
+	defer f.Unlock()
+	if len(blocks) == 0 || blocks[0].BlockHeader.Hash() != ckpt.Hash {
+		return errors.New("finalizer: blocks do not start at the checkpoint")
+	}
+	if f.app != nil && state != nil {
+		snap, ok := f.app.(Snapshotter)
+		if !ok {
+			return errors.New("finalizer: application can't restore a snapshot")
+		}
+		if err := snap.Restore(state); err != nil {
+			return err
+		}
+		root, err := f.app.Commit()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(root, ckpt.StateRoot) {
+			return fmt.Errorf("finalizer: restored state root %x does not match the checkpoint", root)
+		}
+		f.stateRoot = root
+	}
+	f.chain.Reset(blocks[0], ckpt.Height)
+	for _, n := range blocks[1:] {
+		f.chain.Append(n)
+		if f.app != nil {
+			f.deliver(n.Block)
+		}
+	}
+	head := blocks[len(blocks)-1]
+	// whatever was seen before is replaced by the blocks of the peer
+	f.notarized = make(map[int][]*NotarizedBlock)
+	f.skipped = make(map[int]*SkipCertificate)
+	f.firstNotarized = make(map[int]time.Time)
+	f.notarized[head.Round] = []*NotarizedBlock{head}
+	for _, n := range pending {
+		if n.Round > head.Round {
+			f.notarized[n.Round] = append(f.notarized[n.Round], n)
+		}
+	}
+	// as if the round notarizing the block after the head just got finalized
+	f.round = head.Round + 2
+	f.metrics.FinalizedHeight.Set(float64(head.Round))
+	log.Lvl1("finalizer: synced at height", f.chain.Length(), "round", head.Round)
+	f.next()
+	// the blocks of the rounds after the head may still come
+	f.floor = head.Round
+	return nil
+}
+
+// scanReconfig hands the reconfiguration transactions of the finalized block
+// over to the reconfig callback
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (f *Finalizer) scanReconfig(b *Block) {
+	txs, err := DecodeTxs(b.Blob)
+	if err != nil {
+		// random blob
+		return
+	}
+	for _, tx := range txs {
+		if IsReconfigTx(tx) {
+			go f.reconfig(tx, b.Round)
+		}
+	}
+}
+
+// Reconfigure switches the finalizer to the config of a new roster, along with
+// the callback of the new process using it
+func (f *Finalizer) Reconfigure(c *Config, done func(int)) {
+	f.Lock()
+	defer f.Unlock()
+	f.c = c
+	f.done = done
+}
+
+// prune forgets everything about the given round and the ones before, they
+// can't change the chain anymore
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (f *Finalizer) prune(round int) {
+	for r := range f.notarized {
+		if r <= round {
+			delete(f.notarized, r)
+		}
+	}
+	for r := range f.skipped {
+		if r <= round {
+			delete(f.skipped, r)
+		}
+	}
+	for r := range f.firstNotarized {
+		if r <= round {
+			delete(f.firstNotarized, r)
+		}
+	}
+}
+
+// deliver executes the finalized block on the application and commits the
+// resulting state.
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (f *Finalizer) deliver(b *Block) {
+	if b.StateRoot != nil && !bytes.Equal(b.StateRoot, f.stateRoot) {
+		log.Errorf("finalizer: block of round %d claims state root %x but got %x", b.Round, b.StateRoot, f.stateRoot)
+	}
+	if err := f.app.DeliverBlock(b); err != nil {
+		log.Error("finalizer: application failed to deliver block", b.Round, ":", err)
+	}
+	root, err := f.app.Commit()
+	if err != nil {
+		log.Error("finalizer: application failed to commit round", b.Round, ":", err)
+		return
+	}
+	f.stateRoot = root
+	log.Lvlf2("finalizer: round %d committed with state root %x", b.Round, root)
+}
+
+// purge is the recursive call to the purge the chain. The blocks of round
+// start-1 are checked against the blocks of the first round from start on that
+// is not empty.
 // ONLY CALLED WHEN CALLER HAVE THE LOCK
 // XXX Not doing any recursive stuff for the moment
 func (f *Finalizer) purge(start int) {
@@ -258,9 +841,13 @@ func (f *Finalizer) purge(start int) {
 	if len(prevBlocks) <= 1 {
 		return
 	}
-	startBlocks, exists := f.notarized[start]
-	if !exists {
-		panic("that should not happen")
+	var startBlocks []*NotarizedBlock
+	for round := start; round <= f.round && len(startBlocks) == 0; round++ {
+		startBlocks = f.notarized[round]
+	}
+	if len(startBlocks) == 0 {
+		// only skipped rounds since then, nothing to purge with
+		return
 	}
 
 	var referencedIdx []int
@@ -283,6 +870,9 @@ func (f *Finalizer) purge(start int) {
 	if len(referencedIdx) > 1 {
 		panic("that should not happen")
 	}
+	if len(referencedIdx) == 0 {
+		return
+	}
 	finalizedBlock := prevBlocks[referencedIdx[0]]
 	delete(f.notarized, start-1)
 	f.notarized[start-1] = []*NotarizedBlock{finalizedBlock}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testFinalizer returns the genesis of a chain with two block makers and a
+// finalizer of the chain. Its finalize routines don't run during the test.
+func testFinalizer(chainID string) (*Genesis, *Finalizer) {
+	g := &Genesis{ChainID: chainID, BlockMakerNb: 2, BeaconSeed: 1}
+	c := &Config{ChainID: chainID, Genesis: g, BlockMakerNb: 2, FinalizeTime: time.Hour}
+	return g, NewFinalizer(c, new(Chain), nil)
+}
+
+// testBlock returns the block of the owner at the given round built on the
+// parent, notarized. Its randomness is ten times the round and its
+// notarization signature holds the round.
+func testBlock(round, owner int, parent *NotarizedBlock) *NotarizedBlock {
+	b := &Block{BlockHeader: BlockHeader{
+		ChainID:    parent.ChainID,
+		Round:      round,
+		Owner:      owner,
+		Randomness: int64(round * 10),
+		PrvHash:    parent.BlockHeader.Hash(),
+	}}
+	return &NotarizedBlock{Block: b, Notarization: &Notarization{Hash: b.BlockHeader.Hash(), Signature: []byte{byte(round)}}}
+}
+
+func TestFinalizerSkippedRound(t *testing.T) {
+	g, f := testFinalizer("skip")
+	b1 := testBlock(1, 0, g.NotarizedBlock())
+	f.Store(b1)
+	f.StoreSkip(&SkipCertificate{ChainID: "skip", Round: 2})
+	if r := f.HighestRound(); r != 2 {
+		t.Fatal("skipped round not counted, highest round is", r)
+	}
+	head, err := f.HighestChainHead(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != b1 {
+		t.Fatal("block after a skipped round should build on the last notarized one")
+	}
+
+	b3 := testBlock(3, 0, b1)
+	f.Store(b3)
+	f.Lock()
+	parent := f.parent(b3.Block)
+	f.Unlock()
+	if parent != b1 {
+		t.Fatal("parent not found across the skipped round")
+	}
+
+	if bytes.Equal(SkipMessage("skip", 2), SkipMessage("skip", 3)) ||
+		bytes.Equal(SkipMessage("skip", 2), SkipMessage("other", 2)) {
+		t.Fatal("skip messages must differ by round and chain")
+	}
+}
+
+func TestFinalizerBoundedMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const rounds = 3000
+	const retention = 10
+	g := &Genesis{ChainID: "long", BlockMakerNb: 1, BeaconSeed: 1}
+	c := &Config{ChainID: "long", Genesis: g, BlockMakerNb: 1, Retention: retention, BlockDir: dir}
+	chain := NewChain(c)
+	f := NewFinalizer(c, chain, nil)
+	// waits for the finalize routine of the round to be done
+	waitRound := func(round int) {
+		for {
+			f.Lock()
+			done := f.round > round
+			f.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	heap := func() uint64 {
+		runtime.GC()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+
+	parent := g.NotarizedBlock()
+	var start uint64
+	for round := 1; round <= rounds; round++ {
+		b := &Block{BlockHeader: BlockHeader{
+			ChainID:    "long",
+			Round:      round,
+			Randomness: int64(round),
+			PrvHash:    parent.BlockHeader.Hash(),
+		}, Blob: make([]byte, 1024)}
+		parent = &NotarizedBlock{Block: b, Notarization: &Notarization{Hash: b.BlockHeader.Hash()}}
+		f.Store(parent)
+		waitRound(round)
+		if round == 500 {
+			start = heap()
+		}
+	}
+
+	f.Lock()
+	if len(f.notarized) > 3 || len(f.skipped) > 0 || len(f.firstNotarized) > 3 {
+		t.Fatal("finalizer keeps old rounds:", len(f.notarized), len(f.skipped), len(f.firstNotarized))
+	}
+	f.Unlock()
+	if len(chain.all) != retention {
+		t.Fatal("chain keeps", len(chain.all), "blocks in memory")
+	}
+	if chain.Length() != rounds-1 {
+		t.Fatal("wrong chain length", chain.Length())
+	}
+	// 2500 blocks of 1KB were finalized since the first measure
+	if end := heap(); end > start+1024*1024 {
+		t.Fatal("memory grows from", start, "to", end)
+	}
+
+	// evicted blocks are still served from the store
+	headers, err := chain.Headers(0, rounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != rounds-1 {
+		t.Fatal("expected", rounds-1, "headers, got", len(headers))
+	}
+	for i, h := range headers {
+		if h.Header.Round != i {
+			t.Fatal("wrong header at", i, ":", h.Header.Round)
+		}
+	}
+}
+
+func TestChainEvictedWithoutStore(t *testing.T) {
+	g := &Genesis{ChainID: "evicted", BlockMakerNb: 1, BeaconSeed: 1}
+	chain := NewChain(&Config{ChainID: "evicted", Genesis: g, BlockMakerNb: 1, Retention: 2})
+	parent := g.NotarizedBlock()
+	for round := 1; round <= 4; round++ {
+		parent = testBlock(round, 0, parent)
+		chain.Append(parent)
+		if round == 2 {
+			if blocks, err := chain.Blocks(0, 10); err != nil || len(blocks) != 2 {
+				t.Fatal("blocks held in memory not returned:", err)
+			}
+		}
+	}
+	if _, err := chain.Blocks(0, 10); err != ErrEvicted {
+		t.Fatal("evicted blocks requested without error:", err)
+	}
+	if _, err := chain.Headers(1, 10); err != ErrEvicted {
+		t.Fatal("evicted headers requested without error:", err)
+	}
+	blocks, err := chain.Blocks(3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[0].Round != 3 || blocks[1].Round != 4 {
+		t.Fatal("wrong blocks held in memory")
+	}
+}
+
+func TestFinalizerSync(t *testing.T) {
+	g := &Genesis{ChainID: "sync", BlockMakerNb: 1, BeaconSeed: 1}
+	c := &Config{ChainID: "sync", Genesis: g, BlockMakerNb: 1, FinalizeTime: time.Hour}
+	// the blocks of the node synced from, setting one key each
+	var blocks []*NotarizedBlock
+	parent := g.NotarizedBlock()
+	for round := 1; round <= 7; round++ {
+		tx := &KVTx{Op: KVSet, Key: []byte{byte(round)}, Value: []byte{byte(round)}}
+		blob := EncodeTxs([][]byte{tx.Encode()})
+		b := &Block{BlockHeader: BlockHeader{
+			ChainID: "sync",
+			Round:   round,
+			Root:    rootHash(blob),
+			PrvHash: parent.BlockHeader.Hash(),
+		}, Blob: blob}
+		parent = &NotarizedBlock{Block: b, Notarization: &Notarization{Hash: b.BlockHeader.Hash()}}
+		blocks = append(blocks, parent)
+	}
+	source := NewKVStore()
+	for _, n := range blocks[:3] {
+		source.DeliverBlock(n.Block)
+	}
+	root, _ := source.Commit()
+	state, err := source.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ckpt := &Checkpoint{ChainID: "sync", Height: 4, Round: 3, Hash: blocks[2].BlockHeader.Hash(), StateRoot: root}
+
+	f := NewFinalizer(c, new(Chain), nil)
+	kv := NewKVStore()
+	if err := f.SetApplication(kv); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(ckpt, state, blocks[3:4], nil); err == nil {
+		t.Fatal("blocks not starting at the checkpoint accepted")
+	}
+	if err := f.Sync(ckpt, state, blocks[2:4], blocks[4:6]); err != nil {
+		t.Fatal(err)
+	}
+	if f.chain.Length() != 5 || f.chain.Head() != blocks[3].Block {
+		t.Fatal("wrong chain after sync:", f.chain.Length())
+	}
+	source.DeliverBlock(blocks[3].Block)
+	root, _ = source.Commit()
+	if !bytes.Equal(f.stateRoot, root) {
+		t.Fatal("state after sync differs from the source")
+	}
+	if pending := f.Pending(); len(pending) != 2 || pending[0] != blocks[4] || pending[1] != blocks[5] {
+		t.Fatal("wrong pending blocks after sync")
+	}
+	if r := f.HighestRound(); r != 6 {
+		t.Fatal("wrong highest round after sync:", r)
+	}
+
+	// the blocks following the head arrive once synced
+	fast := *c
+	fast.FinalizeTime = 0
+	f = NewFinalizer(&fast, new(Chain), nil)
+	if err := f.Sync(ckpt, nil, blocks[2:4], nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range blocks[4:] {
+		f.Store(n)
+	}
+	for start := time.Now(); f.chain.Length() != 6; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("blocks stored after the sync not finalized")
+		}
+	}
+	if f.chain.Head() != blocks[4].Block {
+		t.Fatal("wrong head after finalizing past the sync")
+	}
+}
+
+func TestFinalizerCheckStateRoot(t *testing.T) {
+	g := &Genesis{ChainID: "root", BlockMakerNb: 1, BeaconSeed: 1}
+	c := &Config{ChainID: "root", Genesis: g, BlockMakerNb: 1, FinalizeTime: time.Hour}
+	f := NewFinalizer(c, new(Chain), nil)
+	if err := f.SetApplication(NewKVStore()); err != nil {
+		t.Fatal(err)
+	}
+	tx := &KVTx{Op: KVSet, Key: []byte("key"), Value: []byte("value")}
+	blob := EncodeTxs([][]byte{tx.Encode()})
+	genesisRoot, err := f.StateRootAfter(g.NotarizedBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1 := &Block{BlockHeader: BlockHeader{
+		ChainID:   "root",
+		Round:     1,
+		Root:      rootHash(blob),
+		PrvHash:   g.NotarizedBlock().BlockHeader.Hash(),
+		StateRoot: genesisRoot,
+	}, Blob: blob}
+	if err := f.CheckStateRoot(b1); err != nil {
+		t.Fatal(err)
+	}
+	n1 := &NotarizedBlock{Block: b1, Notarization: &Notarization{Hash: b1.BlockHeader.Hash()}}
+	f.Store(n1)
+
+	// the block of round 2 must claim the state after the transaction
+	b2 := &Block{BlockHeader: BlockHeader{
+		ChainID:   "root",
+		Round:     2,
+		PrvHash:   b1.BlockHeader.Hash(),
+		StateRoot: genesisRoot,
+	}}
+	if err := f.CheckStateRoot(b2); err == nil {
+		t.Fatal("block with a stale state root accepted")
+	}
+	if b2.StateRoot, err = f.StateRootAfter(n1); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.CheckStateRoot(b2); err != nil {
+		t.Fatal(err)
+	}
+	b2.PrvHash = "unknown"
+	if err := f.CheckStateRoot(b2); err == nil {
+		t.Fatal("block with an unknown parent accepted")
+	}
+}
@@ -0,0 +1,348 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/csanti/onet/log"
+)
+
+// gatewayBlock is a notarized block as returned by the gateway
+type gatewayBlock struct {
+	Hash      string
+	Finalized bool
+	Header    BlockHeader
+	Blob      []byte
+	Signature []byte // notarization, empty for the genesis
+}
+
+// gatewayNotarization is the notarization of a block as returned by the
+// gateway
+type gatewayNotarization struct {
+	Hash      string
+	Round     int
+	Finalized bool
+	Signature []byte
+}
+
+// gatewayStatus is the state of the node as returned by the gateway
+type gatewayStatus struct {
+	ChainID        string
+	Index          int
+	Role           string
+	HighestRound   int    // highest round with a notarized block or skip certificate
+	FinalizedRound int    // round of the head of the finalized chain
+	Height         int    // length of the finalized chain
+	Head           string // hash of the head of the finalized chain
+	Pending        int    // notarized blocks not finalized yet
+}
+
+// gatewayTx is the body of a transaction submission
+type gatewayTx struct {
+	Tx []byte // base64 encoded in JSON
+}
+
+// gatewayError is returned by the gateway on failure
+type gatewayError struct {
+	Error string
+}
+
+// Timeouts of the requests to the gateway. The subscriptions lift the write
+// timeout of their stream.
+const (
+	gatewayReadTimeout  = 10 * time.Second
+	gatewayWriteTimeout = 10 * time.Second
+)
+
+// serveGateway starts the gateway of this node on the given address. It runs
+// until the service closes.
+// ONLY CALLED WHEN CALLER HAVE THE PROCESS LOCK
+func (d *Dfinity) serveGateway(addr string) {
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      d.gatewayHandler(),
+		ReadTimeout:  gatewayReadTimeout,
+		WriteTimeout: gatewayWriteTimeout,
+	}
+	d.gateway = srv
+	log.Lvl1("gateway listening on", addr)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("gateway: can't serve on", addr, ":", err)
+		}
+	}()
+}
+
+// gatewayHandler returns the HTTP handler of the gateway. It answers in JSON
+// from the state of the finalizer of this node:
+//
+//	GET  /status                    state of the node
+//	GET  /blocks/round/<round>      notarized blocks of the round
+//	GET  /blocks/hash/<hash>        notarized block of the given hash
+//	GET  /notarizations/<round>     notarizations of the blocks of the round
+//	GET  /beacons/<round>           randomness of the round
+//	POST /txs                       submits {"Tx": "<base64>"} to the block makers
+//	GET  /subscribe?from=<round>    streams the block events, one JSON per line
+func (d *Dfinity) gatewayHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", d.gatewayStatus)
+	mux.HandleFunc("/blocks/round/", d.gatewayBlocks)
+	mux.HandleFunc("/blocks/hash/", d.gatewayBlock)
+	mux.HandleFunc("/notarizations/", d.gatewayNotarizations)
+	mux.HandleFunc("/beacons/", d.gatewayBeacon)
+	mux.HandleFunc("/txs", d.gatewaySubmit)
+	mux.HandleFunc("/subscribe", d.gatewaySubscribe)
+	return mux
+}
+
+func (d *Dfinity) gatewayStatus(w http.ResponseWriter, r *http.Request) {
+	f, ok := d.gatewayFinalizer(w, r)
+	if !ok {
+		return
+	}
+	c := d.current().c
+	s := &gatewayStatus{
+		ChainID:      c.ChainID,
+		Index:        c.Index,
+		Role:         c.Role(),
+		HighestRound: f.HighestRound(),
+		Height:       f.chain.Length(),
+		Pending:      len(f.Pending()),
+	}
+	if head := f.chain.Head(); head != nil {
+		s.FinalizedRound = head.Round
+		s.Head = head.BlockHeader.Hash()
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (d *Dfinity) gatewayBlocks(w http.ResponseWriter, r *http.Request) {
+	f, ok := d.gatewayFinalizer(w, r)
+	if !ok {
+		return
+	}
+	round, ok := gatewayRound(w, r, "/blocks/round/")
+	if !ok {
+		return
+	}
+	blocks := make([]*gatewayBlock, 0)
+	for i, n := range f.Notarized(round) {
+		blocks = append(blocks, newGatewayBlock(n, i == 0 && round <= finalizedRound(f)))
+	}
+	writeJSON(w, http.StatusOK, blocks)
+}
+
+func (d *Dfinity) gatewayBlock(w http.ResponseWriter, r *http.Request) {
+	f, ok := d.gatewayFinalizer(w, r)
+	if !ok {
+		return
+	}
+	hash := strings.TrimPrefix(r.URL.Path, "/blocks/hash/")
+	n := f.Find(hash)
+	if n == nil {
+		writeError(w, http.StatusNotFound, errors.New("no such block"))
+		return
+	}
+	writeJSON(w, http.StatusOK, newGatewayBlock(n, n.Round <= finalizedRound(f)))
+}
+
+func (d *Dfinity) gatewayNotarizations(w http.ResponseWriter, r *http.Request) {
+	f, ok := d.gatewayFinalizer(w, r)
+	if !ok {
+		return
+	}
+	round, ok := gatewayRound(w, r, "/notarizations/")
+	if !ok {
+		return
+	}
+	nots := make([]*gatewayNotarization, 0)
+	for i, n := range f.Notarized(round) {
+		nots = append(nots, &gatewayNotarization{
+			Hash:      n.Notarization.Hash,
+			Round:     n.Round,
+			Finalized: i == 0 && round <= finalizedRound(f),
+			Signature: n.Notarization.Signature,
+		})
+	}
+	writeJSON(w, http.StatusOK, nots)
+}
+
+// gatewayBeacon returns the randomness of the round, as carried by its blocks
+// or kept by the beacon
+func (d *Dfinity) gatewayBeacon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("GET only"))
+		return
+	}
+	round, ok := gatewayRound(w, r, "/beacons/")
+	if !ok {
+		return
+	}
+	if b := d.current().beacon; b != nil {
+		b.Lock()
+		packet, exists := b.beacons[round]
+		b.Unlock()
+		if exists {
+			writeJSON(w, http.StatusOK, packet)
+			return
+		}
+	}
+	if f := d.finalizer(); f != nil {
+		if blocks := f.Notarized(round); len(blocks) > 0 {
+			writeJSON(w, http.StatusOK, &BeaconPacket{Round: round, Randomness: blocks[0].Randomness})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, errors.New("no beacon for this round"))
+}
+
+func (d *Dfinity) gatewaySubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("POST only"))
+		return
+	}
+	// a transaction can't be larger than a block, base64 encoded in a JSON
+	// object
+	limit := base64.StdEncoding.EncodedLen(d.current().c.BlockSize) + len(`{"Tx":""}`)
+	r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+	tx := new(gatewayTx)
+	if err := json.NewDecoder(r.Body).Decode(tx); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, errors.New("transaction larger than a block"))
+			return
+		}
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(tx.Tx) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("empty transaction"))
+		return
+	}
+	if err := d.SubmitTx(tx.Tx); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, struct{}{})
+}
+
+// gatewayEvent is a block event as streamed by the gateway
+type gatewayEvent struct {
+	Finalized bool
+	Block     *gatewayBlock
+}
+
+// gatewaySubscribe streams the block events until the client goes away. The
+// optional from parameter replays the blocks from that round on, see
+// Dfinity.Subscribe. Slow clients are disconnected and can resume from the
+// last finalized round they got.
+func (d *Dfinity) gatewaySubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("GET only"))
+		return
+	}
+	from := -1
+	if str := r.URL.Query().Get("from"); str != "" {
+		var err error
+		if from, err = strconv.Atoi(str); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid round"))
+			return
+		}
+	}
+	rc := http.NewResponseController(w)
+	// the stream outlives the write timeout of the gateway
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sub := d.Subscribe(from)
+	defer sub.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				if err := sub.Err(); err != nil {
+					enc.Encode(&gatewayError{Error: err.Error()})
+				}
+				return
+			}
+			if err := enc.Encode(&gatewayEvent{Finalized: ev.Finalized, Block: newGatewayBlock(ev.Block, ev.Finalized)}); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// gatewayFinalizer returns the finalizer of this node, or answers with an
+// error if the request can't be served
+func (d *Dfinity) gatewayFinalizer(w http.ResponseWriter, r *http.Request) (*Finalizer, bool) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("GET only"))
+		return nil, false
+	}
+	f := d.finalizer()
+	if f == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("no finalized chain on this node"))
+		return nil, false
+	}
+	return f, true
+}
+
+// gatewayRound parses the round following the prefix of the path
+func gatewayRound(w http.ResponseWriter, r *http.Request, prefix string) (int, bool) {
+	round, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil || round < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("invalid round"))
+		return 0, false
+	}
+	return round, true
+}
+
+// finalizedRound returns the round of the head of the finalized chain
+func finalizedRound(f *Finalizer) int {
+	if head := f.chain.Head(); head != nil {
+		return head.Round
+	}
+	return 0
+}
+
+func newGatewayBlock(n *NotarizedBlock, finalized bool) *gatewayBlock {
+	b := &gatewayBlock{
+		Hash:      n.Block.BlockHeader.Hash(),
+		Finalized: finalized,
+		Header:    n.Block.BlockHeader,
+		Blob:      n.Block.Blob,
+	}
+	if n.Notarization != nil {
+		b.Signature = n.Notarization.Signature
+	}
+	return b
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Lvl2("gateway: can't write reply:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, &gatewayError{Error: err.Error()})
+}
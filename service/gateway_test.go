@@ -0,0 +1,74 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGateway(t *testing.T) {
+	g, f := testFinalizer("gateway")
+	b1 := testBlock(1, 0, g.NotarizedBlock())
+	b2 := testBlock(2, 0, b1)
+	f.chain.Append(b1)
+	f.Store(b2)
+	f.c.BlockSize = 16
+	d := &Dfinity{c: f.c, fin: f}
+	srv := httptest.NewServer(d.gatewayHandler())
+	defer srv.Close()
+
+	get := func(path string, v interface{}) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	status := new(gatewayStatus)
+	if code := get("/status", status); code != http.StatusOK || status.FinalizedRound != 1 || status.HighestRound != 2 || status.Pending != 1 {
+		t.Fatal("wrong status", code, status)
+	}
+	var blocks []*gatewayBlock
+	if get("/blocks/round/1", &blocks); len(blocks) != 1 || !blocks[0].Finalized || blocks[0].Hash != b1.BlockHeader.Hash() {
+		t.Fatal("wrong blocks of round 1")
+	}
+	block2 := new(gatewayBlock)
+	if get("/blocks/hash/"+b2.BlockHeader.Hash(), block2); block2.Header.Round != 2 || block2.Finalized {
+		t.Fatal("wrong block by hash")
+	}
+	var nots []*gatewayNotarization
+	if get("/notarizations/2", &nots); len(nots) != 1 || nots[0].Signature[0] != 2 {
+		t.Fatal("wrong notarizations of round 2")
+	}
+	beacon := new(BeaconPacket)
+	if get("/beacons/2", beacon); beacon.Randomness != 20 {
+		t.Fatal("wrong beacon of round 2")
+	}
+	if code := get("/blocks/round/x", new(gatewayError)); code != http.StatusBadRequest {
+		t.Fatal("invalid round accepted")
+	}
+	resp, err := http.Post(srv.URL+"/txs", "application/json", strings.NewReader("not json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("invalid transaction accepted")
+	}
+	large := `{"Tx":"` + strings.Repeat("A", 64) + `"}`
+	resp, err = http.Post(srv.URL+"/txs", "application/json", strings.NewReader(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatal("transaction larger than a block accepted")
+	}
+}
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber"
+)
+
+// Roles a node can have in the genesis file
+const (
+	RoleBeacon     = "beacon"
+	RoleBlockMaker = "blockmaker"
+	RoleNotarizer  = "notarizer"
+)
+
+// Genesis describes the initial state of a network. Every node derives the
+// block of round 0 from it, so networks started from different genesis never
+// share any block.
+type Genesis struct {
+	ChainID      string        // identifier of the chain
+	Time         time.Time     // time at which the network starts
+	Roster       *onet.Roster  // beacons, then block makers, then notarizers
+	BeaconNb     int           // how many beacons are at the head of the roster
+	BlockMakerNb int           // how many block makers follow
+	NotarizerNb  int           // how many notarizers follow
+	Threshold    int           // threshold of the notarizers' signing key
+	Public       []kyber.Point // commitments of the notarizers' public polynomial
+	AppState     []byte        // initial application state
+	BeaconSeed   int64         // randomness of round 0, seeds the beacon
+	Stakes       StakeRegistry // stakes of the nodes, all block makers equal if empty
+}
+
+// genesisToml is the on-disk representation of the genesis
+type genesisToml struct {
+	ChainID     string
+	GenesisTime time.Time
+	Threshold   int
+	GroupPublic []string // hex encoded commitments
+	AppState    string   // hex encoded initial state
+	BeaconSeed  int64
+	Nodes       []*nodeToml
+}
+
+type nodeToml struct {
+	Address string
+	Public  string // hex encoded public key
+	Role    string
+	Stake   uint64 // stake held by the node, none if 0
+}
+
+// LoadGenesis reads the genesis file at the given path. Public keys of the
+// nodes are decoded using the given group.
+func LoadGenesis(path string, keys kyber.Group) (*Genesis, error) {
+	buff, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseGenesis(string(buff), keys)
+}
+
+// ParseGenesis decodes a genesis out of its TOML representation, for example:
+//
+//	ChainID = "dfinity-testnet"
+//	GenesisTime = 2019-05-01T12:00:00Z
+//	Threshold = 2
+//	GroupPublic = ["<hex>", "<hex>"]
+//	AppState = "<hex>"
+//	BeaconSeed = 1234
+//	[[Nodes]]
+//	Address = "tcp://127.0.0.1:7000"
+//	Public = "<hex>"
+//	Role = "beacon"
+//	Stake = 100
+//
+// Nodes are ordered by role, beacons first, then block makers and notarizers.
+// Within a role the order of the file is kept.
+func ParseGenesis(data string, keys kyber.Group) (*Genesis, error) {
+	gt := new(genesisToml)
+	if _, err := toml.Decode(data, gt); err != nil {
+		return nil, err
+	}
+	g := &Genesis{
+		ChainID:    gt.ChainID,
+		Time:       gt.GenesisTime,
+		Threshold:  gt.Threshold,
+		BeaconSeed: gt.BeaconSeed,
+	}
+	var err error
+	if g.AppState, err = hex.DecodeString(gt.AppState); err != nil {
+		return nil, fmt.Errorf("genesis: invalid application state: %s", err)
+	}
+	for i, str := range gt.GroupPublic {
+		p, err := decodePoint(G2, str)
+		if err != nil {
+			return nil, fmt.Errorf("genesis: invalid group public key %d: %s", i, err)
+		}
+		g.Public = append(g.Public, p)
+	}
+
+	var beacons, makers, notarizers []*network.ServerIdentity
+	for i, n := range gt.Nodes {
+		p, err := decodePoint(keys, n.Public)
+		if err != nil {
+			return nil, fmt.Errorf("genesis: invalid public key for node %d: %s", i, err)
+		}
+		si := network.NewServerIdentity(p, network.Address(n.Address))
+		if n.Stake > 0 {
+			g.Stakes = append(g.Stakes, &Stake{Public: p, Amount: n.Stake})
+		}
+		switch n.Role {
+		case RoleBeacon:
+			beacons = append(beacons, si)
+		case RoleBlockMaker:
+			makers = append(makers, si)
+		case RoleNotarizer:
+			notarizers = append(notarizers, si)
+		default:
+			return nil, fmt.Errorf("genesis: unknown role %q for node %d", n.Role, i)
+		}
+	}
+	g.BeaconNb = len(beacons)
+	g.BlockMakerNb = len(makers)
+	g.NotarizerNb = len(notarizers)
+	list := append(append(beacons, makers...), notarizers...)
+	if len(list) > 0 {
+		g.Roster = onet.NewRoster(list)
+	}
+	if err := g.Verify(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func decodePoint(g kyber.Group, str string) (kyber.Point, error) {
+	buff, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	p := g.Point()
+	return p, p.UnmarshalBinary(buff)
+}
+
+// Verify checks the genesis is consistent
+func (g *Genesis) Verify() error {
+	if g.ChainID == "" {
+		return errors.New("genesis: empty chain id")
+	}
+	if g.Roster == nil || len(g.Roster.List) != g.BeaconNb+g.BlockMakerNb+g.NotarizerNb {
+		return errors.New("genesis: roster does not match the roles")
+	}
+	if g.BeaconNb < 1 || g.BlockMakerNb < 1 || g.NotarizerNb < 1 {
+		return errors.New("genesis: needs at least one node of each role")
+	}
+	if g.Threshold < 1 || g.Threshold > g.NotarizerNb {
+		return fmt.Errorf("genesis: threshold %d out of range", g.Threshold)
+	}
+	if len(g.Public) != g.Threshold {
+		return fmt.Errorf("genesis: %d group public keys for a threshold of %d", len(g.Public), g.Threshold)
+	}
+	return nil
+}
+
+// Hash returns the hash in hexadecimal of the whole genesis
+func (g *Genesis) Hash() string {
+	hash := Suite.Hash()
+	var buff [8]byte
+	writeInt := func(i int64) {
+		binary.BigEndian.PutUint64(buff[:], uint64(i))
+		hash.Write(buff[:])
+	}
+	writeBytes := func(data []byte) {
+		writeInt(int64(len(data)))
+		hash.Write(data)
+	}
+	writeBytes([]byte(g.ChainID))
+	writeInt(g.Time.UnixNano())
+	writeInt(int64(g.BeaconNb))
+	writeInt(int64(g.BlockMakerNb))
+	writeInt(int64(g.NotarizerNb))
+	writeInt(int64(g.Threshold))
+	if g.Roster != nil {
+		for _, si := range g.Roster.List {
+			writeBytes([]byte(si.Address))
+			buff, _ := si.Public.MarshalBinary()
+			writeBytes(buff)
+		}
+	}
+	for _, p := range g.Public {
+		buff, _ := p.MarshalBinary()
+		writeBytes(buff)
+	}
+	writeBytes(g.AppState)
+	writeInt(g.BeaconSeed)
+	for _, s := range g.Stakes {
+		buff, _ := s.Public.MarshalBinary()
+		writeBytes(buff)
+		writeInt(int64(s.Amount))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Block returns the block of round 0. It references the hash of the genesis as
+// previous hash and carries the initial application state.
+func (g *Genesis) Block() *Block {
+	return &Block{
+		BlockHeader: BlockHeader{
+			ChainID:    g.ChainID,
+			Round:      0,
+			Owner:      -1,
+			Root:       rootHash(g.AppState),
+			Randomness: g.BeaconSeed,
+			PrvHash:    g.Hash(),
+		},
+		Blob: g.AppState,
+	}
+}
+
+// NotarizedBlock returns the block of round 0 notarized. The genesis is
+// trusted by every node so its notarization carries no signature.
+func (g *Genesis) NotarizedBlock() *NotarizedBlock {
+	b := g.Block()
+	return &NotarizedBlock{
+		Block: b,
+		Notarization: &Notarization{
+			Hash: b.BlockHeader.Hash(),
+		},
+	}
+}
+
+// Config returns the config of the node at the given index in the roster with
+// all the fields given by the genesis filled in.
+func (g *Genesis) Config(index int) *Config {
+	return &Config{
+		ChainID:      g.ChainID,
+		Seed:         g.BeaconSeed,
+		Roster:       g.Roster,
+		Index:        index,
+		N:            len(g.Roster.List),
+		BeaconNb:     g.BeaconNb,
+		BlockMakerNb: g.BlockMakerNb,
+		NotarizerNb:  g.NotarizerNb,
+		Public:       g.Public,
+		Threshold:    g.Threshold,
+		Stakes:       g.Stakes,
+		Genesis:      g,
+	}
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/util/random"
+)
+
+// testGenesisToml returns a genesis file with a node of every given role and the
+// keys of these nodes
+func testGenesisToml(threshold int, roles ...string) (string, []kyber.Point) {
+	_, public := dkg(threshold, threshold+1)
+	_, commits := public.Info()
+	hexOf := func(m interface{ MarshalBinary() ([]byte, error) }) string {
+		buff, _ := m.MarshalBinary()
+		return hex.EncodeToString(buff)
+	}
+	var group []string
+	for _, c := range commits {
+		group = append(group, `"`+hexOf(c)+`"`)
+	}
+	data := fmt.Sprintf(`ChainID = "genesis-test"
+GenesisTime = 2019-05-01T12:00:00Z
+Threshold = %d
+GroupPublic = [%s]
+AppState = "%s"
+BeaconSeed = 42
+`, threshold, strings.Join(group, ", "), hex.EncodeToString([]byte("state")))
+	var keys []kyber.Point
+	for i, role := range roles {
+		p := G2.Point().Pick(random.New())
+		keys = append(keys, p)
+		data += fmt.Sprintf(`[[Nodes]]
+Address = "tcp://127.0.0.1:%d"
+Public = "%s"
+Role = "%s"
+Stake = %d
+`, 7000+i, hexOf(p), role, i)
+	}
+	return data, keys
+}
+
+func TestParseGenesis(t *testing.T) {
+	data, keys := testGenesisToml(2, RoleNotarizer, RoleBlockMaker, RoleBeacon, RoleNotarizer, RoleBlockMaker)
+	g, err := ParseGenesis(data, G2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.ChainID != "genesis-test" || g.BeaconSeed != 42 || string(g.AppState) != "state" {
+		t.Fatal("genesis not parsed correctly")
+	}
+	if !g.Time.Equal(time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Fatal("wrong genesis time", g.Time)
+	}
+	if g.BeaconNb != 1 || g.BlockMakerNb != 2 || g.NotarizerNb != 2 || len(g.Public) != 2 {
+		t.Fatal("wrong roles")
+	}
+	// roster ordered by role, keeping the order of the file within a role
+	for i, k := range []int{2, 1, 4, 0, 3} {
+		if !g.Roster.List[i].Public.Equal(keys[k]) {
+			t.Fatal("wrong roster order at", i)
+		}
+	}
+	// the first node of the file has no stake
+	if len(g.Stakes) != 4 || g.Stakes.Of(g.Roster.List[0]) != 2 {
+		t.Fatal("wrong stakes")
+	}
+
+	invalid := map[string]string{
+		"no notarizer": "",
+		"unknown role": "leader",
+	}
+	for name, role := range invalid {
+		roles := []string{RoleBeacon, RoleBlockMaker}
+		if role != "" {
+			roles = append(roles, RoleNotarizer, RoleNotarizer, role)
+		}
+		data, _ := testGenesisToml(2, roles...)
+		if _, err := ParseGenesis(data, G2); err == nil {
+			t.Fatal(name, "accepted")
+		}
+	}
+	data, _ = testGenesisToml(2, RoleBeacon, RoleBlockMaker, RoleNotarizer)
+	if _, err := ParseGenesis(data, G2); err == nil {
+		t.Fatal("threshold above the number of notarizers accepted")
+	}
+	if _, err := ParseGenesis(`ChainID = "x"`+"\nAppState = \"zz\"", G2); err == nil {
+		t.Fatal("invalid application state accepted")
+	}
+}
+
+func TestGenesisVerify(t *testing.T) {
+	data, _ := testGenesisToml(2, RoleBeacon, RoleBlockMaker, RoleNotarizer, RoleNotarizer)
+	valid := func() *Genesis {
+		g, err := ParseGenesis(data, G2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	invalid := map[string]func(g *Genesis){
+		"chain id":        func(g *Genesis) { g.ChainID = "" },
+		"roster":          func(g *Genesis) { g.Roster = nil },
+		"role count":      func(g *Genesis) { g.BlockMakerNb++ },
+		"no beacon":       func(g *Genesis) { g.BeaconNb, g.BlockMakerNb = 0, 2 },
+		"no block maker":  func(g *Genesis) { g.BlockMakerNb, g.NotarizerNb = 0, 3 },
+		"zero threshold":  func(g *Genesis) { g.Threshold = 0 },
+		"high threshold":  func(g *Genesis) { g.Threshold = 3 },
+		"public key size": func(g *Genesis) { g.Public = g.Public[:1] },
+	}
+	for name, corrupt := range invalid {
+		g := valid()
+		corrupt(g)
+		if err := g.Verify(); err == nil {
+			t.Fatal(name, "accepted")
+		}
+	}
+}
+
+func TestGenesisHash(t *testing.T) {
+	g := &Genesis{
+		ChainID:      "dfinity-test",
+		Time:         time.Unix(1556712000, 0),
+		BeaconNb:     1,
+		BlockMakerNb: 2,
+		NotarizerNb:  3,
+		Threshold:    2,
+		AppState:     []byte("state"),
+		BeaconSeed:   42,
+	}
+	if h := g.Hash(); h != "223e2dbd67b5a182a7e422550993f9b40ac6d4396160224d0fcbec4883e0f1dd" {
+		t.Fatal("wrong genesis hash", h)
+	}
+	h := g.Hash()
+	g.BeaconSeed++
+	if g.Hash() == h {
+		t.Fatal("hash does not cover the beacon seed")
+	}
+	if g.Block().PrvHash != g.Hash() {
+		t.Fatal("block of round 0 does not reference the genesis")
+	}
+}
+
+func TestLoadGenesis(t *testing.T) {
+	dir, err := ioutil.TempDir("", "genesis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, _ := testGenesisToml(1, RoleBeacon, RoleBlockMaker, RoleNotarizer)
+	path := filepath.Join(dir, "genesis.toml")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := LoadGenesis(path, G2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := ParseGenesis(data, G2)
+	if g.Hash() != parsed.Hash() {
+		t.Fatal("loaded genesis differs from the parsed one")
+	}
+	if _, err := LoadGenesis(filepath.Join(dir, "missing.toml"), G2); err == nil {
+		t.Fatal("missing file accepted")
+	}
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+)
+
+// roundKey is a key of the notarizers, given by a copy of the config carrying
+// its share, public polynomial and threshold, along with its verifier. The
+// config is never modified once the key is created.
+type roundKey struct {
+	c          *Config
+	verifier   *sigVerifier
+	activation int // first round notarized with the key
+}
+
+// keyring holds the keys of the notarizers by activation round, so every round
+// gets signed and verified with the key of its epoch, even once the notarizers
+// moved on to a reshared key. The key of the previous epoch is kept for the
+// late messages of its rounds.
+type keyring struct {
+	sync.Mutex
+	keys  []*roundKey // increasing activation rounds
+	round int         // latest round reached by the notarizer
+}
+
+func newKeyring(c *Config, v *sigVerifier) *keyring {
+	return &keyring{keys: []*roundKey{{c: c, verifier: v}}}
+}
+
+// Add keeps the reshared key to use from its activation round on, along with
+// the new notarizers it was reshared to. Keys activated before the latest one
+// are dropped.
+func (k *keyring) Add(r *ReshareResult) {
+	k.Lock()
+	defer k.Unlock()
+	last := k.keys[len(k.keys)-1]
+	if r.Activation <= last.activation || r.Activation <= k.round {
+		return
+	}
+	c := *last.c
+	start := c.BeaconNb + c.BlockMakerNb
+	list := append([]*network.ServerIdentity{}, c.Roster.List[:start]...)
+	c.Roster = onet.NewRoster(append(list, r.Nodes...))
+	c.N = len(c.Roster.List)
+	c.NotarizerNb = len(r.Nodes)
+	c.Index = start + r.Share.I
+	c.Share = r.Share
+	c.Public = r.Public
+	c.Threshold = r.Threshold
+	k.keys = append(k.keys, &roundKey{c: &c, verifier: last.verifier.forKey(&c), activation: r.Activation})
+}
+
+// At returns the key the given round is notarized with
+func (k *keyring) At(round int) *roundKey {
+	k.Lock()
+	defer k.Unlock()
+	return k.at(round)
+}
+
+// Current returns the key of the latest round reached
+func (k *keyring) Current() *roundKey {
+	k.Lock()
+	defer k.Unlock()
+	return k.at(k.round)
+}
+
+// Activate records the notarizer reached the given round and returns its key.
+// Only the key of the previous epoch is kept among the ones not used anymore.
+func (k *keyring) Activate(round int) *roundKey {
+	k.Lock()
+	defer k.Unlock()
+	if round > k.round {
+		k.round = round
+	}
+	for len(k.keys) > 2 && k.keys[2].activation <= k.round {
+		k.keys[0] = nil
+		k.keys = k.keys[1:]
+	}
+	return k.at(round)
+}
+
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (k *keyring) at(round int) *roundKey {
+	for i := len(k.keys) - 1; i > 0; i-- {
+		if k.keys[i].activation <= round {
+			return k.keys[i]
+		}
+	}
+	return k.keys[0]
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber/sign/tbls"
+	"go.dedis.ch/kyber/util/random"
+)
+
+func TestKeyring(t *testing.T) {
+	var list []*network.ServerIdentity
+	for i := 0; i < 8; i++ {
+		addr := network.Address(fmt.Sprintf("tcp://127.0.0.1:%d", 7300+i))
+		list = append(list, network.NewServerIdentity(G2.Point().Pick(random.New()), addr))
+	}
+	shares, public := dkg(2, 3)
+	_, commits := public.Info()
+	c := &Config{Roster: onet.NewRoster(list[:5]), Index: 2, N: 5, BeaconNb: 1, BlockMakerNb: 1, NotarizerNb: 3,
+		Threshold: 2, Public: commits, Share: shares[0]}
+	v := newSigVerifier(c)
+	defer v.Close()
+	k := newKeyring(c, v)
+
+	next := func(activation int) *ReshareResult {
+		s, p := dkg(2, 3)
+		_, pub := p.Info()
+		return &ReshareResult{Activation: activation, Nodes: list[2:5], Threshold: 2, Public: pub, Share: s[0]}
+	}
+	k.Add(next(10))
+	k.Add(next(5)) // activated before the latest key
+	if k.Activate(9).c != c || k.Current().c != c {
+		t.Fatal("reshared key used before its activation")
+	}
+	first := k.At(10)
+	if first.c == c || first.c.Share == c.Share || c.Share != shares[0] {
+		t.Fatal("reshared key not kept apart from the config")
+	}
+	k.Add(next(20))
+	if k.Activate(20) != k.At(25) || k.At(15) != first {
+		t.Fatal("wrong key by round")
+	}
+	k.Add(next(30))
+	k.Activate(30)
+	if len(k.keys) != 2 || k.At(25).activation != 20 {
+		t.Fatal("keys of old epochs kept")
+	}
+	k.Add(next(30))
+	if len(k.keys) != 2 {
+		t.Fatal("key activated at a past round added")
+	}
+
+	// the key reshared to more notarizers takes their partials
+	s, p := dkg(3, 6)
+	_, pub := p.Info()
+	k.Add(&ReshareResult{Activation: 40, Nodes: list[2:], Threshold: 3, Public: pub, Share: s[1]})
+	key := k.At(40)
+	if key.c.NotarizerNb != 6 || key.c.N != 8 || !key.c.NotarizerNodes()[5].Equal(list[7]) || key.c.Index != 3 {
+		t.Fatal("notarizers of the reshared key not taken")
+	}
+	msg := []byte("block header hash")
+	sig, err := tbls.Sign(Suite, s[5], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.verifier.Verify(msg, sig); err != nil {
+		t.Fatal("partial of a new notarizer rejected:", err)
+	}
+	// and the one reshared to fewer notarizers rejects the indices left out
+	s, p = dkg(2, 2)
+	_, pub = p.Info()
+	k.Add(&ReshareResult{Activation: 50, Nodes: list[2:4], Threshold: 2, Public: pub, Share: s[0]})
+	if err := k.At(50).verifier.Verify(msg, sig); err == nil {
+		t.Fatal("partial of a notarizer left out accepted")
+	}
+}
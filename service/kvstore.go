@@ -0,0 +1,467 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// KVStoreName is the name under which the key-value store is registered
+const KVStoreName = "kv"
+
+func init() {
+	RegisterApplication(KVStoreName, func() Application { return NewKVStore() })
+}
+
+// Operations of the key-value store transactions
+const (
+	KVSet    byte = 1
+	KVDelete byte = 2
+)
+
+// KVTx is a transaction of the key-value store. The nonce only makes two
+// otherwise identical transactions different, replays are ignored.
+type KVTx struct {
+	Op    byte
+	Nonce uint64
+	Key   []byte
+	Value []byte
+}
+
+// Encode returns the binary representation of the transaction:
+// op (1) || nonce (8) || len(key) (4) || key || value
+func (t *KVTx) Encode() []byte {
+	buff := make([]byte, 13, 13+len(t.Key)+len(t.Value))
+	buff[0] = t.Op
+	binary.BigEndian.PutUint64(buff[1:9], t.Nonce)
+	binary.BigEndian.PutUint32(buff[9:13], uint32(len(t.Key)))
+	buff = append(buff, t.Key...)
+	return append(buff, t.Value...)
+}
+
+// DecodeKVTx decodes and checks a key-value store transaction
+func DecodeKVTx(buff []byte) (*KVTx, error) {
+	if len(buff) < 13 {
+		return nil, errors.New("kv: transaction too short")
+	}
+	t := &KVTx{
+		Op:    buff[0],
+		Nonce: binary.BigEndian.Uint64(buff[1:9]),
+	}
+	size := binary.BigEndian.Uint32(buff[9:13])
+	buff = buff[13:]
+	if uint64(len(buff)) < uint64(size) {
+		return nil, errors.New("kv: truncated key")
+	}
+	t.Key = buff[:size]
+	t.Value = buff[size:]
+	switch {
+	case len(t.Key) == 0:
+		return nil, errors.New("kv: empty key")
+	case t.Op == KVDelete && len(t.Value) > 0:
+		return nil, errors.New("kv: delete carries a value")
+	case t.Op != KVSet && t.Op != KVDelete:
+		return nil, errors.New("kv: unknown operation")
+	}
+	return t, nil
+}
+
+// KVStore is the reference application: a key-value store whose state is
+// committed in a Merkle tree over the keys in lexicographic order. Leaves are
+// H(0x00 || len(key) || key || value) and inner nodes H(0x01 || left || right);
+// the last node of an odd level is promoted as is.
+type KVStore struct {
+	sync.Mutex
+	// current state, modified by the delivered blocks
+	state map[string][]byte
+	// hashes of all executed transactions
+	seen map[string]bool
+	// round of the last delivered block
+	round int
+	// committed state: sorted keys, values and merkle tree levels
+	keys   []string
+	values [][]byte
+	levels [][][]byte
+	// round of the committed state
+	committed int
+}
+
+// NewKVStore returns an empty key-value store
+func NewKVStore() *KVStore {
+	return &KVStore{
+		state: make(map[string][]byte),
+		seen:  make(map[string]bool),
+	}
+}
+
+// InitChain loads the genesis state, a list of set transactions
+func (kv *KVStore) InitChain(state []byte) error {
+	kv.Lock()
+	defer kv.Unlock()
+	txs, err := DecodeTxs(state)
+	if err != nil {
+		return err
+	}
+	for _, buff := range txs {
+		tx, err := DecodeKVTx(buff)
+		if err != nil {
+			return err
+		}
+		kvExecute(kv.state, kv.seen, tx, buff)
+	}
+	kv.commit()
+	return nil
+}
+
+// CheckTx implements the Application interface
+func (kv *KVStore) CheckTx(buff []byte) error {
+	if _, err := DecodeKVTx(buff); err != nil {
+		return err
+	}
+	kv.Lock()
+	defer kv.Unlock()
+	if kv.seen[kvTxID(buff)] {
+		return errors.New("kv: transaction already executed")
+	}
+	return nil
+}
+
+// DeliverBlock implements the Application interface. Invalid transactions are
+// skipped.
+func (kv *KVStore) DeliverBlock(b *Block) error {
+	kv.Lock()
+	defer kv.Unlock()
+	kv.round = b.Round
+	return kvExecuteBlock(kv.state, kv.seen, b)
+}
+
+// Commit implements the Application interface
+func (kv *KVStore) Commit() ([]byte, error) {
+	kv.Lock()
+	defer kv.Unlock()
+	return kv.commit(), nil
+}
+
+// commit rebuilds the merkle tree out of the current state
+func (kv *KVStore) commit() []byte {
+	kv.keys = make([]string, 0, len(kv.state))
+	for k := range kv.state {
+		kv.keys = append(kv.keys, k)
+	}
+	sort.Strings(kv.keys)
+	kv.values = make([][]byte, len(kv.keys))
+	leaves := make([][]byte, len(kv.keys))
+	for i, k := range kv.keys {
+		kv.values[i] = kv.state[k]
+		leaves[i] = kvLeaf([]byte(k), kv.values[i])
+	}
+	kv.levels = kvLevels(leaves)
+	kv.committed = kv.round
+	return kvRootOf(kv.levels)
+}
+
+// Snapshot implements the Snapshotter interface. It holds the committed
+// entries, the executed transactions and the committed round.
+func (kv *KVStore) Snapshot() ([]byte, error) {
+	kv.Lock()
+	defer kv.Unlock()
+	entries := make([][]byte, len(kv.keys))
+	for i, k := range kv.keys {
+		entries[i] = (&KVTx{Op: KVSet, Key: []byte(k), Value: kv.values[i]}).Encode()
+	}
+	seen := make([][]byte, 0, len(kv.seen))
+	for id := range kv.seen {
+		seen = append(seen, []byte(id))
+	}
+	round := make([]byte, 8)
+	binary.BigEndian.PutUint64(round, uint64(kv.committed))
+	return EncodeTxs([][]byte{EncodeTxs(entries), EncodeTxs(seen), round}), nil
+}
+
+// Restore implements the Snapshotter interface
+func (kv *KVStore) Restore(snapshot []byte) error {
+	parts, err := DecodeTxs(snapshot)
+	if err != nil {
+		return err
+	}
+	if len(parts) != 3 || len(parts[2]) != 8 {
+		return errors.New("kv: invalid snapshot")
+	}
+	entries, err := DecodeTxs(parts[0])
+	if err != nil {
+		return err
+	}
+	seenIDs, err := DecodeTxs(parts[1])
+	if err != nil {
+		return err
+	}
+	state := make(map[string][]byte, len(entries))
+	for _, buff := range entries {
+		tx, err := DecodeKVTx(buff)
+		if err != nil {
+			return err
+		}
+		state[string(tx.Key)] = tx.Value
+	}
+	seen := make(map[string]bool, len(seenIDs))
+	for _, id := range seenIDs {
+		seen[string(id)] = true
+	}
+	kv.Lock()
+	defer kv.Unlock()
+	kv.state = state
+	kv.seen = seen
+	kv.round = int(binary.BigEndian.Uint64(parts[2]))
+	return nil
+}
+
+// SpeculateRoot implements the Speculator interface. It executes the blocks on
+// a copy of the current state.
+func (kv *KVStore) SpeculateRoot(blocks []*Block) ([]byte, error) {
+	kv.Lock()
+	state := make(map[string][]byte, len(kv.state))
+	for k, v := range kv.state {
+		state[k] = v
+	}
+	seen := make(map[string]bool, len(kv.seen))
+	for k := range kv.seen {
+		seen[k] = true
+	}
+	kv.Unlock()
+	for _, b := range blocks {
+		if err := kvExecuteBlock(state, seen, b); err != nil {
+			return nil, err
+		}
+	}
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	leaves := make([][]byte, len(keys))
+	for i, k := range keys {
+		leaves[i] = kvLeaf([]byte(k), state[k])
+	}
+	return kvRootOf(kvLevels(leaves)), nil
+}
+
+// Query returns the proof of presence or absence of the key in the committed
+// state, along with the state root and the round it corresponds to.
+func (kv *KVStore) Query(key []byte) (*KVProof, []byte, int) {
+	kv.Lock()
+	defer kv.Unlock()
+	i := sort.SearchStrings(kv.keys, string(key))
+	if i < len(kv.keys) && kv.keys[i] == string(key) {
+		return kv.proof(i), kvRootOf(kv.levels), kv.committed
+	}
+	p := &KVProof{Key: key, Size: len(kv.keys)}
+	if i > 0 {
+		p.Left = kv.proof(i - 1)
+	}
+	if i < len(kv.keys) {
+		p.Right = kv.proof(i)
+	}
+	return p, kvRootOf(kv.levels), kv.committed
+}
+
+// proof returns the inclusion proof of the i-th leaf
+func (kv *KVStore) proof(i int) *KVProof {
+	p := &KVProof{
+		Key:   []byte(kv.keys[i]),
+		Value: kv.values[i],
+		Found: true,
+		Index: i,
+		Size:  len(kv.keys),
+	}
+	idx := i
+	for _, level := range kv.levels[:len(kv.levels)-1] {
+		if sibling := idx ^ 1; sibling < len(level) {
+			p.Path = append(p.Path, level[sibling])
+		}
+		idx /= 2
+	}
+	return p
+}
+
+// KVProof proves the presence of a key with its value in the state, or its
+// absence through the proofs of the two neighbouring keys.
+type KVProof struct {
+	Key   []byte
+	Value []byte
+	Found bool
+	Index int      // position of the leaf
+	Size  int      // number of leaves in the tree
+	Path  [][]byte // sibling hashes from the leaf up to the root
+	// neighbours proving the absence of the key
+	Left  *KVProof
+	Right *KVProof
+}
+
+// VerifyKVProof checks the proof against the given state root
+func VerifyKVProof(root []byte, p *KVProof) error {
+	if p == nil {
+		return errors.New("kv: no proof")
+	}
+	if p.Found {
+		return p.verifyLeaf(root)
+	}
+	switch {
+	case p.Left == nil && p.Right == nil:
+		if p.Size != 0 || !bytes.Equal(root, kvRootOf(nil)) {
+			return errors.New("kv: absence proof without neighbours")
+		}
+		return nil
+	case p.Left == nil && p.Right.Index != 0:
+		return errors.New("kv: missing left neighbour")
+	case p.Right == nil && p.Left.Index != p.Left.Size-1:
+		return errors.New("kv: missing right neighbour")
+	case p.Left != nil && p.Right != nil && p.Left.Index+1 != p.Right.Index:
+		return errors.New("kv: neighbours are not adjacent")
+	}
+	if p.Left != nil {
+		if !p.Left.Found || bytes.Compare(p.Left.Key, p.Key) >= 0 {
+			return errors.New("kv: invalid left neighbour")
+		}
+		if err := p.Left.verifyLeaf(root); err != nil {
+			return err
+		}
+	}
+	if p.Right != nil {
+		if !p.Right.Found || bytes.Compare(p.Right.Key, p.Key) <= 0 {
+			return errors.New("kv: invalid right neighbour")
+		}
+		if err := p.Right.verifyLeaf(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *KVProof) verifyLeaf(root []byte) error {
+	if p.Index < 0 || p.Index >= p.Size {
+		return errors.New("kv: leaf index out of range")
+	}
+	h := kvLeaf(p.Key, p.Value)
+	idx, n, k := p.Index, p.Size, 0
+	for n > 1 {
+		if idx%2 == 1 || idx+1 < n {
+			if k >= len(p.Path) {
+				return errors.New("kv: proof path too short")
+			}
+			if idx%2 == 1 {
+				h = kvNode(p.Path[k], h)
+			} else {
+				h = kvNode(h, p.Path[k])
+			}
+			k++
+		}
+		idx /= 2
+		n = (n + 1) / 2
+	}
+	if k != len(p.Path) {
+		return errors.New("kv: proof path too long")
+	}
+	// the size is part of the root, a proof can't claim another one
+	if !bytes.Equal(kvSizedRoot(p.Size, h), root) {
+		return errors.New("kv: proof does not match the root")
+	}
+	return nil
+}
+
+// kvExecuteBlock applies all valid transactions of the block on the state
+func kvExecuteBlock(state map[string][]byte, seen map[string]bool, b *Block) error {
+	txs, err := DecodeTxs(b.Blob)
+	if err != nil {
+		return err
+	}
+	for _, buff := range txs {
+		tx, err := DecodeKVTx(buff)
+		if err != nil {
+			continue
+		}
+		kvExecute(state, seen, tx, buff)
+	}
+	return nil
+}
+
+func kvExecute(state map[string][]byte, seen map[string]bool, tx *KVTx, buff []byte) {
+	id := kvTxID(buff)
+	if seen[id] {
+		return
+	}
+	seen[id] = true
+	switch tx.Op {
+	case KVSet:
+		state[string(tx.Key)] = tx.Value
+	case KVDelete:
+		delete(state, string(tx.Key))
+	}
+}
+
+func kvTxID(buff []byte) string {
+	h := sha256.Sum256(buff)
+	return string(h[:])
+}
+
+func kvLeaf(key, value []byte) []byte {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(key)))
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(size[:])
+	h.Write(key)
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+func kvNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// kvLevels returns all the levels of the merkle tree, from the leaves up to
+// the root
+func kvLevels(leaves [][]byte) [][][]byte {
+	levels := [][][]byte{leaves}
+	for cur := leaves; len(cur) > 1; {
+		next := make([][]byte, 0, (len(cur)+1)/2)
+		for i := 0; i < len(cur); i += 2 {
+			if i+1 == len(cur) {
+				next = append(next, cur[i])
+			} else {
+				next = append(next, kvNode(cur[i], cur[i+1]))
+			}
+		}
+		levels = append(levels, next)
+		cur = next
+	}
+	return levels
+}
+
+// kvRootOf returns the root of the tree bound to its number of leaves. The
+// top of an empty tree is the hash of nothing.
+func kvRootOf(levels [][][]byte) []byte {
+	if len(levels) == 0 || len(levels[len(levels)-1]) == 0 {
+		h := sha256.Sum256(nil)
+		return kvSizedRoot(0, h[:])
+	}
+	return kvSizedRoot(len(levels[0]), levels[len(levels)-1][0])
+}
+
+// kvSizedRoot hashes the top of the tree with its number of leaves, so the
+// shape proofs are verified against can't be forged
+func kvSizedRoot(size int, top []byte) []byte {
+	var buff [8]byte
+	binary.BigEndian.PutUint64(buff[:], uint64(size))
+	h := sha256.New()
+	h.Write([]byte{2})
+	h.Write(buff[:])
+	h.Write(top)
+	return h.Sum(nil)
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestKVStore(t *testing.T) {
+	kv := NewKVStore()
+	if err := kv.InitChain(nil); err != nil {
+		t.Fatal(err)
+	}
+	var txs [][]byte
+	for i := 0; i < 7; i++ {
+		tx := &KVTx{Op: KVSet, Nonce: uint64(i), Key: []byte(fmt.Sprintf("key-%d", i*2)), Value: []byte{byte(i)}}
+		txs = append(txs, tx.Encode())
+	}
+	del := &KVTx{Op: KVDelete, Key: []byte("key-4")}
+	txs = append(txs, del.Encode())
+	block := &Block{BlockHeader: BlockHeader{Round: 1}, Blob: EncodeTxs(txs)}
+
+	speculated, err := kv.SpeculateRoot([]*Block{block})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.DeliverBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	root, err := kv.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, speculated) {
+		t.Fatal("speculated root differs from the committed one")
+	}
+	if err := kv.CheckTx(txs[0]); err == nil {
+		t.Fatal("replayed transaction accepted")
+	}
+
+	// presence
+	for _, i := range []int{0, 2, 6, 12} {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		proof, r, round := kv.Query(key)
+		if !proof.Found || round != 1 || !bytes.Equal(r, root) {
+			t.Fatal("key not found", string(key))
+		}
+		if err := VerifyKVProof(root, proof); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// absence, including the deleted key and keys outside of the range
+	for _, key := range []string{"key-4", "key-1", "a", "z"} {
+		proof, _, _ := kv.Query([]byte(key))
+		if proof.Found {
+			t.Fatal("key should be absent", key)
+		}
+		if err := VerifyKVProof(root, proof); err != nil {
+			t.Fatal(key, err)
+		}
+	}
+
+	// tampered proofs
+	proof, _, _ := kv.Query([]byte("key-2"))
+	proof.Value = []byte{42}
+	if VerifyKVProof(root, proof) == nil {
+		t.Fatal("tampered value accepted")
+	}
+	proof, _, _ = kv.Query([]byte("key-3"))
+	proof.Left = nil
+	if VerifyKVProof(root, proof) == nil {
+		t.Fatal("absence proof without left neighbour accepted")
+	}
+}
+
+func TestKVProofSize(t *testing.T) {
+	kv := NewKVStore()
+	var txs [][]byte
+	for _, key := range []string{"a", "b", "c"} {
+		tx := &KVTx{Op: KVSet, Key: []byte(key), Value: []byte(key)}
+		txs = append(txs, tx.Encode())
+	}
+	kv.DeliverBlock(&Block{BlockHeader: BlockHeader{Round: 1}, Blob: EncodeTxs(txs)})
+	root, _ := kv.Commit()
+
+	// the last of 3 leaves hashes up the same way as the second of 2 leaves
+	proof, _, _ := kv.Query([]byte("c"))
+	if err := VerifyKVProof(root, proof); err != nil {
+		t.Fatal(err)
+	}
+	proof.Index, proof.Size = 1, 2
+	if VerifyKVProof(root, proof) == nil {
+		t.Fatal("proof with a forged size accepted")
+	}
+}
+
+func TestKVStoreSnapshot(t *testing.T) {
+	kv := NewKVStore()
+	tx := &KVTx{Op: KVSet, Key: []byte("key"), Value: []byte("value")}
+	block := &Block{BlockHeader: BlockHeader{Round: 3}, Blob: EncodeTxs([][]byte{tx.Encode()})}
+	if err := kv.DeliverBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	root, _ := kv.Commit()
+	snapshot, err := kv.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewKVStore()
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	root2, _ := restored.Commit()
+	if !bytes.Equal(root, root2) {
+		t.Fatal("restored state root differs")
+	}
+	if _, _, round := restored.Query([]byte("key")); round != 3 {
+		t.Fatal("restored round is", round)
+	}
+	if err := restored.CheckTx(tx.Encode()); err == nil {
+		t.Fatal("transaction executed before the snapshot accepted again")
+	}
+	if err := restored.Restore([]byte{1, 2}); err == nil {
+		t.Fatal("invalid snapshot accepted")
+	}
+}
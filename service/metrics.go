@@ -0,0 +1,257 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/network"
+	"github.com/csanti/onet/simul/monitor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the consensus metrics of one node. All of them carry the
+// address of the node as label so several nodes can share the same process, as
+// in the localhost simulations.
+type Metrics struct {
+	// current round of the node
+	Round prometheus.Gauge
+	// round of the last finalized block
+	FinalizedHeight prometheus.Gauge
+	// time between the start of a round and its first notarized block
+	NotarizationLatency prometheus.Histogram
+	// partial signatures received by the notarizer
+	PartialSigs prometheus.Counter
+	// partial signatures that failed verification
+	InvalidSigs prometheus.Counter
+	// future messages buffered by the notarizer, by buffer
+	Buffered *prometheus.GaugeVec
+	// notarized blocks seen for each finalized round
+	Forks prometheus.Histogram
+	// bytes sent, by message type
+	BytesSent *prometheus.CounterVec
+	// time spent verifying signatures
+	VerifySeconds prometheus.Counter
+	// rounds reported stalled by the notarizer
+	Stalls prometheus.Counter
+	// bytes not sent thanks to proposals dropped by lower ranked makers
+	SavedBytes prometheus.Counter
+	// true when the metrics are exported, sizes of the messages are only
+	// computed in that case
+	enabled bool
+
+	// with monitor set, the messages, bytes and verification time since the
+	// last round are also recorded as onet monitor measures
+	sync.Mutex
+	monitor bool
+	msgs    map[string]int
+	bytes   map[string]int
+	verify  time.Duration
+}
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var metricsMut sync.Mutex
+
+// exported metrics mapped from the identity of their node, see nodeID
+var exportedMetrics = make(map[string]*Metrics)
+
+// addresses on which the metrics are already exported
+var metricsServers = make(map[string]bool)
+
+// metricsOf returns the metrics of the node the config belongs to. They are
+// kept in the config, so copies of it made on reconfigurations share them,
+// and registered and exported over HTTP once the config gives an address.
+func metricsOf(c *Config) *Metrics {
+	metricsMut.Lock()
+	defer metricsMut.Unlock()
+	if m := c.metrics; m != nil && (m.enabled || c.MetricsAddr == "") {
+		return m
+	}
+	id := nodeID(c)
+	if m, exists := exportedMetrics[id]; exists && c.MetricsAddr != "" {
+		// the node got a new config, its metrics are already exported
+		c.metrics = m
+		return m
+	}
+	m := newMetrics(c, id)
+	c.metrics = m
+	if c.MetricsAddr == "" {
+		return m
+	}
+	m.enabled = true
+	exportedMetrics[id] = m
+	metricsRegistry.MustRegister(m.Round, m.FinalizedHeight, m.NotarizationLatency,
+		m.PartialSigs, m.InvalidSigs, m.Buffered, m.Forks, m.BytesSent, m.VerifySeconds, m.Stalls, m.SavedBytes)
+	if !metricsServers[c.MetricsAddr] {
+		metricsServers[c.MetricsAddr] = true
+		go serveMetrics(c.MetricsAddr)
+	}
+	return m
+}
+
+// nodeID returns the address of the node the config belongs to, which tells
+// apart the nodes sharing a process. Without roster entry, it is its index.
+func nodeID(c *Config) string {
+	if c.Roster != nil && c.Index >= 0 && c.Index < len(c.Roster.List) {
+		return c.Roster.List[c.Index].Address.String()
+	}
+	return strconv.Itoa(c.Index)
+}
+
+// nodeFile returns the name of the files of the node the config belongs to,
+// node-<address> with the address made of letters, digits, dots and dashes
+// only, or node-<index> without roster entry. See nodeID.
+func nodeFile(c *Config) string {
+	return "node-" + strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' {
+			return r
+		}
+		return '-'
+	}, nodeID(c))
+}
+
+// newMetrics returns fresh metrics labelled with the given node identity
+func newMetrics(c *Config, id string) *Metrics {
+	labels := prometheus.Labels{"node": id}
+	opts := func(name, help string) prometheus.Opts {
+		return prometheus.Opts{Namespace: "dfinity", Name: name, Help: help, ConstLabels: labels}
+	}
+	return &Metrics{
+		Round:           prometheus.NewGauge(prometheus.GaugeOpts(opts("round", "Current round of the node."))),
+		FinalizedHeight: prometheus.NewGauge(prometheus.GaugeOpts(opts("finalized_height", "Round of the last finalized block."))),
+		NotarizationLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   "dfinity",
+			Name:        "notarization_latency_seconds",
+			Help:        "Time between the start of a round and its first notarized block.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.05, 2, 10),
+		}),
+		PartialSigs: prometheus.NewCounter(prometheus.CounterOpts(opts("partial_signatures_total", "Partial signatures received."))),
+		InvalidSigs: prometheus.NewCounter(prometheus.CounterOpts(opts("invalid_signatures_total", "Partial signatures failing verification."))),
+		Buffered: prometheus.NewGaugeVec(prometheus.GaugeOpts(opts("buffered_messages",
+			"Future messages buffered by the notarizer.")), []string{"buffer"}),
+		Forks: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   "dfinity",
+			Name:        "notarized_blocks_per_round",
+			Help:        "Notarized blocks seen for each finalized round.",
+			ConstLabels: labels,
+			Buckets:     prometheus.LinearBuckets(1, 1, 5),
+		}),
+		BytesSent: prometheus.NewCounterVec(prometheus.CounterOpts(opts("sent_bytes_total",
+			"Bytes sent by message type.")), []string{"type"}),
+		VerifySeconds: prometheus.NewCounter(prometheus.CounterOpts(opts("verify_seconds_total",
+			"Time spent verifying signatures."))),
+		Stalls: prometheus.NewCounter(prometheus.CounterOpts(opts("stalled_rounds_total",
+			"Rounds without notarized block after the round timeout."))),
+		SavedBytes: prometheus.NewCounter(prometheus.CounterOpts(opts("saved_bytes_total",
+			"Bytes of block proposals dropped because the round was already notarized."))),
+		monitor: c.Monitor,
+		msgs:    make(map[string]int),
+		bytes:   make(map[string]int),
+	}
+}
+
+// serveMetrics exports all the registered metrics on /metrics
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	log.Lvl1("metrics exported on", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error("metrics: can't serve on", addr, ":", err)
+	}
+}
+
+// Sent accounts for the size of the message sent to n nodes
+func (m *Metrics) Sent(msg interface{}, n int) {
+	if !(m.enabled || m.monitor) || n == 0 {
+		return
+	}
+	buff, err := network.Marshal(msg)
+	if err != nil {
+		return
+	}
+	typ := messageType(msg)
+	m.BytesSent.WithLabelValues(typ).Add(float64(len(buff) * n))
+	if m.monitor {
+		m.Lock()
+		m.msgs[typ] += n
+		m.bytes[typ] += len(buff) * n
+		m.Unlock()
+	}
+}
+
+// Saved accounts for the size of a message that did not need to be sent to n
+// nodes
+func (m *Metrics) Saved(msg interface{}, n int) {
+	if !(m.enabled || m.monitor) || n == 0 {
+		return
+	}
+	buff, err := network.Marshal(msg)
+	if err != nil {
+		return
+	}
+	saved := len(buff) * n
+	m.SavedBytes.Add(float64(saved))
+	m.Record("saved_bytes", float64(saved))
+}
+
+// Verified accounts for time spent verifying signatures
+func (m *Metrics) Verified(d time.Duration) {
+	m.VerifySeconds.Add(d.Seconds())
+	if m.monitor {
+		m.Lock()
+		m.verify += d
+		m.Unlock()
+	}
+}
+
+// Record records the measure on the onet monitor if enabled
+func (m *Metrics) Record(name string, value float64) {
+	if m.monitor {
+		monitor.RecordSingleMeasure(name, value)
+	}
+}
+
+// FlushRound records the messages, bytes and verification time accumulated
+// since the last call on the onet monitor. It is called once per round.
+func (m *Metrics) FlushRound() {
+	if !m.monitor {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	for typ, n := range m.msgs {
+		monitor.RecordSingleMeasure("msgs_"+typ, float64(n))
+		monitor.RecordSingleMeasure("bytes_"+typ, float64(m.bytes[typ]))
+	}
+	monitor.RecordSingleMeasure("verify_cpu", m.verify.Seconds()*1000)
+	m.msgs = make(map[string]int)
+	m.bytes = make(map[string]int)
+	m.verify = 0
+}
+
+func messageType(msg interface{}) string {
+	switch msg.(type) {
+	case *BeaconPacket:
+		return "beacon"
+	case *BlockProposal:
+		return "block_proposal"
+	case *SignatureProposal:
+		return "signature_proposal"
+	case *NotarizedBlock:
+		return "notarized_block"
+	case *Transaction:
+		return "transaction"
+	case *SkipProposal:
+		return "skip_proposal"
+	case *SkipCertificate:
+		return "skip_certificate"
+	}
+	return "other"
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber/util/random"
+)
+
+func TestMetricsOf(t *testing.T) {
+	var list []*network.ServerIdentity
+	for _, addr := range []string{"tcp://127.0.0.1:7770", "tcp://127.0.0.1:7772"} {
+		list = append(list, network.NewServerIdentity(G2.Point().Pick(random.New()), network.Address(addr)))
+	}
+	roster := onet.NewRoster(list)
+
+	// nodes of the same process with the same index keep their own metrics
+	c1 := &Config{Roster: roster, Index: 1}
+	m1 := metricsOf(c1)
+	if metricsOf(&Config{Roster: roster, Index: 1}) == m1 {
+		t.Fatal("metrics shared between configs")
+	}
+	if metricsOf(c1) != m1 {
+		t.Fatal("metrics of the config not kept")
+	}
+	// copies made on reconfiguration carry them over, whatever the index
+	c2 := *c1
+	c2.Index = 0
+	if metricsOf(&c2) != m1 {
+		t.Fatal("metrics lost on reconfiguration")
+	}
+	if m1.enabled {
+		t.Fatal("metrics exported without address")
+	}
+
+	// a later config can still export the metrics
+	c3 := *c1
+	c3.MetricsAddr = "127.0.0.1:0"
+	m3 := metricsOf(&c3)
+	if !m3.enabled {
+		t.Fatal("metrics not exported")
+	}
+	// and a new config of the same node exports the same ones again
+	if metricsOf(&Config{Roster: roster, Index: 1, MetricsAddr: "127.0.0.1:0"}) != m3 {
+		t.Fatal("metrics of the node registered twice")
+	}
+	c4 := &Config{Roster: roster, Index: 0, MetricsAddr: "127.0.0.1:0"}
+	if metricsOf(c4) == m3 {
+		t.Fatal("metrics shared between nodes")
+	}
+
+	if id := nodeID(&Config{Roster: roster, Index: 5}); id != "5" {
+		t.Fatal("wrong identity for a node out of the roster:", id)
+	}
+}
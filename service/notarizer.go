@@ -32,16 +32,38 @@ type Notarizer struct {
 	// future blocks
 	tmpBlocks map[int][]*BlockProposal
 	// future notarized blocks
-	tmpNot    map[int][]*NotarizedBlock
-	broadcast BroadcastFn
+	tmpNot map[int][]*NotarizedBlock
+	// future skip signatures and certificates
+	tmpSkips     map[int][]*SkipProposal
+	tmpSkipCerts map[int]*SkipCertificate
+	broadcast    BroadcastFn
+	// verifier of the partial signatures of the genesis key, whose workers
+	// the verifiers of the reshared keys run on
+	verifier *sigVerifier
+	// keys of the notarizers, the reshared ones waiting for their activation
+	keys    *keyring
+	metrics *Metrics
+	tracer  *Tracer
+	// called at the first round of every epoch, if set
+	epoch func(round int)
+	// true once the notarizer got replaced after a reconfiguration
+	stopped bool
 }
 
 // NewMultiChain returns a fresh multi chain
 func NewNotarizerProcess(c *onet.Context, conf *Config, b BroadcastFn) *Notarizer {
-	chain := new(Chain)
+	return newNotarizer(c, conf, b, nil)
+}
+
+// newNotarizer returns a notarizer going on with the given finalizer, or a
+// fresh one if nil
+func newNotarizer(c *onet.Context, conf *Config, b BroadcastFn, fin *Finalizer) *Notarizer {
+	if fin == nil {
+		fin = NewFinalizer(conf, NewChain(conf), nil)
+	}
 	n := &Notarizer{
 		ServiceProcessor: onet.NewServiceProcessor(c),
-		chain:            chain,
+		chain:            fin.chain,
 		c:                conf,
 		Cond:             sync.NewCond(new(sync.Mutex)),
 		rounds:           make(map[int]*roundStorage),
@@ -49,33 +71,111 @@ func NewNotarizerProcess(c *onet.Context, conf *Config, b BroadcastFn) *Notarize
 		tmpBlocks:        make(map[int][]*BlockProposal),
 		tmpSigs:          make(map[int][]*SignatureProposal),
 		tmpNot:           make(map[int][]*NotarizedBlock),
+		tmpSkips:         make(map[int][]*SkipProposal),
+		tmpSkipCerts:     make(map[int]*SkipCertificate),
 		broadcast:        b,
+		verifier:         newSigVerifier(conf),
+		metrics:          metricsOf(conf),
+		tracer:           tracerOf(conf),
 	}
-	n.finalizer = NewFinalizer(conf, chain, n.deleteRound)
+	n.finalizer = fin
+	n.keys = newKeyring(conf, n.verifier)
+	fin.Reconfigure(conf, n.deleteRound)
 	return n
 }
 
-// Process process incoming network packets
+// Stop makes the round loops return and ignores any further round
+func (m *Notarizer) Stop() {
+	m.Cond.L.Lock()
+	defer m.Cond.L.Unlock()
+	m.stopped = true
+	m.rounds = make(map[int]*roundStorage)
+	m.tmpBeacon = make(map[int]*BeaconPacket)
+	m.verifier.Close()
+	m.Cond.Broadcast()
+}
+
+// locked runs fn under the notarizer lock and wakes up the round loops
+func (m *Notarizer) locked(fn func()) {
+	m.Cond.L.Lock()
+	defer m.Cond.L.Unlock()
+	defer m.Cond.Broadcast()
+	fn()
+}
+
+// Process process incoming network packets. Unless optimistic verification is
+// enabled, partial signatures are first verified on the worker pool, outside of
+// the notarizer lock, and dropped if invalid.
 func (m *Notarizer) Process(e *network.Envelope) {
+	var msg, partial []byte
+	var round int
+	switch inner := e.Msg.(type) {
+	case *SignatureProposal:
+		m.metrics.PartialSigs.Inc()
+		msg, partial, round = inner.BlockHeader.SigningMessage(), inner.Partial, inner.BlockHeader.Round
+	case *SkipProposal:
+		msg, partial, round = SkipMessage(inner.ChainID, inner.Round), inner.Partial, inner.Round
+	}
+	if partial != nil && !m.c.OptimisticVerify {
+		m.keys.At(round).verifier.Submit(msg, partial, func(err error) {
+			if err != nil {
+				log.Lvl2("notarizer: invalid partial signature:", err)
+				return
+			}
+			m.process(e)
+		})
+		return
+	}
+	m.process(e)
+}
+
+func (m *Notarizer) process(e *network.Envelope) {
 	m.Cond.L.Lock()
 	defer m.Cond.L.Unlock()
 	defer m.Cond.Broadcast()
 	switch inner := e.Msg.(type) {
 	case *BeaconPacket:
+		m.tracer.Event(EventBeaconReceived, inner.Round, "")
 		m.NewRound(inner)
 	case *BlockProposal:
+		m.tracer.Event(EventProposalReceived, inner.Round, inner.BlockHeader.Hash())
 		m.NewBlockProposal(inner)
 	case *SignatureProposal:
 		m.NewSignatureProposal(inner)
 	case *NotarizedBlock:
+		m.tracer.Event(EventNotarizedReceived, inner.Round, inner.BlockHeader.Hash())
 		m.NewNotarizedBlock(inner)
+	case *SkipProposal:
+		m.NewSkipProposal(inner)
+	case *SkipCertificate:
+		m.NewSkipCertificate(inner)
 	}
+	m.updateBuffered()
+}
+
+// updateBuffered reports the number of future messages held by the notarizer
+func (m *Notarizer) updateBuffered() {
+	var sigs, blocks, nots int
+	for _, s := range m.tmpSigs {
+		sigs += len(s)
+	}
+	for _, b := range m.tmpBlocks {
+		blocks += len(b)
+	}
+	for _, n := range m.tmpNot {
+		nots += len(n)
+	}
+	m.metrics.Buffered.WithLabelValues("signatures").Set(float64(sigs))
+	m.metrics.Buffered.WithLabelValues("blocks").Set(float64(blocks))
+	m.metrics.Buffered.WithLabelValues("notarized").Set(float64(nots))
+	m.metrics.Buffered.WithLabelValues("beacon").Set(float64(len(m.tmpBeacon)))
+	m.metrics.Buffered.WithLabelValues("skips").Set(float64(len(m.tmpSkips) + len(m.tmpSkipCerts)))
 }
 
 // NewRound starts a new notarization round
 // it increase the round number and create the corresponding round storage.
 func (m *Notarizer) NewRound(b *BeaconPacket) {
-	if b.Round <= m.round {
+	if m.stopped || b.Round <= m.round {
 		// forget about previous or current beacon
 		return
 	}
@@ -85,10 +185,46 @@ func (m *Notarizer) NewRound(b *BeaconPacket) {
 		return
 	}
 	m.round++
-	m.rounds[m.round] = newRoundStorage(m.c, m.round, b.Randomness, m.finalizer)
+	m.metrics.Round.Set(float64(m.round))
+	key := m.keys.Activate(m.round)
+	if key.activation == m.round && m.round > 0 {
+		log.Lvl1("notarizer: using reshared key from round", m.round)
+	}
+	if m.epoch != nil && m.c.ReshareEpoch > 0 && m.round%m.c.ReshareEpoch == 0 {
+		go m.epoch(m.round)
+	}
+	m.rounds[m.round] = newRoundStorage(key.c, m.round, b.Randomness, m.finalizer, key.verifier)
+	m.rounds[m.round].locked = m.locked
 	go m.roundLoop(b.Round)
 }
 
+// SetNextKey keeps the reshared key of this notarizer to use from its
+// activation round on. The rounds before keep the key of their epoch.
+func (m *Notarizer) SetNextKey(k *ReshareResult) {
+	m.keys.Add(k)
+}
+
+// Resume moves the notarizer to the highest round of its finalizer after it
+// synced from a checkpoint, so it takes part in the next round
+func (m *Notarizer) Resume() {
+	m.Cond.L.Lock()
+	defer m.Cond.L.Unlock()
+	defer m.Cond.Broadcast()
+	if round := m.finalizer.HighestRound(); round > m.round {
+		m.round = round
+	}
+	for r := range m.tmpBeacon {
+		if r <= m.round {
+			delete(m.tmpBeacon, r)
+		}
+	}
+	if b, exists := m.tmpBeacon[m.round+1]; exists {
+		delete(m.tmpBeacon, m.round+1)
+		m.NewRound(b)
+	}
+	log.Lvl1("notarizer: resuming at round", m.round+1)
+}
+
 func (m *Notarizer) roundLoop(round int) {
 	// at the end always see if we can directly go to next step
 	defer func() {
@@ -98,7 +234,7 @@ func (m *Notarizer) roundLoop(round int) {
 		delete(m.tmpBeacon, round+1)
 	}()
 	// sleep the finalization time
-	time.Sleep(time.Duration(m.c.BlockTime) * time.Millisecond)
+	time.Sleep(m.c.BlockTime)
 	//log.Lvl1("notarizer enters round loop for round ", round)
 	// test if things look correct
 	m.Cond.L.Lock()
@@ -108,9 +244,33 @@ func (m *Notarizer) roundLoop(round int) {
 		panic("that should never happen")
 	}
 
+	// wake up each time a lower rank becomes eligible for signing, and when
+	// the round times out
+	var timers []*time.Timer
+	defer func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}()
+	if m.c.RankDelay > 0 {
+		for k := 1; k < m.c.BlockMakerNb; k++ {
+			d := m.c.BlockTime + time.Duration(k)*m.c.RankDelay
+			timers = append(timers, time.AfterFunc(time.Until(roundStorage.start.Add(d)), m.wakeUp))
+		}
+	}
+	var stalled, skipDue bool
+	if m.c.RoundTimeout > 0 {
+		timers = append(timers, time.AfterFunc(time.Until(roundStorage.start.Add(m.c.RoundTimeout)), m.raise(&stalled)))
+	}
+	if m.c.SkipTimeout > 0 {
+		timers = append(timers, time.AfterFunc(time.Until(roundStorage.start.Add(m.c.SkipTimeout)), m.raise(&skipDue)))
+	}
+
 	var sigProposal *SignatureProposal
+	var skipSent bool
 	// condition returns whether we should wait or quit the loop
 	var condition = func() (bool, bool) {
+		sigProposal = nil
 		roundStorage, exists = m.rounds[round]
 		if !exists {
 			// we don't have the storage anymore
@@ -144,31 +304,70 @@ func (m *Notarizer) roundLoop(round int) {
 			// round
 			return true, true
 		}
+		for _, skip := range m.tmpSkips[round] {
+			roundStorage.StoreSkipProposal(skip)
+		}
+		if cert, exists := m.tmpSkipCerts[round]; exists {
+			roundStorage.StoreSkipCertificate(cert)
+		}
+		if roundStorage.IsSkipped() {
+			return true, true
+		}
+		if skipDue && !skipSent && roundStorage.CanSkip() {
+			return true, false
+		}
 		sigProposal = roundStorage.HighestSignature()
 		//log.Lvl1("not. roundloop sigProposal?: ", sigProposal != nil)
 		//log.Lvl1("not. round storage: ", roundStorage.blocks)
 		return sigProposal != nil, false
 	}
 
+	var partialSent, stallReported bool
 	for {
 		var dataFound, mustQuit bool
 		for {
 			dataFound, mustQuit = condition()
-			if !dataFound {
-				//log.Lvl1("notarizer: waiting on new inputs...")
-				m.Cond.Wait()
-			} else {
+			if dataFound {
 				break
 			}
+			if mustQuit {
+				return
+			}
+			if stalled && !stallReported {
+				// keep waiting, a late block or skip certificate still
+				// ends the round
+				stallReported = true
+				m.reportStall(round)
+			}
+			//log.Lvl1("notarizer: waiting on new inputs...")
+			m.Cond.Wait()
 		}
 
 		if notarized := roundStorage.HighestNotarizedBlock(); notarized != nil {
 			// a block is notarized ! quit notarizing for this round
 			log.Lvl1("notarizer broadcasting notarized block round", notarized.Block.Round, ":", notarized.BlockHeader.Hash())
+			latency := time.Since(roundStorage.start)
+			m.metrics.NotarizationLatency.Observe(latency.Seconds())
+			m.metrics.Record("beacon_to_notarization", float64(latency.Nanoseconds())/1e6)
 			go m.broadcast(m.c.Roster.List, notarized)
 			return
 		}
 
+		if roundStorage.IsSkipped() {
+			log.Lvl1("notarizer broadcasting skip certificate of round", round)
+			m.metrics.Record("skipped_round", float64(round))
+			m.tracer.Event(EventRoundSkipped, round, "")
+			go m.broadcast(m.c.Roster.List, roundStorage.skipped)
+			return
+		}
+
+		if skipDue && !skipSent && roundStorage.CanSkip() {
+			// no block got notarized in time, vote to skip the round
+			skipSent = true
+			go m.broadcast(m.c.NotarizerNodes(), roundStorage.SkipProposal())
+			continue
+		}
+
 		if sigProposal == nil {
 			panic("that should never happen")
 		}
@@ -176,6 +375,10 @@ func (m *Notarizer) roundLoop(round int) {
 		//log.Lvl1("notarizer broadcasted sig proposal for ", sigProposal.BlockHeader.Hash())
 		// broadcast the signature
 		go m.broadcast(m.c.NotarizerNodes(), sigProposal)
+		if !partialSent {
+			partialSent = true
+			m.tracer.Event(EventFirstPartialSent, round, sigProposal.BlockHeader.Hash())
+		}
 		if mustQuit {
 			//log.Lvl1("notarizer quit round loop at the end for round", round)
 			return
@@ -183,18 +386,76 @@ func (m *Notarizer) roundLoop(round int) {
 	}
 }
 
-// deleteRound deletes the round storage for the given round. This round number
-// is given from the finalizer. It means the notarizer still can receive
-// notarized block after seeing the first one of a round, but after the
-// finalization routine finished, it stops receiveing new ones.
+// raise returns a function setting the flag and waking up the round loops
+func (m *Notarizer) raise(flag *bool) func() {
+	return func() {
+		m.Cond.L.Lock()
+		defer m.Cond.L.Unlock()
+		*flag = true
+		m.Cond.Broadcast()
+	}
+}
+
+// wakeUp wakes up the round loops waiting on new inputs
+func (m *Notarizer) wakeUp() {
+	m.Cond.L.Lock()
+	defer m.Cond.L.Unlock()
+	m.Cond.Broadcast()
+}
+
+// reportStall reports a round that got no notarized block before the round
+// timeout
+func (m *Notarizer) reportStall(round int) {
+	log.Error("notarizer: round", round, "stalled, no notarized block after", m.c.RoundTimeout)
+	m.metrics.Stalls.Inc()
+	m.metrics.Record("round_stall", float64(round))
+	m.tracer.Event(EventRoundStalled, round, "")
+}
+
+// deleteRound deletes the round storage for the given round and everything
+// buffered for it or for earlier rounds. This round number is given from the
+// finalizer. It means the notarizer still can receive notarized block after
+// seeing the first one of a round, but after the finalization routine
+// finished, it stops receiveing new ones.
 func (n *Notarizer) deleteRound(round int) {
 	n.Cond.L.Lock()
 	defer n.Cond.L.Unlock()
-	delete(n.rounds, round)
-	delete(n.tmpBeacon, round)
-	delete(n.tmpSigs, round)
-	delete(n.tmpBlocks, round)
-	delete(n.rounds, round)
+	for r := range n.rounds {
+		if r <= round {
+			delete(n.rounds, r)
+		}
+	}
+	for r := range n.tmpBeacon {
+		if r <= round {
+			delete(n.tmpBeacon, r)
+		}
+	}
+	for r := range n.tmpSigs {
+		if r <= round {
+			delete(n.tmpSigs, r)
+		}
+	}
+	for r := range n.tmpBlocks {
+		if r <= round {
+			delete(n.tmpBlocks, r)
+		}
+	}
+	for r := range n.tmpNot {
+		if r <= round {
+			delete(n.tmpNot, r)
+		}
+	}
+	for r := range n.tmpSkips {
+		if r <= round {
+			delete(n.tmpSkips, r)
+		}
+	}
+	for r := range n.tmpSkipCerts {
+		if r <= round {
+			delete(n.tmpSkipCerts, r)
+		}
+	}
+	n.updateBuffered()
 }
 
 // NewBlockProposal stores the blockproposal internally and broadcasts a
@@ -204,6 +465,10 @@ func (m *Notarizer) NewBlockProposal(p *BlockProposal) {
 		log.Lvl2("received too old block ")
 		return
 	}
+	if p.ChainID != m.c.ChainID {
+		log.Lvl2("received block for another chain", p.ChainID)
+		return
+	}
 	round, exists := m.rounds[p.Round]
 	if !exists {
 		m.tmpBlocks[p.Round] = append(m.tmpBlocks[p.Round], p)
@@ -217,6 +482,10 @@ func (m *Notarizer) NewBlockProposal(p *BlockProposal) {
 // referenced gets enough signature the final signature gets reconstructed and
 // the notarizer broadcasts the notarizedblock.
 func (m *Notarizer) NewSignatureProposal(s *SignatureProposal) {
+	if s.ChainID != m.c.ChainID {
+		log.Lvl2("received signature for another chain", s.ChainID)
+		return
+	}
 	if s.Round > m.round {
 		log.Lvl2("received future signature proposal -> storing temporarily")
 		m.tmpSigs[s.Round] = append(m.tmpSigs[s.Round], s)
@@ -251,3 +520,38 @@ func (m *Notarizer) NewNotarizedBlock(n *NotarizedBlock) {
 	}
 	round.StoreNotarizedBlock(n)
 }
+
+// NewSkipProposal stores a partial signature to skip a round. If the round
+// gets enough of them, its skip certificate gets recovered.
+func (m *Notarizer) NewSkipProposal(s *SkipProposal) {
+	if s.ChainID != m.c.ChainID || s.Round < m.round {
+		return
+	}
+	round, exists := m.rounds[s.Round]
+	if !exists {
+		m.tmpSkips[s.Round] = append(m.tmpSkips[s.Round], s)
+		return
+	}
+	round.StoreSkipProposal(s)
+}
+
+// NewSkipCertificate marks the round as skipped if the certificate verifies
+// against the group key
+func (m *Notarizer) NewSkipCertificate(s *SkipCertificate) {
+	if s.ChainID != m.c.ChainID {
+		return
+	}
+	if err := m.keys.At(s.Round).verifier.VerifyThreshold(SkipMessage(s.ChainID, s.Round), s.Signature); err != nil {
+		log.Lvl2("notarizer: invalid skip certificate for round", s.Round, ":", err)
+		return
+	}
+	round, exists := m.rounds[s.Round]
+	switch {
+	case exists:
+		round.StoreSkipCertificate(s)
+	case s.Round > m.round:
+		m.tmpSkipCerts[s.Round] = s
+	default:
+		m.finalizer.StoreSkip(s)
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -12,22 +13,42 @@ var BlockProposalType network.MessageTypeID
 var NotarizedBlockType network.MessageTypeID
 var SignatureProposalType network.MessageTypeID
 var BeaconType network.MessageTypeID
+var TransactionType network.MessageTypeID
+var SkipProposalType network.MessageTypeID
+var SkipCertificateType network.MessageTypeID
 
 func init() {
 	BlockProposalType = network.RegisterMessage(&BlockProposal{})
 	NotarizedBlockType = network.RegisterMessage(&NotarizedBlock{})
 	SignatureProposalType = network.RegisterMessage(&SignatureProposal{})
 	BeaconType = network.RegisterMessage(&BeaconPacket{})
+	TransactionType = network.RegisterMessage(&Transaction{})
+	SkipProposalType = network.RegisterMessage(&SkipProposal{})
+	SkipCertificateType = network.RegisterMessage(&SkipCertificate{})
 }
 
+// HeaderVersion is the version of the canonical header encoding. It must be
+// increased whenever the encoding changes.
+const HeaderVersion uint16 = 2
+
+// HeaderDomain is the domain separation tag prepended to every encoded header
+// so its hash and signatures can't be mistaken for other messages.
+const HeaderDomain = "dfinity-block-header"
+
+// SkipDomain is the domain separation tag of the message signed to skip a
+// round
+const SkipDomain = "dfinity-skip-round"
+
 // BlockHeader represents all the information regarding a block
 type BlockHeader struct {
+	ChainID    string // identifier of the chain this block belongs to
 	Round      int    // round of the block
 	Owner      int    // index of the owner of the block
 	Root       string // hash of the data
 	Randomness int64  // randomness of the round
 	PrvHash    string // hash of the previous block
 	PrvSig     []byte // signature of the previous block (i.e. notarization)
+	StateRoot  []byte // application state root after the previous block
 }
 
 // Block represents how a block is stored locally
@@ -64,34 +85,93 @@ type BeaconPacket struct {
 	Randomness int64
 }
 
-// Hash returns the hash in hexadecimal of the header
+// Transaction is sent to the block makers to be included in a future block
+type Transaction struct {
+	Tx []byte
+}
+
+// SkipProposal is the partial signature of a notarizer agreeing to skip a
+// round for which it had no block to sign before the skip timeout
+type SkipProposal struct {
+	ChainID string
+	Round   int
+	Partial []byte
+}
+
+// SkipCertificate is the threshold signature of the notarizers over the skip of
+// a round. A round with a skip certificate and no notarized block is empty: the
+// blocks of the next round build on the last notarized block before it. If a
+// block of the round still gets notarized, that block wins.
+type SkipCertificate struct {
+	ChainID   string
+	Round     int
+	Signature []byte
+}
+
+// SkipMessage returns the message signed by the notarizers to skip the round:
+//
+//	domain tag || chain id || round (8)
+func SkipMessage(chainID string, round int) []byte {
+	var b bytes.Buffer
+	var buff [8]byte
+	b.WriteString(SkipDomain)
+	binary.BigEndian.PutUint32(buff[:4], uint32(len(chainID)))
+	b.Write(buff[:4])
+	b.WriteString(chainID)
+	binary.BigEndian.PutUint64(buff[:], uint64(round))
+	b.Write(buff[:])
+	return b.Bytes()
+}
+
+// Hash returns the hash in hexadecimal of the canonical encoding of the header
 func (h *BlockHeader) Hash() string {
 	hash := Suite.Hash()
-	binary.Write(hash, binary.BigEndian, h.Owner)
-	binary.Write(hash, binary.BigEndian, h.Round)
-	hash.Write([]byte(h.PrvHash))
-	hash.Write([]byte(h.Root))
-	hash.Write(h.PrvSig)
+	hash.Write(h.MarshalCanonical())
 	buff := hash.Sum(nil)
 	return hex.EncodeToString(buff)
 }
 
+// SigningMessage returns the message notarizers sign for this header, i.e.
+// its canonical encoding.
+func (h *BlockHeader) SigningMessage() []byte {
+	return h.MarshalCanonical()
+}
+
+// MarshalCanonical returns the canonical encoding of the header. All integers
+// are fixed-width big endian and variable length fields are prefixed by their
+// length on 4 bytes:
+//
+//	domain tag || version (2) || chain id || round (8) || owner (8) ||
+//	randomness (8) || root || previous hash || previous signature ||
+//	state root
+func (h *BlockHeader) MarshalCanonical() []byte {
+	var b bytes.Buffer
+	var buff [8]byte
+	writeBytes := func(data []byte) {
+		binary.BigEndian.PutUint32(buff[:4], uint32(len(data)))
+		b.Write(buff[:4])
+		b.Write(data)
+	}
+	writeInt := func(i int64) {
+		binary.BigEndian.PutUint64(buff[:], uint64(i))
+		b.Write(buff[:])
+	}
+	b.WriteString(HeaderDomain)
+	binary.BigEndian.PutUint16(buff[:2], HeaderVersion)
+	b.Write(buff[:2])
+	writeBytes([]byte(h.ChainID))
+	writeInt(int64(h.Round))
+	writeInt(int64(h.Owner))
+	writeInt(h.Randomness)
+	writeBytes([]byte(h.Root))
+	writeBytes([]byte(h.PrvHash))
+	writeBytes(h.PrvSig)
+	writeBytes(h.StateRoot)
+	return b.Bytes()
+}
+
 func rootHash(data []byte) string {
 	h := sha256.New()
 	h.Write(data)
 	return hex.EncodeToString(h.Sum(nil))
 }
-
-// GenesisBlock is the first block of the chain
-var GenesisBlock = &Block{
-	BlockHeader: BlockHeader{
-		Round: 0,
-		Owner: -1,
-		Root:  "6afbc27f4ae8951a541be53038ca20d3a9f18f60a38b1dc2cd48a46ff5d26ace",
-		// sha256("hello world")
-		PrvHash: "a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447",
-		// echo "hello world" | sha256sum | sha256sum
-		PrvSig: []byte("3605ff73b6faec27aa78e311603e9fe2ef35bad82ccf46fc707814bfbdcc6f9e"),
-	},
-	Blob: []byte("Hello Genesis"),
-}
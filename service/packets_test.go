@@ -0,0 +1,65 @@
+package service
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// headerVectors pins down the canonical header encoding. Any change to these
+// values must come with a new HeaderVersion.
+var headerVectors = []struct {
+	header   BlockHeader
+	encoding string
+	hash     string
+}{
+	{
+		header:   BlockHeader{Owner: -1},
+		encoding: "6466696e6974792d626c6f636b2d6865616465720002000000000000000000000000ffffffffffffffff000000000000000000000000000000000000000000000000",
+		hash:     "f2e32d31afb321d902d622b62f4dd224f4fd51377ff88ccb4a286a9b8688ff24",
+	},
+	{
+		header: BlockHeader{
+			ChainID:    "dfinity-test",
+			Round:      42,
+			Owner:      3,
+			Root:       "abcd",
+			Randomness: -5,
+			PrvHash:    "0123",
+			PrvSig:     []byte{1, 2, 3},
+			StateRoot:  []byte{4, 5},
+		},
+		encoding: "6466696e6974792d626c6f636b2d68656164657200020000000c6466696e6974792d74657374000000000000002a0000000000000003fffffffffffffffb0000000461626364000000043031323300000003010203000000020405",
+		hash:     "99a73dec546f6fd953eca0e5f568ee3c358d1537562aac9fe4135f34a865a9ac",
+	},
+}
+
+func TestBlockHeaderCanonical(t *testing.T) {
+	for i, v := range headerVectors {
+		if enc := hex.EncodeToString(v.header.MarshalCanonical()); enc != v.encoding {
+			t.Fatalf("vector %d: wrong encoding %s", i, enc)
+		}
+		if h := v.header.Hash(); h != v.hash {
+			t.Fatalf("vector %d: wrong hash %s", i, h)
+		}
+	}
+
+	// every field must change the hash
+	base := headerVectors[1].header
+	modified := []func(h *BlockHeader){
+		func(h *BlockHeader) { h.ChainID = "other" },
+		func(h *BlockHeader) { h.Round++ },
+		func(h *BlockHeader) { h.Owner++ },
+		func(h *BlockHeader) { h.Root = "abce" },
+		func(h *BlockHeader) { h.Randomness++ },
+		func(h *BlockHeader) { h.PrvHash = "0124" },
+		func(h *BlockHeader) { h.PrvSig = []byte{1, 2, 4} },
+		func(h *BlockHeader) { h.StateRoot = []byte{4, 6} },
+	}
+	for i, modify := range modified {
+		h := base
+		modify(&h)
+		if h.Hash() == base.Hash() {
+			t.Fatalf("modification %d does not change the hash", i)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/sign/bls"
+)
+
+var ReconfigType network.MessageTypeID
+
+func init() {
+	ReconfigType = network.RegisterMessage(&Reconfig{})
+}
+
+// ReconfigPrefix starts every reconfiguration transaction, so they can't be
+// mistaken for the transactions of the application
+const ReconfigPrefix = "dfinity-reconfig"
+
+// ReconfigDelay is the minimum number of rounds between the block finalizing
+// a reconfiguration and its first round, so the notarizers have the time to
+// reshare their key
+const ReconfigDelay = 10
+
+// syncRetry is the time a node which joined waits before trying again to sync
+// the chain, e.g. until its notarizer signed a checkpoint
+const syncRetry = 5 * time.Second
+
+// Reconfig changes the roster and the roles of the nodes from the given round
+// on. It must be signed by the operator key of the config.
+type Reconfig struct {
+	ChainID      string
+	Round        int                       // first round run by the new roster
+	Roster       []*network.ServerIdentity // beacons, then block makers, then notarizers
+	BeaconNb     int
+	BlockMakerNb int
+	NotarizerNb  int
+	Threshold    int
+	Signature    []byte
+}
+
+// SigningMessage returns the message signed by the operator:
+//
+//	prefix || chain id || round || counts || threshold || (address || public)*
+func (r *Reconfig) SigningMessage() []byte {
+	var b bytes.Buffer
+	b.WriteString(ReconfigPrefix)
+	r.encode(&b)
+	return b.Bytes()
+}
+
+// encode writes all fields but the signature
+func (r *Reconfig) encode(b *bytes.Buffer) {
+	writeBytes([]byte(r.ChainID), b)
+	for _, i := range []int{r.Round, r.BeaconNb, r.BlockMakerNb, r.NotarizerNb, r.Threshold, len(r.Roster)} {
+		writeInt(i, b)
+	}
+	for _, si := range r.Roster {
+		public, _ := si.Public.MarshalBinary()
+		writeBytes([]byte(si.Address), b)
+		writeBytes(public, b)
+	}
+}
+
+func writeInt(i int, b *bytes.Buffer) {
+	var buff [8]byte
+	binary.BigEndian.PutUint64(buff[:], uint64(i))
+	b.Write(buff[:])
+}
+
+func writeBytes(data []byte, b *bytes.Buffer) {
+	writeInt(len(data), b)
+	b.Write(data)
+}
+
+// Sign signs the reconfiguration with the private operator key
+func (r *Reconfig) Sign(operator kyber.Scalar) error {
+	sig, err := bls.Sign(Suite, operator, r.SigningMessage())
+	r.Signature = sig
+	return err
+}
+
+// Tx returns the transaction to submit to the block makers
+func (r *Reconfig) Tx() []byte {
+	var b bytes.Buffer
+	b.WriteString(ReconfigPrefix)
+	r.encode(&b)
+	writeBytes(r.Signature, &b)
+	return b.Bytes()
+}
+
+// Verify checks the reconfiguration is consistent and signed by the operator
+// of the config
+func (r *Reconfig) Verify(c *Config) error {
+	switch {
+	case c.Operator == nil:
+		return errors.New("reconfig: no operator key")
+	case r.ChainID != c.ChainID:
+		return errors.New("reconfig: wrong chain id")
+	case r.BeaconNb < 1 || r.BlockMakerNb < 1 || r.NotarizerNb < 1:
+		return errors.New("reconfig: needs at least one node of each role")
+	case len(r.Roster) != r.BeaconNb+r.BlockMakerNb+r.NotarizerNb:
+		return errors.New("reconfig: roster does not match the roles")
+	case r.Threshold < 1 || r.Threshold > r.NotarizerNb:
+		return fmt.Errorf("reconfig: threshold %d out of range", r.Threshold)
+	}
+	return bls.Verify(Suite, c.Operator, r.SigningMessage(), r.Signature)
+}
+
+// IsReconfigTx returns whether the transaction is a reconfiguration
+func IsReconfigTx(tx []byte) bool {
+	return bytes.HasPrefix(tx, []byte(ReconfigPrefix))
+}
+
+// DecodeReconfig decodes a reconfiguration transaction. Public keys of the
+// nodes are decoded with the given group.
+func DecodeReconfig(tx []byte, keys kyber.Group) (*Reconfig, error) {
+	if !IsReconfigTx(tx) {
+		return nil, errors.New("reconfig: not a reconfiguration")
+	}
+	rd := &reconfigReader{buff: tx[len(ReconfigPrefix):]}
+	r := &Reconfig{
+		ChainID:      string(rd.bytes()),
+		Round:        rd.int(),
+		BeaconNb:     rd.int(),
+		BlockMakerNb: rd.int(),
+		NotarizerNb:  rd.int(),
+		Threshold:    rd.int(),
+	}
+	n := rd.int()
+	for i := 0; i < n && rd.err == nil; i++ {
+		address, buff := rd.bytes(), rd.bytes()
+		public := keys.Point()
+		if err := public.UnmarshalBinary(buff); err != nil && rd.err == nil {
+			return nil, fmt.Errorf("reconfig: invalid public key for node %d: %s", i, err)
+		}
+		r.Roster = append(r.Roster, network.NewServerIdentity(public, network.Address(address)))
+	}
+	r.Signature = rd.bytes()
+	if rd.err != nil || len(rd.buff) > 0 {
+		return nil, errors.New("reconfig: invalid encoding")
+	}
+	return r, nil
+}
+
+// reconfigReader decodes what writeBytes and writeInt encode, remembering the
+// first error
+type reconfigReader struct {
+	buff []byte
+	err  error
+}
+
+func (r *reconfigReader) int() int {
+	if r.err != nil || len(r.buff) < 8 {
+		r.err = errors.New("truncated")
+		return 0
+	}
+	i := binary.BigEndian.Uint64(r.buff)
+	r.buff = r.buff[8:]
+	return int(i)
+}
+
+func (r *reconfigReader) bytes() []byte {
+	size := r.int()
+	if r.err != nil || size < 0 || size > len(r.buff) {
+		r.err = errors.New("truncated")
+		return nil
+	}
+	data := r.buff[:size]
+	r.buff = r.buff[size:]
+	return data
+}
+
+// verifyReconfigTx decodes the reconfiguration transaction and verifies it
+// against the config of this node
+func (d *Dfinity) verifyReconfigTx(tx []byte) (*Reconfig, error) {
+	r, err := DecodeReconfig(tx, d.context.Suite())
+	if err != nil {
+		return nil, err
+	}
+	return r, r.Verify(d.current().c)
+}
+
+// onReconfigTx schedules the reconfiguration finalized in the block of the
+// given round
+func (d *Dfinity) onReconfigTx(tx []byte, round int) {
+	r, err := d.verifyReconfigTx(tx)
+	if err != nil {
+		log.Error("dfinity: invalid reconfiguration finalized at round", round, ":", err)
+		return
+	}
+	d.scheduleReconfig(r, round)
+}
+
+// scheduleReconfig keeps the reconfiguration finalized at the given round
+// until its first round. The first notarizer forwards it to all nodes of both
+// rosters and starts the resharing of the key if the notarizers or the
+// threshold change.
+func (d *Dfinity) scheduleReconfig(r *Reconfig, round int) {
+	if r.Round < round+ReconfigDelay {
+		log.Error("dfinity: reconfiguration of round", r.Round, "finalized too late at round", round)
+		return
+	}
+	if !d.keepReconfig(r) {
+		return
+	}
+	c := d.current().c
+	nots := c.NotarizerNodes()
+	if !nots[0].Equal(d.ServerIdentity()) {
+		return
+	}
+	// beacons and joining nodes may not finalize blocks themselves
+	go d.broadcast(unique(append(c.Roster.List, r.Roster...)), r)
+	newNots := r.Roster[r.BeaconNb+r.BlockMakerNb:]
+	if sameNodes(newNots, nots) && r.Threshold == c.Threshold {
+		return
+	}
+	go func() {
+		if err := d.Reshare(newNots, r.Threshold, r.Round, r.Round); err != nil {
+			log.Error("dfinity: resharing for the reconfiguration of round", r.Round, "failed:", err)
+		}
+	}()
+}
+
+// keepReconfig keeps the reconfiguration until its first round and returns
+// whether it was new. Reconfigurations starting at a round this node already
+// reached, or before the last one applied, are replays and get dropped.
+func (d *Dfinity) keepReconfig(r *Reconfig) bool {
+	round := d.current().round()
+	d.reconfMu.Lock()
+	defer d.reconfMu.Unlock()
+	if r.Round <= round || r.Round <= d.applied {
+		log.Lvl2("dfinity: dropping reconfiguration of past round", r.Round)
+		return false
+	}
+	if _, exists := d.reconfigs[r.Round]; exists {
+		return false
+	}
+	d.reconfigs[r.Round] = r
+	log.Lvl1("dfinity: roster reconfiguration scheduled at round", r.Round)
+	return true
+}
+
+// applyReconfig switches to the roster of the reconfigurations starting at the
+// latest right after the given round, in order. The round must have been
+// verified: nodes following the chain call it once their finalizer stored a
+// notarized block or a skip certificate of the round, the others once they
+// verified one. Nodes without chain then sync it from a notarizer in the
+// background, see syncJoined.
+func (d *Dfinity) applyReconfig(round int) {
+	d.reconfMu.Lock()
+	var due []int
+	for r := range d.reconfigs {
+		if r <= round+1 {
+			due = append(due, r)
+		}
+	}
+	sort.Ints(due)
+	var from *network.ServerIdentity
+	for _, r := range due {
+		from = d.reconfigure(d.reconfigs[r])
+		delete(d.reconfigs, r)
+	}
+	d.reconfMu.Unlock()
+	if from == nil {
+		return
+	}
+	if d.app != nil {
+		if err := d.setApplication(); err != nil {
+			log.Error("dfinity: can't set application:", err)
+		}
+	}
+	go d.syncJoined(from)
+}
+
+// syncJoined fast syncs the chain of this node from the given notarizer after
+// it joined, trying again every syncRetry until it succeeds or the node
+// changes its process
+func (d *Dfinity) syncJoined(si *network.ServerIdentity) {
+	f := d.finalizer()
+	for {
+		err := d.FastSync(NewClient(d.context.Suite()), si)
+		if err == nil {
+			return
+		}
+		log.Error("dfinity: can't sync the chain after joining:", err)
+		time.Sleep(syncRetry)
+		if d.finalizer() != f {
+			return
+		}
+	}
+}
+
+// join applies the reconfigurations adding this node to the roster once a
+// beacon of the new roster sends it the beacon of a round they run
+func (d *Dfinity) join(si *network.ServerIdentity, round int) {
+	d.reconfMu.Lock()
+	var joined bool
+	for _, r := range d.reconfigs {
+		for _, beacon := range r.Roster[:r.BeaconNb] {
+			joined = joined || (r.Round <= round && beacon.Equal(si))
+		}
+	}
+	d.reconfMu.Unlock()
+	if joined {
+		d.applyReconfig(round - 1)
+	}
+}
+
+// reconfigure rebuilds the process of this node for its role in the new
+// roster. The finalized chain and the application carry over. Notarizers take
+// the key reshared for the new roster, unless the notarizers and the threshold
+// stay the same. Nodes without chain, i.e. beacons becoming block makers or
+// notarizers and nodes joining the roster, have to fast sync from the returned
+// notarizer. Joining nodes must have been given the config of the chain with a
+// negative index.
+// ONLY CALLED WHEN CALLER HAVE THE RECONFIGURATION LOCK
+func (d *Dfinity) reconfigure(r *Reconfig) *network.ServerIdentity {
+	c := *d.keyConfig()
+	d.procMu.Lock()
+	defer d.procMu.Unlock()
+	d.applied = r.Round
+	if d.c.Index < 0 {
+		// joining node, its metrics get labelled with its new roster entry
+		c.metrics = nil
+	}
+	c.Roster = onet.NewRoster(r.Roster)
+	c.N = len(r.Roster)
+	c.BeaconNb = r.BeaconNb
+	c.BlockMakerNb = r.BlockMakerNb
+	c.NotarizerNb = r.NotarizerNb
+	c.Index = -1
+	for i, si := range r.Roster {
+		if si.Equal(d.ServerIdentity()) {
+			c.Index = i
+		}
+	}
+	newNots := c.NotarizerNodes()
+	if !sameNodes(newNots, d.c.NotarizerNodes()) || r.Threshold != d.c.Threshold {
+		c.Threshold = r.Threshold
+		c.Share = nil
+		if k := d.nextKey; k != nil && k.Activation == r.Round {
+			c.Public = k.Public
+			if c.IsNotarizer(c.Index) {
+				c.Share = k.Share
+			}
+		}
+	}
+	fin := d.state().finalizer()
+	d.stop()
+	d.nextKey = nil
+	if c.IsNotarizer(c.Index) && c.Share == nil {
+		log.Error("dfinity: no reshared key for the new roster, can't notarize")
+		c.Index = -1
+	}
+	d.c = &c
+	log.Lvl1("dfinity: new roster from round", r.Round, ", now", c.Role(), "at index", c.Index)
+	if c.Index < 0 {
+		// left the roster, keep serving the chain
+		if d.fin == nil {
+			d.fin = fin
+		}
+		d.wire()
+		return nil
+	}
+	d.metrics = metricsOf(&c)
+	switch {
+	case c.IsBeacon(c.Index):
+		d.beacon = NewBeaconProcess(d.context, &c, d.broadcast)
+		d.beacon.catchUp(r.Round - 1)
+		if c.BeaconResend > 0 {
+			go d.beacon.resendLoop()
+		}
+	case c.IsBlockMaker(c.Index):
+		d.bm = newBlockMaker(d.context, &c, d.broadcast, fin)
+		d.bm.app = d.app
+		d.bm.highestRound = r.Round - 1
+	default:
+		d.not = newNotarizer(d.context, &c, d.broadcast, fin)
+		d.not.round = r.Round - 1
+	}
+	d.wire()
+	if d.fin != nil {
+		d.fin.Reconfigure(&c, d.fin.done)
+	}
+	if fin != nil || d.beacon != nil {
+		return nil
+	}
+	// no chain on this node yet
+	return newNots[0]
+}
+
+// Close stops the process and the gateway of this node and closes its trace
+// file
+func (d *Dfinity) Close() error {
+	d.reconfMu.Lock()
+	defer d.reconfMu.Unlock()
+	d.procMu.Lock()
+	defer d.procMu.Unlock()
+	d.stop()
+	if d.gateway != nil {
+		if err := d.gateway.Close(); err != nil {
+			log.Error("gateway:", err)
+		}
+		d.gateway = nil
+	}
+	if d.c == nil {
+		return nil
+	}
+	return closeTracer(d.c)
+}
+
+// stop stops the current process of this node
+// ONLY CALLED WHEN CALLER HAVE THE PROCESS LOCK
+func (d *Dfinity) stop() {
+	switch {
+	case d.beacon != nil:
+		d.beacon.Stop()
+	case d.bm != nil:
+		d.bm.Stop()
+	case d.not != nil:
+		d.not.Stop()
+	}
+	d.beacon, d.bm, d.not = nil, nil, nil
+}
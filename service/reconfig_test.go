@@ -0,0 +1,182 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber/sign/tbls"
+	"go.dedis.ch/kyber/util/random"
+)
+
+func TestReconfigTx(t *testing.T) {
+	operator := G2.Scalar().Pick(random.New())
+	c := &Config{ChainID: "test", Operator: G2.Point().Mul(operator, nil)}
+	r := &Reconfig{ChainID: "test", Round: 42, BeaconNb: 1, BlockMakerNb: 1, NotarizerNb: 2, Threshold: 2}
+	for _, addr := range []string{"tcp://1.1.1.1:2000", "tcp://2.2.2.2:2000", "tcp://3.3.3.3:2000", "tcp://4.4.4.4:2000"} {
+		r.Roster = append(r.Roster, network.NewServerIdentity(G2.Point().Pick(random.New()), network.Address(addr)))
+	}
+	if err := r.Sign(operator); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeReconfig(r.Tx(), G2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Round != r.Round || len(decoded.Roster) != len(r.Roster) || !decoded.Roster[3].Equal(r.Roster[3]) {
+		t.Fatal("reconfig not decoded correctly")
+	}
+	if err := decoded.Verify(c); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded.Threshold = 1
+	if err := decoded.Verify(c); err == nil {
+		t.Fatal("tampered reconfig accepted")
+	}
+	if _, err := DecodeReconfig(r.Tx()[:len(r.Tx())-1], G2); err == nil {
+		t.Fatal("truncated reconfig decoded")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	test := onet.NewTCPTest(newNetworkSuite())
+	defer test.CloseAll()
+
+	n := 5
+	servers, all, _ := test.GenTree(n+1, true)
+	// the last server joins the roster with the reconfiguration
+	roster := onet.NewRoster(all.List[:n])
+	operator := G2.Scalar().Pick(random.New())
+	shares, public := dkg(2, 2)
+	_, commits := public.Info()
+	genesis := &Genesis{ChainID: "reconfig", Roster: roster, BeaconNb: 1, BlockMakerNb: 2, NotarizerNb: 2,
+		Threshold: 2, Public: commits, BeaconSeed: 1}
+	config := func(i int) *Config {
+		c := genesis.Config(i)
+		c.RoundsToSimulate = 100
+		c.BlockSize = 1024
+		c.FinalizeTime = time.Hour
+		c.Operator = G2.Point().Mul(operator, nil)
+		return c
+	}
+	dfinities := make([]*Dfinity, n)
+	for i := range dfinities {
+		c := config(i)
+		if i >= 3 {
+			c.Share = shares[i-3]
+		}
+		dfinities[i] = servers[i].Service(Name).(*Dfinity)
+		dfinities[i].SetConfig(c)
+	}
+	joining := servers[n].Service(Name).(*Dfinity)
+	joining.SetConfig(config(-1))
+
+	// the chain finalized so far by the notarizers, without checkpoint
+	notarize := func(round int, parent *Block) *NotarizedBlock {
+		b := &Block{BlockHeader: BlockHeader{ChainID: "reconfig", Round: round, Root: rootHash(nil), PrvHash: parent.BlockHeader.Hash()}}
+		msg := b.BlockHeader.SigningMessage()
+		var sigs [][]byte
+		for _, s := range shares {
+			sig, err := tbls.Sign(Suite, s, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sigs = append(sigs, sig)
+		}
+		sig, err := tbls.Recover(Suite, public, msg, sigs, 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &NotarizedBlock{Block: b, Notarization: &Notarization{Hash: b.BlockHeader.Hash(), Signature: sig}}
+	}
+	b1 := notarize(1, genesis.Block())
+	b2 := notarize(2, b1.Block)
+	for _, d := range dfinities[3:] {
+		chain := d.not.finalizer.chain
+		chain.Append(genesis.NotarizedBlock())
+		chain.Append(b1)
+		chain.Append(b2)
+	}
+	// and a checkpoint signed by the notarizers
+	ckpt := &Checkpoint{ChainID: "reconfig", Height: 3, Round: 2, Hash: b2.BlockHeader.Hash()}
+	for _, s := range shares {
+		sig, err := tbls.Sign(Suite, s, ckpt.SigningMessage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dfinities[4].checkpoints.AddPartial(&CheckpointProposal{Checkpoint: ckpt, Partial: sig})
+	}
+	signed := dfinities[4].checkpoints.Get(3)
+	if signed == nil {
+		t.Fatal("checkpoint not signed")
+	}
+
+	reconfig := func(round int) *Reconfig {
+		// the beacon and the second block maker swap their roles, the joining
+		// node becomes the third block maker
+		list := all.List
+		r := &Reconfig{ChainID: "reconfig", Round: round, BeaconNb: 1, BlockMakerNb: 3, NotarizerNb: 2, Threshold: 2,
+			Roster: []*network.ServerIdentity{list[2], list[1], list[0], list[5], list[3], list[4]}}
+		if err := r.Sign(operator); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	r := reconfig(20)
+	oldNot := dfinities[3].not
+	for _, d := range dfinities {
+		d.onReconfigTx(r.Tx(), 5)
+	}
+	// a node following the chain ignores the reconfigurations sent to it
+	dfinities[3].Process(&network.Envelope{Msg: reconfig(40)})
+	if _, exists := dfinities[3].reconfigs[40]; exists {
+		t.Fatal("reconfiguration taken from the network")
+	}
+	// while the joining node takes it
+	joining.Process(&network.Envelope{Msg: r})
+	dfinities = append(dfinities, joining)
+	for _, d := range dfinities {
+		d.applyReconfig(r.Round - 1)
+	}
+
+	if d := dfinities[0]; d.beacon != nil || d.bm == nil || d.c.Index != 2 {
+		t.Fatal("beacon not rebuilt as block maker")
+	}
+	if d := dfinities[2]; d.bm != nil || d.beacon == nil || d.beacon.round != r.Round-1 || d.c.Index != 0 {
+		t.Fatal("block maker not rebuilt as beacon")
+	}
+	not := dfinities[3].not
+	if not == nil || not == oldNot || not.round != r.Round-1 || not.finalizer != oldNot.finalizer || !oldNot.stopped {
+		t.Fatal("notarizer not rebuilt on the same chain")
+	}
+	if dfinities[4].checkpoints.Get(3) != signed {
+		t.Fatal("signed checkpoint lost with the reconfiguration")
+	}
+	if d := joining; d.bm == nil || d.c.Index != 3 {
+		t.Fatal("joining node not rebuilt as block maker")
+	}
+	for _, d := range dfinities {
+		if d.applied != r.Round || len(d.reconfigs) != 0 || !d.c.Roster.List[0].Equal(all.List[2]) {
+			t.Fatal("reconfiguration not applied")
+		}
+		// signed reconfigurations of past rounds can't be replayed
+		if d.keepReconfig(r) || d.keepReconfig(reconfig(15)) {
+			t.Fatal("reconfiguration replayed")
+		}
+	}
+	// the nodes without chain replay it from the genesis
+	for _, d := range []*Dfinity{dfinities[0], joining} {
+		chain := d.finalizer().chain
+		for start := time.Now(); chain.Length() != 3; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("chain not synced after joining:", chain.Length())
+			}
+		}
+		if chain.Head().BlockHeader.Hash() != b2.BlockHeader.Hash() {
+			t.Fatal("wrong head after syncing")
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/share"
+	"go.dedis.ch/kyber/util/random"
+)
+
+// ReshareProtocolName is the name of the onet protocol resharing the
+// notarizers' key
+const ReshareProtocolName = "dfinity-reshare"
+
+// reshareTimeout is the time after which a resharing that did not complete
+// is given up
+const reshareTimeout = 30 * time.Second
+
+func init() {
+	network.RegisterMessages(&ReshareStart{}, &ReshareDeal{}, &ReshareResponse{},
+		&ReshareQualified{}, &ReshareDone{})
+}
+
+// ReshareStart announces a resharing of the notarizers' key to the new
+// notarizers given in share index order, with the given threshold. The new
+// shares are used from the activation round on. It carries the current public
+// polynomial of the dealers for the nodes joining the notarizers, which may not
+// know it.
+type ReshareStart struct {
+	Epoch      int
+	Activation int
+	Nodes      []*network.ServerIdentity
+	Threshold  int
+
+	Public         []kyber.Point
+	OldThreshold   int
+	OldNotarizerNb int
+}
+
+// ReshareDeal is sent by a holder of a current share to each new notarizer. It
+// holds a share of a fresh polynomial whose secret is the dealer's own share,
+// along with the commitments of this polynomial.
+type ReshareDeal struct {
+	Epoch   int
+	Dealer  int // index of the current share of the dealer
+	Commits []kyber.Point
+	Share   *share.PriShare
+}
+
+// ReshareResponse tells the initiator the deal of the dealer is valid
+type ReshareResponse struct {
+	Epoch  int
+	Dealer int
+}
+
+// ReshareQualified gives the dealers every new notarizer combines the deals of,
+// so they all end up on the same polynomial
+type ReshareQualified struct {
+	Epoch   int
+	Dealers []int
+}
+
+// ReshareDone tells the initiator a new notarizer got its share
+type ReshareDone struct {
+	Epoch int
+}
+
+// ReshareResult is the new key of a notarizer after a resharing. The group key,
+// Public[0], is the one of before.
+type ReshareResult struct {
+	Epoch      int
+	Activation int
+	Nodes      []*network.ServerIdentity // new notarizers in share index order
+	Threshold  int
+	Public     []kyber.Point
+	Share      *share.PriShare
+}
+
+// reshareDeals returns the deals of the holder of the given share for n new
+// notarizers with threshold t
+func reshareDeals(s *share.PriShare, t, n int) ([]kyber.Point, []*share.PriShare) {
+	poly := share.NewPriPoly(G2, t, s.V, random.New())
+	_, commits := poly.Commit(G2.Point().Base()).Info()
+	return commits, poly.Shares(n)
+}
+
+// verifyDeal checks the deal is a share for the new notarizer at index i of a
+// polynomial of the given threshold, whose secret is the current share of the
+// dealer
+func verifyDeal(c *Config, d *ReshareDeal, i, t int) error {
+	switch {
+	case d.Dealer < 0 || d.Dealer >= c.NotarizerNb:
+		return fmt.Errorf("invalid dealer %d", d.Dealer)
+	case len(d.Commits) != t:
+		return fmt.Errorf("%d commitments for a threshold of %d", len(d.Commits), t)
+	case d.Share == nil || d.Share.I != i:
+		return errors.New("share of another notarizer")
+	}
+	old := share.NewPubPoly(G2, G2.Point().Base(), c.Public)
+	if !d.Commits[0].Equal(old.Eval(d.Dealer).V) {
+		return errors.New("polynomial does not share the dealer's share")
+	}
+	if !share.NewPubPoly(G2, G2.Point().Base(), d.Commits).Check(d.Share) {
+		return errors.New("share does not match the commitments")
+	}
+	return nil
+}
+
+// combineDeals interpolates the deals of the qualified dealers into the new
+// share at index i and the new public polynomial. There must be as many deals
+// as the current threshold.
+func combineDeals(c *Config, deals []*ReshareDeal, i, t int) (*share.PriShare, []kyber.Point, error) {
+	if len(deals) < c.Threshold {
+		return nil, nil, fmt.Errorf("%d deals for a threshold of %d", len(deals), c.Threshold)
+	}
+	subs := make([]*share.PriShare, len(deals))
+	for k, d := range deals {
+		subs[k] = &share.PriShare{I: d.Dealer, V: d.Share.V}
+	}
+	secret, err := share.RecoverSecret(G2, subs, c.Threshold, c.NotarizerNb)
+	if err != nil {
+		return nil, nil, err
+	}
+	commits := make([]kyber.Point, t)
+	for j := range commits {
+		pubs := make([]*share.PubShare, len(deals))
+		for k, d := range deals {
+			pubs[k] = &share.PubShare{I: d.Dealer, V: d.Commits[j]}
+		}
+		if commits[j], err = share.RecoverCommit(G2, pubs, c.Threshold, c.NotarizerNb); err != nil {
+			return nil, nil, err
+		}
+	}
+	old := share.NewPubPoly(G2, G2.Point().Base(), c.Public)
+	if !commits[0].Equal(old.Commit()) {
+		return nil, nil, errors.New("group key changed")
+	}
+	s := &share.PriShare{I: i, V: secret}
+	if !share.NewPubPoly(G2, G2.Point().Base(), commits).Check(s) {
+		return nil, nil, errors.New("new share does not match the new polynomial")
+	}
+	return s, commits, nil
+}
+
+// Reshare is the onet protocol issuing fresh shares of the notarizers' key to
+// a new set of notarizers, possibly with a different threshold, keeping the
+// group key. It runs on a flat tree holding the current and the new
+// notarizers, rooted at the initiator:
+//
+//   - the initiator sends ReshareStart to everybody,
+//   - every holder of a current share sends a deal to every new notarizer,
+//   - new notarizers check the deals and tell the initiator which are valid,
+//   - once a threshold of new notarizers approved the same dealers, as many as
+//     the current threshold, the initiator sends them to everybody,
+//   - new notarizers combine the deals of the qualified dealers into their new
+//     share, once they got them all, and tell the initiator they are done.
+//
+// Every instance gives up after reshareTimeout. The initiator then reports the
+// resharing done if a threshold of new notarizers got their share, as they
+// are enough to sign.
+//
+// Deals travel in clear, like the shares in the config, so links between
+// notarizers must be trusted.
+type Reshare struct {
+	sync.Mutex
+	*onet.TreeNodeInstance
+	c *Config // config of this node, holding the current key
+	// parameters of the resharing, set by the initiator before Start
+	Params *ReshareStart
+	// called with the new key of this node, if it is a new notarizer
+	result func(*ReshareResult)
+	// Finished gets nil once all new notarizers got their share, on the
+	// initiator only
+	Finished chan error
+
+	deals     map[int]*ReshareDeal // deals received by a new notarizer
+	early     []*ReshareDeal       // deals received before the parameters
+	combine   []int                // qualified dealers a new notarizer waits for
+	approvals map[int]map[int]bool // new notarizers approving each dealer, initiator only
+	qualified bool
+	done      int // new notarizers done, initiator only
+	once      sync.Once
+}
+
+// NewReshareProtocol returns the protocol instance for the given config,
+// calling fn with the new key of this node
+func NewReshareProtocol(n *onet.TreeNodeInstance, c *Config, fn func(*ReshareResult)) (*Reshare, error) {
+	r := &Reshare{
+		TreeNodeInstance: n,
+		c:                c,
+		result:           fn,
+		Finished:         make(chan error, 1),
+		deals:            make(map[int]*ReshareDeal),
+		approvals:        make(map[int]map[int]bool),
+	}
+	err := n.RegisterHandlers(r.handleStart, r.handleDeal, r.handleResponse,
+		r.handleQualified, r.handleDone)
+	time.AfterFunc(reshareTimeout, r.timeout)
+	return r, err
+}
+
+type structReshareStart struct {
+	*onet.TreeNode
+	ReshareStart
+}
+
+type structReshareDeal struct {
+	*onet.TreeNode
+	ReshareDeal
+}
+
+type structReshareResponse struct {
+	*onet.TreeNode
+	ReshareResponse
+}
+
+type structReshareQualified struct {
+	*onet.TreeNode
+	ReshareQualified
+}
+
+type structReshareDone struct {
+	*onet.TreeNode
+	ReshareDone
+}
+
+// Start sends the parameters of the resharing to all nodes and deals the share
+// of the initiator, if any
+func (r *Reshare) Start() error {
+	if r.Params == nil {
+		return errors.New("reshare: no parameters")
+	}
+	if r.Params.Threshold < 1 || r.Params.Threshold > len(r.Params.Nodes) {
+		return fmt.Errorf("reshare: threshold %d out of range", r.Params.Threshold)
+	}
+	if err := r.SendToChildren(r.Params); err != nil {
+		return err
+	}
+	return r.deal()
+}
+
+func (r *Reshare) handleStart(msg structReshareStart) error {
+	r.Lock()
+	start := msg.ReshareStart
+	r.Params = &start
+	early := r.early
+	r.early = nil
+	member := r.index(r.ServerIdentity()) >= 0
+	r.Unlock()
+	if !member && !r.isDealer() {
+		// neither dealer nor new notarizer
+		r.finish(nil)
+		return nil
+	}
+	for _, d := range early {
+		if err := r.handleDeal(structReshareDeal{msg.TreeNode, *d}); err != nil {
+			return err
+		}
+	}
+	return r.deal()
+}
+
+// deal sends the deals of this node to the new notarizers, if it holds a
+// current share
+func (r *Reshare) deal() error {
+	if !r.isDealer() {
+		return nil
+	}
+	start := r.Params
+	commits, shares := reshareDeals(r.c.Share, start.Threshold, len(start.Nodes))
+	for i, si := range start.Nodes {
+		d := &ReshareDeal{
+			Epoch:   start.Epoch,
+			Dealer:  r.c.Share.I,
+			Commits: commits,
+			Share:   shares[i],
+		}
+		if err := r.send(si, d); err != nil {
+			log.Error("reshare: can't send deal to", si, ":", err)
+		}
+	}
+	return nil
+}
+
+func (r *Reshare) handleDeal(msg structReshareDeal) error {
+	r.Lock()
+	defer r.Unlock()
+	d := msg.ReshareDeal
+	start := r.Params
+	if start == nil {
+		// the dealer got the parameters first
+		r.early = append(r.early, &d)
+		return nil
+	}
+	if d.Epoch != start.Epoch {
+		return nil
+	}
+	old, err := r.dealers()
+	if err != nil {
+		return err
+	}
+	if err := verifyDeal(old, &d, r.index(r.ServerIdentity()), start.Threshold); err != nil {
+		log.Lvl2("reshare: invalid deal from dealer", d.Dealer, ":", err)
+		return nil
+	}
+	if _, exists := r.deals[d.Dealer]; exists {
+		return nil
+	}
+	r.deals[d.Dealer] = &d
+	if deals := r.qualifiedDeals(); deals != nil {
+		// the qualified dealers were known before this deal
+		go r.complete(deals)
+	}
+	return r.send(r.Root().ServerIdentity, &ReshareResponse{Epoch: d.Epoch, Dealer: d.Dealer})
+}
+
+func (r *Reshare) handleResponse(msg structReshareResponse) error {
+	r.Lock()
+	defer r.Unlock()
+	if !r.IsRoot() || r.qualified || msg.Epoch != r.Params.Epoch {
+		return nil
+	}
+	node := r.index(msg.ServerIdentity)
+	if node < 0 {
+		return nil
+	}
+	if r.approvals[msg.Dealer] == nil {
+		r.approvals[msg.Dealer] = make(map[int]bool)
+	}
+	r.approvals[msg.Dealer][node] = true
+	old, err := r.dealers()
+	if err != nil {
+		return err
+	}
+	dealers := r.qualify(old.Threshold)
+	if dealers == nil {
+		return nil
+	}
+	r.qualified = true
+	q := &ReshareQualified{Epoch: r.Params.Epoch, Dealers: dealers}
+	if err := r.SendToChildren(q); err != nil {
+		return err
+	}
+	go r.handleQualified(structReshareQualified{r.TreeNode(), *q})
+	return nil
+}
+
+// qualify returns the first t dealers approved by a threshold of new
+// notarizers, if a threshold of new notarizers approved them all
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (r *Reshare) qualify(t int) []int {
+	var dealers []int
+	for dealer, nodes := range r.approvals {
+		if len(nodes) >= r.Params.Threshold {
+			dealers = append(dealers, dealer)
+		}
+	}
+	if len(dealers) < t {
+		return nil
+	}
+	sort.Ints(dealers)
+	dealers = dealers[:t]
+	var approving int
+	for i := range r.Params.Nodes {
+		all := true
+		for _, dealer := range dealers {
+			all = all && r.approvals[dealer][i]
+		}
+		if all {
+			approving++
+		}
+	}
+	if approving < r.Params.Threshold {
+		return nil
+	}
+	return dealers
+}
+
+func (r *Reshare) handleQualified(msg structReshareQualified) error {
+	r.Lock()
+	start := r.Params
+	if start == nil || msg.Epoch != start.Epoch || r.index(r.ServerIdentity()) < 0 {
+		r.Unlock()
+		if !r.IsRoot() {
+			r.finish(nil)
+		}
+		return nil
+	}
+	r.combine = msg.Dealers
+	deals := r.qualifiedDeals()
+	r.Unlock()
+	if deals == nil {
+		// waits for the missing deals, see handleDeal
+		return nil
+	}
+	return r.complete(deals)
+}
+
+// qualifiedDeals returns the deals of the qualified dealers once this node got
+// all of them, only the first time
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (r *Reshare) qualifiedDeals() []*ReshareDeal {
+	if r.combine == nil {
+		return nil
+	}
+	deals := make([]*ReshareDeal, 0, len(r.combine))
+	for _, dealer := range r.combine {
+		d, exists := r.deals[dealer]
+		if !exists {
+			return nil
+		}
+		deals = append(deals, d)
+	}
+	r.combine = nil
+	return deals
+}
+
+// complete gets the new share of this node out of the deals of the qualified
+// dealers and ends the protocol instance, unless it is the initiator
+func (r *Reshare) complete(deals []*ReshareDeal) error {
+	err := r.newShare(deals)
+	if !r.IsRoot() {
+		r.finish(err)
+	}
+	return err
+}
+
+// newShare combines the deals into the new share of this node, hands it over
+// and tells the initiator
+func (r *Reshare) newShare(deals []*ReshareDeal) error {
+	r.Lock()
+	start := r.Params
+	i := r.index(r.ServerIdentity())
+	old, err := r.dealers()
+	r.Unlock()
+	if err != nil {
+		return err
+	}
+	s, public, err := combineDeals(old, deals, i, start.Threshold)
+	if err != nil {
+		log.Error("reshare: can't combine deals:", err)
+		return err
+	}
+	log.Lvl1("reshare: new share", i, "for epoch", start.Epoch)
+	if r.result != nil {
+		r.result(&ReshareResult{
+			Epoch:      start.Epoch,
+			Activation: start.Activation,
+			Nodes:      start.Nodes,
+			Threshold:  start.Threshold,
+			Public:     public,
+			Share:      s,
+		})
+	}
+	return r.send(r.Root().ServerIdentity, &ReshareDone{Epoch: start.Epoch})
+}
+
+func (r *Reshare) handleDone(msg structReshareDone) error {
+	r.Lock()
+	if !r.IsRoot() || msg.Epoch != r.Params.Epoch {
+		r.Unlock()
+		return nil
+	}
+	r.done++
+	all := r.done == len(r.Params.Nodes)
+	r.Unlock()
+	if all {
+		r.finish(nil)
+	}
+	return nil
+}
+
+// finish ends the protocol instance, only the first time. The outcome is
+// reported on Finished.
+func (r *Reshare) finish(err error) {
+	r.once.Do(func() {
+		r.Finished <- err
+		r.Done()
+	})
+}
+
+// timeout gives the resharing up. The initiator reports it done if a threshold
+// of new notarizers got their share.
+func (r *Reshare) timeout() {
+	r.Lock()
+	enough := r.IsRoot() && r.Params != nil && r.done >= r.Params.Threshold
+	r.Unlock()
+	if enough {
+		r.finish(nil)
+		return
+	}
+	r.finish(errors.New("reshare: timeout"))
+}
+
+// dealers returns the key parameters of the dealers, the ones given by the
+// initiator if they share the group key of this node
+func (r *Reshare) dealers() (*Config, error) {
+	p := r.Params
+	if len(p.Public) == 0 {
+		return r.c, nil
+	}
+	if !p.Public[0].Equal(r.c.Public[0]) {
+		return nil, errors.New("reshare: initiator has another group key")
+	}
+	return &Config{Public: p.Public, Threshold: p.OldThreshold, NotarizerNb: p.OldNotarizerNb}, nil
+}
+
+// isDealer returns whether this node holds a current share
+func (r *Reshare) isDealer() bool {
+	return r.c.Share != nil && r.c.IsNotarizer(r.c.Index)
+}
+
+// index returns the index of the new share of the given node, -1 if it is not
+// a new notarizer
+func (r *Reshare) index(si *network.ServerIdentity) int {
+	for i, node := range r.Params.Nodes {
+		if node.Equal(si) {
+			return i
+		}
+	}
+	return -1
+}
+
+// send sends the message to the given node of the tree, or handles it right
+// away if it is this node
+func (r *Reshare) send(si *network.ServerIdentity, msg interface{}) error {
+	if si.Equal(r.ServerIdentity()) {
+		tn := r.TreeNode()
+		switch inner := msg.(type) {
+		case *ReshareDeal:
+			go r.handleDeal(structReshareDeal{tn, *inner})
+		case *ReshareResponse:
+			go r.handleResponse(structReshareResponse{tn, *inner})
+		case *ReshareDone:
+			go r.handleDone(structReshareDone{tn, *inner})
+		}
+		return nil
+	}
+	for _, tn := range r.List() {
+		if tn.ServerIdentity.Equal(si) {
+			return r.SendTo(tn, msg)
+		}
+	}
+	return fmt.Errorf("reshare: %s not in the tree", si)
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber/share"
+	"go.dedis.ch/kyber/sign/bls"
+	"go.dedis.ch/kyber/sign/tbls"
+)
+
+func TestReshareKeepsGroupKey(t *testing.T) {
+	oldT, oldN, newT, newN := 3, 5, 2, 4
+	shares, public := dkg(oldT, oldN)
+	_, commits := public.Info()
+	c := &Config{Public: commits, Threshold: oldT, NotarizerNb: oldN}
+
+	deals := make([][]*ReshareDeal, newN)
+	for _, s := range shares {
+		dc, ds := reshareDeals(s, newT, newN)
+		for j := range deals {
+			deals[j] = append(deals[j], &ReshareDeal{Dealer: s.I, Commits: dc, Share: ds[j]})
+		}
+	}
+	bad := *deals[0][0]
+	bad.Share = &share.PriShare{I: 0, V: G2.Scalar().One()}
+	if err := verifyDeal(c, &bad, 0, newT); err == nil {
+		t.Fatal("invalid deal accepted")
+	}
+
+	msg := []byte("reshared")
+	var sigs [][]byte
+	var newPublic *share.PubPoly
+	for j := range deals {
+		qualified := []*ReshareDeal{deals[j][0], deals[j][2], deals[j][4]}
+		for _, d := range qualified {
+			if err := verifyDeal(c, d, j, newT); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s, pub, err := combineDeals(c, qualified, j, newT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newPublic = share.NewPubPoly(G2, G2.Point().Base(), pub)
+		sig, err := tbls.Sign(Suite, s, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs = append(sigs, sig)
+	}
+	sig, err := tbls.Recover(Suite, newPublic, msg, sigs[:newT], newT, newN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bls.Verify(Suite, public.Commit(), msg, sig); err != nil {
+		t.Fatal("signature of the new shares does not verify under the group key:", err)
+	}
+}
+
+func TestReshareProtocol(t *testing.T) {
+	test := onet.NewTCPTest(newNetworkSuite())
+	defer test.CloseAll()
+
+	n, notIndex, threshold := 5, 2, 2
+	servers, roster, _ := test.GenTree(n, true)
+	shares, public := dkg(threshold, n-notIndex)
+	_, commits := public.Info()
+	genesis := &Genesis{ChainID: "reshare", Roster: roster, BeaconNb: 1, BlockMakerNb: 1,
+		NotarizerNb: n - notIndex, Threshold: threshold, Public: commits, BeaconSeed: 1}
+	dfinities := make([]*Dfinity, n)
+	for i := range dfinities {
+		c := genesis.Config(i)
+		c.RoundsToSimulate = 100
+		if i >= notIndex {
+			c.Share = shares[i-notIndex]
+		}
+		dfinities[i] = servers[i].Service(Name).(*Dfinity)
+		dfinities[i].SetConfig(c)
+	}
+
+	const activation = 10
+	nodes := roster.List[notIndex:]
+	if err := dfinities[notIndex].Reshare(nodes, threshold, 1, activation); err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("reshared")
+	sigs := make(map[int][]byte)
+	var key *roundKey
+	for i, d := range dfinities[notIndex:] {
+		// the rounds before the activation keep the key of the genesis
+		if before := d.not.keys.At(activation - 1); before.c != d.c || before.c.Share != shares[i] {
+			t.Fatal("key of the rounds before the activation changed")
+		}
+		key = d.not.keys.At(activation)
+		if key.c == d.c || key.c.Share.I != i || !key.c.Public[0].Equal(commits[0]) {
+			t.Fatal("wrong reshared key of notarizer", i)
+		}
+		sig, err := tbls.Sign(Suite, key.c.Share, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs[i] = sig
+	}
+	signature, _, err := key.verifier.Recover(msg, sigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bls.Verify(Suite, public.Commit(), msg, signature); err != nil {
+		t.Fatal("signature of the reshared keys does not verify under the group key:", err)
+	}
+}
+
+func TestReshareQualify(t *testing.T) {
+	r := &Reshare{Params: &ReshareStart{Nodes: make([]*network.ServerIdentity, 3), Threshold: 2}}
+	// no two new notarizers approved the same two dealers yet
+	r.approvals = map[int]map[int]bool{
+		0: {0: true, 1: true},
+		1: {1: true, 2: true},
+		2: {0: true},
+	}
+	if dealers := r.qualify(2); dealers != nil {
+		t.Fatal("dealers qualified without a threshold approving them all:", dealers)
+	}
+	r.approvals[1][0] = true
+	if dealers := r.qualify(2); len(dealers) != 2 || dealers[0] != 0 || dealers[1] != 1 {
+		t.Fatal("dealers approved by a threshold not qualified:", dealers)
+	}
+}
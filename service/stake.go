@@ -0,0 +1,79 @@
+package service
+
+import (
+	"math/rand"
+
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber"
+)
+
+// Stake is the stake held by a node, identified by its public key
+type Stake struct {
+	Public kyber.Point
+	Amount uint64
+}
+
+// StakeRegistry holds the stake of the nodes. The chance of a block maker to
+// get a high rank in a round is proportional to its stake. Nodes missing from
+// the registry hold no stake and always rank last.
+type StakeRegistry []*Stake
+
+// Of returns the stake held by the node
+func (s StakeRegistry) Of(si *network.ServerIdentity) uint64 {
+	for _, stake := range s {
+		if stake.Public.Equal(si.Public) {
+			return stake.Amount
+		}
+	}
+	return 0
+}
+
+// Weights returns the weights of the block makers for the round of the given
+// randomness. Without stake registry every block maker has the same chance,
+// otherwise the chances follow the stakes of the block makers.
+func (c *Config) Weights(randomness int64) []int {
+	if len(c.Stakes) == 0 {
+		return Weights(c.BlockMakerNb, randomness)
+	}
+	makers := c.BlockMakerNodes()
+	stakes := make([]uint64, len(makers))
+	for i, si := range makers {
+		stakes[i] = c.Stakes.Of(si)
+	}
+	return StakeWeights(stakes, randomness)
+}
+
+// StakeWeights returns the weights of the block makers holding the given
+// stakes, between 1 and len(stakes) like Weights. Block makers are drawn one
+// after the other with a probability proportional to their stake, the first
+// one drawn getting the highest weight. The draws only depend on the
+// randomness so every node computes the same weights. Block makers without
+// stake are drawn uniformly once all the stake is exhausted.
+func StakeWeights(stakes []uint64, randomness int64) []int {
+	r := rand.New(rand.NewSource(randomness))
+	n := len(stakes)
+	weights := make([]int, n)
+	left := make([]int, n)
+	var total uint64
+	for i, s := range stakes {
+		left[i] = i
+		total += s
+	}
+	for w := n; w > 0; w-- {
+		pick := 0
+		if total > 0 {
+			// modulo bias is negligible for stakes far below 2^64
+			x := r.Uint64() % total
+			for pick = 0; x >= stakes[left[pick]]; pick++ {
+				x -= stakes[left[pick]]
+			}
+		} else {
+			pick = r.Intn(len(left))
+		}
+		owner := left[pick]
+		weights[owner] = w
+		total -= stakes[owner]
+		left = append(left[:pick], left[pick+1:]...)
+	}
+	return weights
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStakeWeights(t *testing.T) {
+	stakes := []uint64{1, 0, 3}
+	if !reflect.DeepEqual(StakeWeights(stakes, 42), StakeWeights(stakes, 42)) {
+		t.Fatal("weights not deterministic")
+	}
+	top := make([]int, len(stakes))
+	rounds := 4000
+	for i := 0; i < rounds; i++ {
+		weights := StakeWeights(stakes, int64(i))
+		seen := make(map[int]bool)
+		for owner, w := range weights {
+			if w < 1 || w > len(stakes) || seen[w] {
+				t.Fatal("invalid weights", weights)
+			}
+			seen[w] = true
+			if w == len(stakes) {
+				top[owner]++
+			}
+		}
+		if weights[1] != 1 {
+			t.Fatal("block maker without stake not ranked last")
+		}
+	}
+	if ratio := float64(top[2]) / float64(rounds); ratio < 0.7 || ratio > 0.8 {
+		t.Fatal("block maker with 3/4 of the stake ranked first", ratio, "of the time")
+	}
+}
@@ -1,9 +1,10 @@
 package service
 
 import (
-	"go.dedis.ch/kyber/share"
-	"go.dedis.ch/kyber/sign/tbls"
+	"time"
+
 	"github.com/csanti/onet/log"
+	"go.dedis.ch/kyber/sign/tbls"
 )
 
 // roundStorage keeps tracks of all received valid blocks for a given round and
@@ -27,18 +28,38 @@ type roundStorage struct {
 	notarizeds []*NotarizedBlock
 	// the finalizer
 	finalizer *Finalizer
+	// verifier shared by all blocks of the notarizer
+	verifier *sigVerifier
+	// time at which the round started
+	start time.Time
+	// partial signatures to skip this round mapped from their share index
+	skipSigs map[int][]byte
+	// true while the skip certificate is being recovered
+	skipRecovering bool
+	// true once this notarizer signed the skip of the round, it signs no
+	// block of the round from then on
+	skipSigned bool
+	// skip certificate of this round, if any
+	skipped *SkipCertificate
+	// runs a function under the lock of the notarizer owning this storage.
+	// Signatures are recovered outside of that lock and stored back through
+	// it. Everything runs inline when nil.
+	locked func(func())
 }
 
 // newRoundStorage returns a new round storage for the given round
-func newRoundStorage(c *Config, round int, randomness int64, f *Finalizer) *roundStorage {
+func newRoundStorage(c *Config, round int, randomness int64, f *Finalizer, v *sigVerifier) *roundStorage {
 	return &roundStorage{
 		c:                  c,
 		Round:              round,
 		blocks:             make(map[string]*blockStorage),
 		tmpSigs:            make(map[int][]*SignatureProposal),
 		randomness:         randomness,
-		weights:            Weights(c.BlockMakerNb, randomness),
+		weights:            c.Weights(randomness),
 		finalizer:          f,
+		verifier:           v,
+		start:              time.Now(),
+		skipSigs:           make(map[int][]byte),
 		maxWeightNotarized: -1,
 		maxWeightSig:       -1,
 	}
@@ -53,7 +74,7 @@ func (r *roundStorage) StoreBlockProposal(p *BlockProposal) {
 	storage, exists := r.blocks[hash]
 	if !exists {
 		b := Block(*p)
-		storage = newBlockStorage(r.c, &b)
+		storage = newBlockStorage(r.c, &b, r.verifier)
 		r.blocks[hash] = storage
 		return
 	}
@@ -72,22 +93,53 @@ func (r *roundStorage) StoreSignatureProposal(s *SignatureProposal) {
 	if !exists {
 		// first time we received something about this block
 		// so we sign it
-		block = newBlockStorage(r.c, s.Block)
+		block = newBlockStorage(r.c, s.Block, r.verifier)
 		r.blocks[h] = block
 		// it can't be notarized locally if its the first time we see this block
 		return
 	}
 
-	notarized, err := block.AddPartialSig(s.Partial)
+	sigs, err := block.AddPartialSig(s.Partial)
 	if err != nil {
 		log.Lvl2("signature error block: ", err)
 		return
 	}
-	if notarized != nil {
-		r.StoreNotarizedBlock(notarized)
+	if sigs != nil {
+		r.notarize(block, sigs)
 	}
 }
 
+// notarize recovers the notarization of the block out of the given partials
+// and stores the notarized block. Invalid partials are dropped and the
+// recovery starts again if enough are left.
+func (r *roundStorage) notarize(block *blockStorage, sigs map[int][]byte) {
+	r.unlocked(func() func() {
+		signature, invalids, err := block.verifier.Recover(block.block.BlockHeader.SigningMessage(), sigs)
+		return func() {
+			notarized, retry := block.recovered(signature, invalids, err)
+			switch {
+			case notarized != nil:
+				tracerOf(r.c).Event(EventThresholdReached, r.Round, notarized.Notarization.Hash)
+				r.StoreNotarizedBlock(notarized)
+			case retry != nil:
+				r.notarize(block, retry)
+			}
+		}
+	})
+}
+
+// unlocked runs work outside of the notarizer lock, then the function it
+// returns under the lock
+func (r *roundStorage) unlocked(work func() func()) {
+	if r.locked == nil {
+		work()()
+		return
+	}
+	go func() {
+		r.locked(work())
+	}()
+}
+
 // StoreNotarizedBlock stores the notarization for future retrieval
 func (r *roundStorage) StoreNotarizedBlock(n *NotarizedBlock) {
 	r.notarizeds = append(r.notarizeds, n)
@@ -118,16 +170,117 @@ func (r *roundStorage) IsNotarized() bool {
 	return len(r.notarizeds) > 0
 }
 
-// HighestSignature returns the siganture for the highest block possible seen so
+// IsSkipped returns true if this round has a skip certificate
+func (r *roundStorage) IsSkipped() bool {
+	return r.skipped != nil
+}
+
+// SkipProposal returns the partial signature of this node to skip the round,
+// and stores it
+func (r *roundStorage) SkipProposal() *SkipProposal {
+	r.skipSigned = true
+	sig, err := tbls.Sign(Suite, r.c.Share, SkipMessage(r.c.ChainID, r.Round))
+	if err != nil {
+		panic("this should not happen")
+	}
+	s := &SkipProposal{ChainID: r.c.ChainID, Round: r.Round, Partial: sig}
+	r.StoreSkipProposal(s)
+	return s
+}
+
+// CanSkip returns whether this notarizer can still sign the skip of the round,
+// i.e. it signed no block of the round. A notarizer never signs both, so
+// unless more notarizers than the threshold allows misbehave, a round can't
+// end up with both a notarized block and a skip certificate.
+func (r *roundStorage) CanSkip() bool {
+	return r.maxWeightSig < 0
+}
+
+// StoreSkipProposal stores the partial signature to skip the round. Once
+// enough of them are gathered, the skip certificate is recovered and stored.
+func (r *roundStorage) StoreSkipProposal(s *SkipProposal) {
+	if r.skipped != nil {
+		return
+	}
+	i, err := tbls.SigShare(s.Partial).Index()
+	if err != nil {
+		log.Lvl2("skip signature error: ", err)
+		return
+	}
+	r.skipSigs[i] = s.Partial
+	r.recoverSkip()
+}
+
+// recoverSkip recovers the skip certificate once enough partials are stored
+// and no recovery is running
+func (r *roundStorage) recoverSkip() {
+	if r.skipped != nil || r.skipRecovering || len(r.skipSigs) < r.c.Threshold {
+		return
+	}
+	r.skipRecovering = true
+	sigs := copySigs(r.skipSigs)
+	r.unlocked(func() func() {
+		signature, invalids, err := r.verifier.Recover(SkipMessage(r.c.ChainID, r.Round), sigs)
+		return func() {
+			r.skipRecovering = false
+			if err != nil {
+				for _, j := range invalids {
+					delete(r.skipSigs, j)
+				}
+				log.Lvl2("skip signature error: ", err)
+				if len(invalids) > 0 {
+					r.recoverSkip()
+				}
+				return
+			}
+			r.StoreSkipCertificate(&SkipCertificate{
+				ChainID:   r.c.ChainID,
+				Round:     r.Round,
+				Signature: signature,
+			})
+		}
+	})
+}
+
+// StoreSkipCertificate marks the round as skipped
+func (r *roundStorage) StoreSkipCertificate(s *SkipCertificate) {
+	if r.skipped != nil {
+		return
+	}
+	r.skipped = s
+	r.finalizer.StoreSkip(s)
+}
+
+// rank returns the rank of the block maker for this round, 0 being the highest
+func (r *roundStorage) rank(owner int) int {
+	return r.c.BlockMakerNb - r.weights[owner]
+}
+
+// eligible returns whether a block of the given owner can be signed yet. A
+// block of rank k is only signed BlockTime + k * RankDelay after the start of
+// the round, so lower ranked blocks only get notarized when the higher ranked
+// block makers are silent.
+func (r *roundStorage) eligible(owner int) bool {
+	wait := r.c.BlockTime + time.Duration(r.rank(owner))*r.c.RankDelay
+	return time.Since(r.start) >= wait
+}
+
+// HighestSignature returns the siganture for the highest eligible block seen so
 // far.
 func (r *roundStorage) HighestSignature() *SignatureProposal {
+	if r.skipSigned {
+		return nil
+	}
 	var maxWeight = r.maxWeightSig
 	var maxSig *SignatureProposal
 	for _, storage := range r.blocks {
 		//fmt.Printf("block owner: %d => weights: %v\n", storage.block.Owner, r.weights)
+		if !r.eligible(storage.block.BlockHeader.Owner) {
+			continue
+		}
 		w := r.weights[storage.block.BlockHeader.Owner]
 		//log.Lvlf1("block  %s: w: %d vs maxweight %d", storage.block.Hash(), w, maxWeight)
-		if maxWeight < w {
+		if maxWeight < w && r.validState(storage.block) {
 			maxWeight = w
 			maxSig = storage.SignatureProposal()
 			//log.Lvl1("notarizer partially signed ", storage.block.BlockHeader.Hash())
@@ -140,42 +293,55 @@ func (r *roundStorage) HighestSignature() *SignatureProposal {
 	return maxSig
 }
 
+// validState returns false if the block claims a wrong state root
+func (r *roundStorage) validState(b *Block) bool {
+	if r.finalizer == nil {
+		return true
+	}
+	if err := r.finalizer.CheckStateRoot(b); err != nil {
+		log.Lvl2("notarizer: not signing block:", err)
+		return false
+	}
+	return true
+}
+
 // blockStorage stores all information regarding a particular block and the
 // signatures received for this specific block. It is meant to only be used with
 // roundStorage.
 type blockStorage struct {
-	c         *Config // config used to recover the final signature
-	block     *Block
-	finalSig  []byte         // when notarization happenned
-	sigs      map[int][]byte // all signatures for the blob received so far
-	notarized bool           // true if already notarized
-	pub       *share.PubPoly
+	c          *Config // config used to recover the final signature
+	block      *Block
+	finalSig   []byte         // when notarization happenned
+	sigs       map[int][]byte // all signatures for the blob received so far
+	notarized  bool           // true if already notarized
+	recovering bool           // true while the final signature is recovered
+	verifier   *sigVerifier   // used to recover the final signature
 }
 
 // newBlockStorage returns a new storage for this block holding on all
 // signatures received so far
-func newBlockStorage(c *Config, b *Block) *blockStorage {
+func newBlockStorage(c *Config, b *Block, v *sigVerifier) *blockStorage {
 	return &blockStorage{
-		c:     c,
-		block: b,
-		sigs:  make(map[int][]byte),
-		pub:   share.NewPubPoly(G2, G2.Point().Base(), c.Public),
+		c:        c,
+		block:    b,
+		sigs:     make(map[int][]byte),
+		verifier: v,
 	}
 }
 
 // AddPartialSig appends a new tbls signature to the list of already received signature
-// for this block. It returns an error if the signature is invalid.
-func (b *blockStorage) AddPartialSig(s []byte) (*NotarizedBlock, error) {
+// for this block. Once the threshold is reached, it returns a copy of the
+// partials to recover the final signature from, outside of any lock. No other
+// copy is returned until the outcome is reported to recovered. Partial
+// signatures are expected to be verified already, unless the config asks for
+// optimistic verification: in that case invalid ones are only detected and
+// dropped by the recovery.
+func (b *blockStorage) AddPartialSig(s []byte) (map[int][]byte, error) {
 	if b.notarized {
 		// no need to store more sigs if we already have a notarized block
 		return nil, nil
 	}
 
-	err := tbls.Verify(Suite, b.pub, []byte(b.block.BlockHeader.Hash()), s)
-	if err != nil {
-		return nil, err
-	}
-
 	i, err := tbls.SigShare(s).Index()
 	if err != nil {
 		return nil, err
@@ -183,34 +349,51 @@ func (b *blockStorage) AddPartialSig(s []byte) (*NotarizedBlock, error) {
 
 	b.sigs[i] = s
 	// not enough yet signature to get the notarized block ready
-	if len(b.sigs) < b.c.Threshold {
+	if b.recovering || len(b.sigs) < b.c.Threshold {
 		return nil, nil
 	}
+	b.recovering = true
+	return copySigs(b.sigs), nil
+}
 
-	arr := make([][]byte, 0, b.c.Threshold)
-	for _, val := range b.sigs {
-		arr = append(arr, val)
-	}
-
-	hash := b.block.BlockHeader.Hash()
-	signature, err := tbls.Recover(Suite, b.pub, []byte(hash), arr, b.c.Threshold, b.c.N)
+// recovered takes the outcome of the recovery of the final signature. It
+// returns the notarized block on success. Otherwise the invalid partials are
+// dropped and, if enough partials are left, a copy of them is returned to try
+// again.
+func (b *blockStorage) recovered(signature []byte, invalids []int, err error) (*NotarizedBlock, map[int][]byte) {
+	b.recovering = false
 	if err != nil {
-		return nil, err
+		log.Lvl2("signature error block: ", err)
+		for _, j := range invalids {
+			delete(b.sigs, j)
+		}
+		if len(invalids) == 0 || len(b.sigs) < b.c.Threshold {
+			return nil, nil
+		}
+		b.recovering = true
+		return nil, copySigs(b.sigs)
 	}
 	b.notarized = true
 	return &NotarizedBlock{
 		Block: b.block,
 		Notarization: &Notarization{
-			Hash:      hash,
+			Hash:      b.block.BlockHeader.Hash(),
 			Signature: signature,
 		},
 	}, nil
+}
 
+func copySigs(sigs map[int][]byte) map[int][]byte {
+	c := make(map[int][]byte, len(sigs))
+	for i, s := range sigs {
+		c[i] = s
+	}
+	return c
 }
 
 // SignatureProposal returns the signature from this node for this block
 func (b *blockStorage) SignatureProposal() *SignatureProposal {
-	sig, err := tbls.Sign(Suite, b.c.Share, []byte(b.block.BlockHeader.Hash()))
+	sig, err := tbls.Sign(Suite, b.c.Share, b.block.BlockHeader.SigningMessage())
 	if err != nil {
 		panic("this should not happen")
 	}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"go.dedis.ch/kyber/sign/tbls"
+)
+
+func TestRoundStorageRankDelay(t *testing.T) {
+	c := &Config{BlockMakerNb: 3, BlockTime: 100 * time.Millisecond, RankDelay: 50 * time.Millisecond}
+	r := newRoundStorage(c, 1, 42, nil, nil)
+	owners := make([]int, c.BlockMakerNb) // owners sorted by rank
+	for owner := 0; owner < c.BlockMakerNb; owner++ {
+		owners[r.rank(owner)] = owner
+	}
+
+	r.start = time.Now().Add(-120 * time.Millisecond)
+	if !r.eligible(owners[0]) {
+		t.Fatal("rank 0 should be eligible after the block time")
+	}
+	if r.eligible(owners[1]) {
+		t.Fatal("rank 1 should wait one more delay")
+	}
+	r.start = time.Now().Add(-160 * time.Millisecond)
+	if !r.eligible(owners[1]) || r.eligible(owners[2]) {
+		t.Fatal("only ranks 0 and 1 should be eligible")
+	}
+	r.start = time.Now().Add(-210 * time.Millisecond)
+	if !r.eligible(owners[2]) {
+		t.Fatal("rank 2 should be eligible")
+	}
+}
+
+func TestBlockStorageRecovery(t *testing.T) {
+	n, threshold := 4, 2
+	shares, public := dkg(threshold, n)
+	_, commits := public.Info()
+	c := &Config{N: n, NotarizerNb: n, Threshold: threshold, Public: commits, OptimisticVerify: true}
+	b := newBlockStorage(c, &Block{BlockHeader: BlockHeader{Round: 1}}, newSigVerifier(c))
+	defer b.verifier.Close()
+	msg := b.block.BlockHeader.SigningMessage()
+	sign := func(i int, msg []byte) []byte {
+		sig, err := tbls.Sign(Suite, shares[i], msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+
+	if sigs, _ := b.AddPartialSig(sign(0, []byte("another message"))); sigs != nil {
+		t.Fatal("recovery requested below the threshold")
+	}
+	sigs, err := b.AddPartialSig(sign(1, msg))
+	if err != nil || len(sigs) != threshold {
+		t.Fatal("recovery not requested at the threshold", err)
+	}
+	if more, _ := b.AddPartialSig(sign(2, msg)); more != nil {
+		t.Fatal("recovery requested twice")
+	}
+
+	// the invalid partial is dropped and the recovery starts again
+	notarized, retry := b.recovered(b.verifier.Recover(msg, sigs))
+	if notarized != nil || len(retry) != threshold {
+		t.Fatal("recovery should be retried without the invalid partial")
+	}
+	if _, exists := retry[shares[0].I]; exists {
+		t.Fatal("invalid partial kept")
+	}
+	notarized, retry = b.recovered(b.verifier.Recover(msg, retry))
+	if notarized == nil || retry != nil {
+		t.Fatal("block not notarized")
+	}
+	if err := verifyThreshold(c, msg, notarized.Notarization.Signature); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundStorageBlockOrSkip(t *testing.T) {
+	shares, public := dkg(2, 3)
+	_, commits := public.Info()
+	c := &Config{ChainID: "skip", BlockMakerNb: 1, NotarizerNb: 3, Threshold: 2, Public: commits, Share: shares[0]}
+	block := &BlockProposal{BlockHeader: BlockHeader{ChainID: "skip", Round: 1}}
+
+	// a notarizer signing a block of the round can't sign its skip
+	r := newRoundStorage(c, 1, 42, nil, nil)
+	r.StoreBlockProposal(block)
+	if !r.CanSkip() {
+		t.Fatal("skip refused before signing any block")
+	}
+	if r.HighestSignature() == nil {
+		t.Fatal("block not signed")
+	}
+	if r.CanSkip() {
+		t.Fatal("skip allowed after signing a block")
+	}
+
+	// and the other way around
+	r = newRoundStorage(c, 1, 42, nil, nil)
+	r.StoreBlockProposal(block)
+	if s := r.SkipProposal(); s == nil || len(r.skipSigs) != 1 {
+		t.Fatal("skip not signed")
+	}
+	if r.HighestSignature() != nil {
+		t.Fatal("block signed after signing the skip")
+	}
+}
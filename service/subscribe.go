@@ -0,0 +1,187 @@
+package service
+
+import (
+	"errors"
+	"sync"
+)
+
+// SubscriptionBuffer is the number of events a subscriber can lag behind
+// before being dropped
+const SubscriptionBuffer = 256
+
+// ErrSlowSubscriber ends the subscriptions not keeping up with the chain. They
+// can subscribe again from the round of the last finalized block they got.
+var ErrSlowSubscriber = errors.New("subscription: subscriber too slow")
+
+// BlockEvent is sent to the subscribers each time a block gets notarized and
+// again when it gets finalized
+type BlockEvent struct {
+	Block     *NotarizedBlock
+	Finalized bool
+}
+
+// Subscription delivers the block events of a node in order. Finalized blocks
+// are delivered once each, in increasing rounds.
+type Subscription struct {
+	// C receives the events, it is closed when the subscription ends
+	C <-chan *BlockEvent
+
+	out  chan *BlockEvent
+	in   chan *BlockEvent // live events not forwarded yet
+	done chan struct{}
+	once sync.Once
+	err  error
+	subs *subscriptions
+}
+
+// subscriptions fans out the block events to all the subscribers
+type subscriptions struct {
+	sync.Mutex
+	all map[*Subscription]bool
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{all: make(map[*Subscription]bool)}
+}
+
+// publish sends the event to every subscriber without ever blocking. The
+// subscribers whose buffer is full are dropped.
+func (s *subscriptions) publish(ev *BlockEvent) {
+	s.Lock()
+	defer s.Unlock()
+	for sub := range s.all {
+		select {
+		case sub.in <- ev:
+		default:
+			delete(s.all, sub)
+			sub.end(ErrSlowSubscriber)
+		}
+	}
+}
+
+// Subscribe returns a subscription to the blocks notarized and finalized by
+// this node. With from >= 0, the finalized blocks from that round on are
+// replayed first, followed by the pending notarized blocks of those rounds.
+// Only blocks still held in memory or in the block store can be replayed.
+// With a negative from, only the new events are delivered.
+func (d *Dfinity) Subscribe(from int) *Subscription {
+	sub := &Subscription{
+		out:  make(chan *BlockEvent),
+		in:   make(chan *BlockEvent, SubscriptionBuffer),
+		done: make(chan struct{}),
+		subs: d.subs,
+	}
+	sub.C = sub.out
+	// register first so no event gets lost during the replay
+	d.subs.Lock()
+	d.subs.all[sub] = true
+	d.subs.Unlock()
+	go sub.run(d.finalizer(), from)
+	return sub
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.stop(nil)
+}
+
+// stop unregisters the subscription and ends it with the given error
+func (s *Subscription) stop(err error) {
+	s.subs.Lock()
+	delete(s.subs.all, s)
+	s.subs.Unlock()
+	s.end(err)
+}
+
+// Err returns why the subscription ended, nil if it was closed or is still
+// running
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *Subscription) end(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// run replays the blocks from the given round and forwards the live events,
+// skipping the finalized blocks and the notarized ones already replayed
+func (s *Subscription) run(f *Finalizer, from int) {
+	defer close(s.out)
+	last := -1 // round of the last finalized block delivered
+	// hashes of the pending blocks replayed, which may also be queued as live
+	// events, and their highest round
+	replayed := make(map[string]bool)
+	replayedRound := -1
+	if f != nil && from >= 0 {
+		next := from
+		for {
+			blocks, err := f.chain.Blocks(next, MaxBlocks)
+			if err != nil {
+				s.stop(err)
+				return
+			}
+			if len(blocks) == 0 {
+				break
+			}
+			for _, n := range blocks {
+				if !s.send(&BlockEvent{Block: n, Finalized: true}) {
+					return
+				}
+				last = n.Round
+			}
+			next = last + 1
+		}
+		for _, n := range f.Pending() {
+			if n.Round < from {
+				continue
+			}
+			if !s.send(&BlockEvent{Block: n}) {
+				return
+			}
+			replayed[n.Block.BlockHeader.Hash()] = true
+			if n.Round > replayedRound {
+				replayedRound = n.Round
+			}
+		}
+	}
+	for {
+		select {
+		case ev := <-s.in:
+			if ev.Finalized {
+				if ev.Block.Round <= last {
+					continue
+				}
+				last = ev.Block.Round
+				if last >= replayedRound {
+					// the live events caught up with the replay
+					replayed = nil
+				}
+			} else if hash := ev.Block.BlockHeader.Hash(); replayed[hash] {
+				delete(replayed, hash)
+				continue
+			}
+			if !s.send(ev) {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Subscription) send(ev *BlockEvent) bool {
+	select {
+	case s.out <- ev:
+		return true
+	case <-s.done:
+		return false
+	}
+}
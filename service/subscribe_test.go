@@ -0,0 +1,90 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscription(t *testing.T) {
+	g, f := testFinalizer("subscribe")
+	b1 := testBlock(1, 0, g.NotarizedBlock())
+	b2 := testBlock(2, 0, b1)
+	b3 := testBlock(3, 0, b2)
+	f.chain.Append(b1)
+	f.Store(b2)
+	d := &Dfinity{c: f.c, fin: f, subs: newSubscriptions()}
+	f.publish = d.subs.publish
+
+	sub := d.Subscribe(1)
+	slow := d.Subscribe(-1)
+	expect := func(b *NotarizedBlock, finalized bool) {
+		select {
+		case ev := <-sub.C:
+			if ev.Block != b || ev.Finalized != finalized {
+				t.Fatal("unexpected event for round", ev.Block.Round, "finalized", ev.Finalized)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no event for round", b.Round)
+		}
+	}
+	expect(b1, true)
+	expect(b2, false)
+	// notarized during the replay, already delivered
+	d.subs.publish(&BlockEvent{Block: b2})
+	f.Store(b3)
+	expect(b3, false)
+	// already replayed
+	d.subs.publish(&BlockEvent{Block: b1, Finalized: true})
+	d.subs.publish(&BlockEvent{Block: b2, Finalized: true})
+	expect(b2, true)
+
+	for i := 0; i < SubscriptionBuffer; i++ {
+		d.subs.publish(&BlockEvent{Block: b3})
+	}
+	for range slow.C {
+	}
+	if slow.Err() != ErrSlowSubscriber {
+		t.Fatal("slow subscriber not dropped")
+	}
+	sub.Close()
+	for range sub.C {
+	}
+	if sub.Err() != nil {
+		t.Fatal("closed subscription ended with", sub.Err())
+	}
+}
+
+func TestStreamBlocks(t *testing.T) {
+	g, f := testFinalizer("stream")
+	b1 := testBlock(1, 0, g.NotarizedBlock())
+	f.chain.Append(b1)
+	d := &Dfinity{c: f.c, fin: f, subs: newSubscriptions()}
+
+	out, closing, err := d.StreamBlocks(&SubscribeRequest{From: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reply := <-out:
+		if reply.Block != b1 || !reply.Finalized {
+			t.Fatal("wrong block streamed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no block streamed")
+	}
+	// the client goes away
+	close(closing)
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Fatal("block streamed after the client left")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream not closed")
+	}
+	d.subs.Lock()
+	defer d.subs.Unlock()
+	if len(d.subs.all) != 0 {
+		t.Fatal("subscription not closed with the stream")
+	}
+}
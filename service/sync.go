@@ -0,0 +1,145 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/csanti/onet/log"
+	"github.com/csanti/onet/network"
+)
+
+// FastSync brings this node up to date from the latest signed checkpoint of
+// the given node instead of replaying the chain from the genesis:
+//
+//   - the checkpoint is verified against the group key of the notarizers,
+//   - the application state is restored from the snapshot taken at the
+//     checkpoint and checked against its state root,
+//   - the blocks finalized since then and the pending notarized blocks are
+//     downloaded, verified and handed to the finalizer.
+//
+// Chains without checkpoints, i.e. with a zero CheckpointInterval, are
+// replayed from the genesis instead. The node then takes part in the protocol
+// from the next round on. Beacon nodes can't sync this way.
+func (d *Dfinity) FastSync(cl *Client, si *network.ServerIdentity) error {
+	s := d.current()
+	if s.c == nil {
+		return errors.New("dfinity: node not configured yet")
+	}
+	f := s.finalizer()
+	if s.beacon != nil || f == nil {
+		return errors.New("dfinity: no finalized chain to sync on this node")
+	}
+	ckpt, err := cl.Checkpoint(si, 0, s.c.Public)
+	if err != nil && s.c.CheckpointInterval > 0 {
+		return fmt.Errorf("dfinity: can't get checkpoint: %s", err)
+	}
+	cp := genesisCheckpoint(s.c.Genesis)
+	if err == nil {
+		cp = ckpt.Checkpoint
+	}
+	if cp.ChainID != s.c.ChainID {
+		return errors.New("dfinity: checkpoint of another chain")
+	}
+	var state []byte
+	if d.app != nil && ckpt != nil {
+		snap, err := cl.Snapshot(si, cp.Height)
+		if err != nil {
+			return fmt.Errorf("dfinity: can't get snapshot: %s", err)
+		}
+		if snap.Height != cp.Height || snap.Round != cp.Round {
+			return errors.New("dfinity: snapshot does not match the checkpoint")
+		}
+		state = snap.State
+	}
+	blocks, pending, err := d.fetchBlocks(cl, si, cp)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(cp, state, blocks, pending); err != nil {
+		return err
+	}
+	if s.fin != nil && s.fin != f {
+		// the finalizer of the callback follows the same chain
+		if err := s.fin.Sync(cp, state, blocks, pending); err != nil {
+			return err
+		}
+	}
+	if ckpt != nil {
+		if err := s.checkpoints.Add(ckpt); err != nil {
+			log.Lvl2("dfinity: can't keep checkpoint:", err)
+		}
+	}
+	if s.not != nil {
+		s.not.Resume()
+	}
+	return nil
+}
+
+// fetchBlocks downloads the finalized blocks from the checkpoint on, and the
+// pending notarized blocks. Finalized blocks must follow each other from the
+// one of the checkpoint, and all blocks must be notarized.
+func (d *Dfinity) fetchBlocks(cl *Client, si *network.ServerIdentity, cp *Checkpoint) ([]*NotarizedBlock, []*NotarizedBlock, error) {
+	var blocks, pending []*NotarizedBlock
+	from := cp.Round
+	for {
+		reply, err := cl.Blocks(si, from, MaxBlocks)
+		if err != nil {
+			return nil, nil, fmt.Errorf("dfinity: can't get blocks: %s", err)
+		}
+		for _, n := range reply.Blocks {
+			if len(blocks) == 0 {
+				// vouched for by the checkpoint, the genesis has no
+				// notarization
+				if n.Block == nil || n.BlockHeader.Hash() != cp.Hash {
+					return nil, nil, errors.New("dfinity: first block does not match the checkpoint")
+				}
+				blocks = append(blocks, n)
+				continue
+			}
+			if err := d.verifyNotarized(n); err != nil {
+				return nil, nil, fmt.Errorf("dfinity: block of round %d: %s", n.Round, err)
+			}
+			if prv := blocks[len(blocks)-1]; n.PrvHash != prv.BlockHeader.Hash() || n.Round <= prv.Round {
+				return nil, nil, fmt.Errorf("dfinity: block of round %d does not follow the chain", n.Round)
+			}
+			blocks = append(blocks, n)
+		}
+		pending = reply.Pending
+		if len(reply.Blocks) < MaxBlocks {
+			break
+		}
+		from = blocks[len(blocks)-1].Round + 1
+	}
+	if len(blocks) == 0 {
+		return nil, nil, errors.New("dfinity: no block at the checkpoint")
+	}
+	for _, n := range pending {
+		if err := d.verifyNotarized(n); err != nil {
+			return nil, nil, fmt.Errorf("dfinity: pending block of round %d: %s", n.Round, err)
+		}
+	}
+	return blocks, pending, nil
+}
+
+// genesisCheckpoint returns the checkpoint of the genesis block, the first one
+// of the chain
+func genesisCheckpoint(g *Genesis) *Checkpoint {
+	return &Checkpoint{ChainID: g.ChainID, Height: 1, Hash: g.Block().BlockHeader.Hash()}
+}
+
+// verifyNotarized checks the block is part of this chain, its blob matches its
+// header and the notarization is a valid threshold signature of the header
+func (d *Dfinity) verifyNotarized(n *NotarizedBlock) error {
+	c := d.current().c
+	switch {
+	case n.Block == nil || n.Notarization == nil:
+		return errors.New("incomplete notarized block")
+	case n.ChainID != c.ChainID:
+		return errors.New("wrong chain id")
+	case n.Root != rootHash(n.Blob):
+		return errors.New("blob does not match the header")
+	case n.Notarization.Hash != n.BlockHeader.Hash():
+		return errors.New("notarization of another block")
+	}
+	return verifyThreshold(c, n.BlockHeader.SigningMessage(), n.Notarization.Signature)
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/csanti/onet/log"
+)
+
+// Protocol events traced by the nodes
+const (
+	EventBeaconSent        = "beacon_sent"
+	EventBeaconReceived    = "beacon_received"
+	EventProposalSent      = "proposal_sent"
+	EventProposalReceived  = "proposal_received"
+	EventFirstPartialSent  = "first_partial_sent"
+	EventThresholdReached  = "threshold_reached"
+	EventNotarizedReceived = "notarized_received"
+	EventFinalized         = "finalized"
+	EventRoundStalled      = "round_stalled"
+	EventRoundSkipped      = "round_skipped"
+)
+
+// TraceEvent is one line of a trace file
+type TraceEvent struct {
+	Time  time.Time `json:"time"`
+	Node  int       `json:"node"`
+	Role  string    `json:"role"`
+	Round int       `json:"round"`
+	Event string    `json:"event"`
+	Block string    `json:"block,omitempty"` // hash of the block concerned
+}
+
+// Tracer writes the protocol events of a node as JSON lines. A nil tracer
+// discards everything so callers don't have to check whether tracing is on.
+type Tracer struct {
+	sync.Mutex
+	id   string // see nodeID
+	node int
+	role string
+	f    *os.File
+	enc  *json.Encoder
+}
+
+var tracersMut sync.Mutex
+
+// tracers of all nodes of this process mapped from their address, see nodeID
+var tracers = make(map[string]*Tracer)
+
+// tracerOf returns the tracer of the node the config belongs to, writing to
+// its file in the trace directory, see nodeFile. The node keeps its tracer
+// across reconfigurations, which update its index and role. It is nil if the
+// config gives no directory.
+func tracerOf(c *Config) *Tracer {
+	if c.TraceDir == "" {
+		return nil
+	}
+	tracersMut.Lock()
+	defer tracersMut.Unlock()
+	id := nodeID(c)
+	if t, exists := tracers[id]; exists {
+		if t != nil {
+			t.Lock()
+			t.node, t.role = c.Index, c.Role()
+			t.Unlock()
+		}
+		return t
+	}
+	path := filepath.Join(c.TraceDir, nodeFile(c)+".jsonl")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Error("trace: can't open", path, ":", err)
+		tracers[id] = nil
+		return nil
+	}
+	t := &Tracer{id: id, node: c.Index, role: c.Role(), f: f, enc: json.NewEncoder(f)}
+	tracers[id] = t
+	return t
+}
+
+// Event records the event for the given round and block hash, which can be
+// empty
+func (t *Tracer) Event(event string, round int, block string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.f == nil {
+		return
+	}
+	err := t.enc.Encode(&TraceEvent{
+		Time:  time.Now(),
+		Node:  t.node,
+		Role:  t.role,
+		Round: round,
+		Event: event,
+		Block: block,
+	})
+	if err != nil {
+		log.Error("trace:", err)
+	}
+}
+
+// Close closes the trace file. Events recorded afterwards are dropped and the
+// next tracer of the node opens the file again.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	tracersMut.Lock()
+	if tracers[t.id] == t {
+		delete(tracers, t.id)
+	}
+	tracersMut.Unlock()
+	t.Lock()
+	defer t.Unlock()
+	if t.f == nil {
+		return nil
+	}
+	err := t.f.Close()
+	t.f = nil
+	return err
+}
+
+// closeTracer closes the tracer of the node the config belongs to, if it has
+// one open
+func closeTracer(c *Config) error {
+	tracersMut.Lock()
+	t := tracers[nodeID(c)]
+	tracersMut.Unlock()
+	return t.Close()
+}
+
+// ReadTrace returns all the events of a trace file
+func ReadTrace(path string) ([]*TraceEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []*TraceEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e := new(TraceEvent)
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// Timeline returns the events of all nodes grouped by round, each round
+// sorted by time
+func Timeline(events []*TraceEvent) map[int][]*TraceEvent {
+	rounds := make(map[int][]*TraceEvent)
+	for _, e := range events {
+		rounds[e.Round] = append(rounds[e.Round], e)
+	}
+	for _, evs := range rounds {
+		sort.SliceStable(evs, func(i, j int) bool {
+			return evs[i].Time.Before(evs[j].Time)
+		})
+	}
+	return rounds
+}
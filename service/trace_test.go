@@ -0,0 +1,132 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/csanti/onet"
+	"github.com/csanti/onet/network"
+	"go.dedis.ch/kyber/util/random"
+)
+
+func TestTracer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Config{Index: 2, BeaconNb: 1, BlockMakerNb: 1, NotarizerNb: 1, TraceDir: dir}
+	tracer := tracerOf(c)
+	if tracer == nil || tracerOf(c) != tracer {
+		t.Fatal("tracer not kept for the node")
+	}
+	tracer.Event(EventBeaconReceived, 1, "")
+	tracer.Event(EventFinalized, 1, "abcd")
+	if err := closeTracer(c); err != nil {
+		t.Fatal(err)
+	}
+	// dropped once closed
+	tracer.Event(EventBeaconReceived, 2, "")
+	if err := tracer.Close(); err != nil {
+		t.Fatal("closing twice failed:", err)
+	}
+
+	path := filepath.Join(dir, "node-2.jsonl")
+	events, err := ReadTrace(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatal("expected 2 events, got", len(events))
+	}
+	if e := events[1]; e.Node != 2 || e.Role != c.Role() || e.Round != 1 || e.Event != EventFinalized || e.Block != "abcd" {
+		t.Fatal("wrong event read:", e)
+	}
+
+	// a new tracer of the node appends to the same file
+	reopened := tracerOf(c)
+	if reopened == tracer {
+		t.Fatal("closed tracer reused")
+	}
+	reopened.Event(EventBeaconReceived, 2, "")
+	reopened.Close()
+	if events, _ = ReadTrace(path); len(events) != 3 {
+		t.Fatal("expected 3 events after reopening, got", len(events))
+	}
+
+	ioutil.WriteFile(path, []byte("{\"round\": 1}\nnot json\n"), 0644)
+	if _, err := ReadTrace(path); err == nil {
+		t.Fatal("invalid trace read")
+	}
+	if _, err := ReadTrace(filepath.Join(dir, "missing.jsonl")); err == nil {
+		t.Fatal("missing trace read")
+	}
+	if tracerOf(&Config{}) != nil {
+		t.Fatal("tracer without directory")
+	}
+}
+
+func TestTracerReconfigured(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var list []*network.ServerIdentity
+	for i := 0; i < 3; i++ {
+		addr := network.Address(fmt.Sprintf("tcp://127.0.0.1:%d", 7400+i))
+		list = append(list, network.NewServerIdentity(G2.Point().Pick(random.New()), addr))
+	}
+	c := &Config{Roster: onet.NewRoster(list), Index: 0, BeaconNb: 1, BlockMakerNb: 1, NotarizerNb: 1, TraceDir: dir}
+	tracer := tracerOf(c)
+	defer tracer.Close()
+	tracer.Event(EventBeaconSent, 1, "")
+	// the beacon becomes the notarizer of a new roster
+	reconfigured := *c
+	reconfigured.Roster = onet.NewRoster([]*network.ServerIdentity{list[2], list[1], list[0]})
+	reconfigured.Index = 2
+	if tracerOf(&reconfigured) != tracer {
+		t.Fatal("reconfigured node got another tracer")
+	}
+	tracer.Event(EventFinalized, 2, "")
+	other := tracerOf(&Config{Roster: c.Roster, Index: 2, BeaconNb: 1, BlockMakerNb: 1, NotarizerNb: 1, TraceDir: dir})
+	defer other.Close()
+	if other == tracer {
+		t.Fatal("node at the former index of another one got its tracer")
+	}
+
+	events, err := ReadTrace(filepath.Join(dir, "node-tcp---127.0.0.1-7400.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Role != RoleBeacon || events[1].Role != RoleNotarizer || events[1].Node != 2 {
+		t.Fatal("wrong events of the reconfigured node:", events)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	events := []*TraceEvent{
+		{Time: at(30), Node: 1, Round: 1, Event: EventFinalized},
+		{Time: at(20), Node: 2, Round: 2, Event: EventBeaconReceived},
+		{Time: at(10), Node: 0, Round: 1, Event: EventBeaconSent},
+		{Time: at(20), Node: 1, Round: 1, Event: EventThresholdReached},
+		{Time: at(20), Node: 2, Round: 1, Event: EventNotarizedReceived},
+	}
+	rounds := Timeline(events)
+	if len(rounds) != 2 || len(rounds[1]) != 4 || len(rounds[2]) != 1 {
+		t.Fatal("events not grouped by round")
+	}
+	// sorted by time, ties keep the order of the input
+	order := []string{EventBeaconSent, EventThresholdReached, EventNotarizedReceived, EventFinalized}
+	for i, e := range rounds[1] {
+		if e.Event != order[i] {
+			t.Fatal("wrong event at", i, ":", e.Event)
+		}
+	}
+}
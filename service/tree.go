@@ -0,0 +1,147 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Status of the blocks in the block tree
+const (
+	TreeNotarized = "notarized" // notarized, not finalized yet
+	TreeFinalized = "finalized" // part of the finalized chain
+	TreeOrphaned  = "orphaned"  // notarized but left out of the finalized chain
+)
+
+// treeWindow is the number of rounds of the block tree kept by the finalizers
+// whose chain keeps all its blocks in memory
+const treeWindow = 1024
+
+// TreeNode is a notarized block of the block tree
+type TreeNode struct {
+	Hash    string
+	PrvHash string
+	Round   int
+	Owner   int
+	Weight  int // weight of the owner in the round, the highest ranks first
+	Status  string
+}
+
+// BlockTree is the tree of all the notarized blocks seen by a node, forks
+// included. Edges go from each block to the one its PrvHash references.
+type BlockTree struct {
+	Nodes []*TreeNode // sorted by round, then owner
+}
+
+// DOT returns the tree in the Graphviz format. Finalized blocks are filled,
+// orphaned ones are dashed.
+func (t *BlockTree) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph blocks {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	known := make(map[string]bool, len(t.Nodes))
+	for _, n := range t.Nodes {
+		known[n.Hash] = true
+	}
+	for _, n := range t.Nodes {
+		style := ""
+		switch n.Status {
+		case TreeFinalized:
+			style = ", style=filled"
+		case TreeOrphaned:
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(&b, "\t%q [label=\"round %d\\nowner %d\\nweight %d\\n%s\"%s];\n",
+			n.Hash, n.Round, n.Owner, n.Weight, n.Status, style)
+	}
+	for _, n := range t.Nodes {
+		if known[n.PrvHash] {
+			fmt.Fprintf(&b, "\t%q -> %q;\n", n.Hash, n.PrvHash)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// JSON returns the tree encoded in JSON
+func (t *BlockTree) JSON() ([]byte, error) {
+	return json.MarshalIndent(t, "", "  ")
+}
+
+// Tree returns the tree of the notarized blocks this finalizer has seen within
+// the last Retention rounds, or the last treeWindow rounds if the chain keeps
+// all its blocks
+func (f *Finalizer) Tree() *BlockTree {
+	f.Lock()
+	defer f.Unlock()
+	t := &BlockTree{Nodes: make([]*TreeNode, 0, len(f.tree))}
+	for _, n := range f.tree {
+		copied := *n
+		t.Nodes = append(t.Nodes, &copied)
+	}
+	sort.Slice(t.Nodes, func(i, j int) bool {
+		if t.Nodes[i].Round != t.Nodes[j].Round {
+			return t.Nodes[i].Round < t.Nodes[j].Round
+		}
+		return t.Nodes[i].Owner < t.Nodes[j].Owner
+	})
+	return t
+}
+
+// record adds the notarized block to the tree. Blocks of rounds already
+// finalized are orphaned right away.
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (f *Finalizer) record(n *NotarizedBlock) {
+	hash := n.Block.BlockHeader.Hash()
+	if _, exists := f.tree[hash]; exists || n.Round < f.treeLow {
+		return
+	}
+	var weight int
+	if n.Round > 0 {
+		weight = f.c.Weights(n.Randomness)[n.Owner]
+	}
+	status := TreeNotarized
+	if n.Round <= f.treeFinal {
+		status = TreeOrphaned
+	}
+	f.tree[hash] = &TreeNode{
+		Hash:    hash,
+		PrvHash: n.PrvHash,
+		Round:   n.Round,
+		Owner:   n.Owner,
+		Weight:  weight,
+		Status:  status,
+	}
+	f.treeRounds[n.Round] = append(f.treeRounds[n.Round], hash)
+}
+
+// recordFinalized marks the block as finalized and the blocks left out since
+// the last finalized one as orphaned. Rounds out of the window of the tree are
+// forgotten.
+// ONLY CALLED WHEN CALLER HAVE THE LOCK
+func (f *Finalizer) recordFinalized(b *NotarizedBlock) {
+	f.record(b)
+	final := b.Block.BlockHeader.Hash()
+	for round := f.treeFinal; round <= b.Round; round++ {
+		for _, hash := range f.treeRounds[round] {
+			n := f.tree[hash]
+			switch {
+			case hash == final:
+				n.Status = TreeFinalized
+			case n.Status == TreeNotarized:
+				n.Status = TreeOrphaned
+			}
+		}
+	}
+	f.treeFinal = b.Round
+	window := f.c.Retention
+	if window <= 0 {
+		window = treeWindow
+	}
+	for ; f.treeLow <= b.Round-window; f.treeLow++ {
+		for _, hash := range f.treeRounds[f.treeLow] {
+			delete(f.tree, hash)
+		}
+		delete(f.treeRounds, f.treeLow)
+	}
+}
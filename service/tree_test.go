@@ -0,0 +1,78 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBlockTree(t *testing.T) {
+	g, f := testFinalizer("tree")
+	b1, fork := testBlock(1, 0, g.NotarizedBlock()), testBlock(1, 1, g.NotarizedBlock())
+	f.Store(b1)
+	f.Store(fork)
+	f.Store(testBlock(2, 0, b1))
+	f.Lock()
+	f.recordFinalized(b1)
+	f.Unlock()
+
+	tree := f.Tree()
+	if len(tree.Nodes) != 4 {
+		t.Fatal("expected 4 blocks in the tree, got", len(tree.Nodes))
+	}
+	status := make(map[string]string)
+	for _, n := range tree.Nodes {
+		status[n.Hash] = n.Status
+	}
+	if status[b1.BlockHeader.Hash()] != TreeFinalized || status[fork.BlockHeader.Hash()] != TreeOrphaned {
+		t.Fatal("wrong status of the blocks of round 1")
+	}
+	if tree.Nodes[3].Round != 2 || tree.Nodes[3].Status != TreeNotarized {
+		t.Fatal("block of round 2 should still be pending")
+	}
+
+	dot := tree.DOT()
+	if !strings.Contains(dot, `"`+fork.BlockHeader.Hash()+`" -> "`+g.Block().BlockHeader.Hash()+`"`) {
+		t.Fatal("missing edge of the fork in", dot)
+	}
+	js, err := tree.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(BlockTree)
+	if err := json.Unmarshal(js, decoded); err != nil || len(decoded.Nodes) != 4 {
+		t.Fatal("tree not encoded correctly", err)
+	}
+}
+
+func TestBlockTreeWindow(t *testing.T) {
+	g, f := testFinalizer("window")
+	f.c.Retention = 3
+	f.Lock()
+	defer f.Unlock()
+	parent := g.NotarizedBlock()
+	var fork *NotarizedBlock
+	for round := 1; round <= 10; round++ {
+		b := testBlock(round, 0, parent)
+		f.record(b)
+		if round == 9 {
+			fork = testBlock(round, 1, parent)
+		}
+		f.recordFinalized(b)
+		parent = b
+	}
+	if len(f.tree) != 3 || len(f.treeRounds) != 3 {
+		t.Fatal("tree keeps", len(f.tree), "blocks out of the window")
+	}
+	for _, n := range f.tree {
+		if n.Round <= 7 || n.Status != TreeFinalized {
+			t.Fatal("wrong block kept in the tree:", n.Round, n.Status)
+		}
+	}
+	// a fork of a finalized round arriving late is orphaned, an old one dropped
+	f.record(fork)
+	f.record(testBlock(2, 1, g.NotarizedBlock()))
+	if n := f.tree[fork.BlockHeader.Hash()]; n == nil || n.Status != TreeOrphaned || len(f.tree) != 4 {
+		t.Fatal("late fork not orphaned")
+	}
+}
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/share"
+	"go.dedis.ch/kyber/sign/bls"
+	"go.dedis.ch/kyber/sign/tbls"
+)
+
+// defaultVerifyWorkers is the size of the verification pool used when the
+// config does not give one
+const defaultVerifyWorkers = 4
+
+// sigVerifier checks the tbls partial signatures sent by the notarizers. The
+// public polynomial is built once and each public share is only evaluated the
+// first time its index shows up. Pairings run on a pool of workers so they
+// happen outside of the notarizer lock.
+type sigVerifier struct {
+	sync.Mutex
+	c      *Config
+	pub    *share.PubPoly
+	shares map[int]kyber.Point // cached public shares per notarizer index
+	jobs   chan func()
+	// closed to stop the workers
+	quit      chan struct{}
+	closeOnce *sync.Once
+	// counts the invalid partial signatures
+	metrics *Metrics
+}
+
+// newSigVerifier returns a verifier for the notarizers' public polynomial of
+// the given config and starts its workers
+func newSigVerifier(c *Config) *sigVerifier {
+	workers := c.VerifyWorkers
+	if workers <= 0 {
+		workers = defaultVerifyWorkers
+	}
+	v := &sigVerifier{
+		c:         c,
+		pub:       share.NewPubPoly(G2, G2.Point().Base(), c.Public),
+		shares:    make(map[int]kyber.Point),
+		jobs:      make(chan func(), workers*16),
+		quit:      make(chan struct{}),
+		closeOnce: new(sync.Once),
+		metrics:   metricsOf(c),
+	}
+	for i := 0; i < workers; i++ {
+		go v.worker()
+	}
+	return v
+}
+
+func (v *sigVerifier) worker() {
+	for {
+		select {
+		case job := <-v.jobs:
+			job()
+		case <-v.quit:
+			return
+		}
+	}
+}
+
+// Close stops the workers. Jobs submitted afterwards are dropped.
+func (v *sigVerifier) Close() {
+	v.closeOnce.Do(func() {
+		close(v.quit)
+	})
+}
+
+// PubShare returns the public share of the notarizer at index i
+func (v *sigVerifier) PubShare(i int) kyber.Point {
+	v.Lock()
+	defer v.Unlock()
+	p, exists := v.shares[i]
+	if !exists {
+		p = v.pub.Eval(i).V
+		v.shares[i] = p
+	}
+	return p
+}
+
+// forKey returns a verifier of the notarizers' key given by the config, after
+// it got reshared. It runs on the workers of v and gets closed along with it.
+func (v *sigVerifier) forKey(c *Config) *sigVerifier {
+	return &sigVerifier{
+		c:         c,
+		pub:       share.NewPubPoly(G2, G2.Point().Base(), c.Public),
+		shares:    make(map[int]kyber.Point),
+		jobs:      v.jobs,
+		quit:      v.quit,
+		closeOnce: v.closeOnce,
+		metrics:   v.metrics,
+	}
+}
+
+// Verify checks a single partial signature over msg
+func (v *sigVerifier) Verify(msg, sig []byte) error {
+	defer v.timed(time.Now())
+	s := tbls.SigShare(sig)
+	i, err := s.Index()
+	if err != nil {
+		return err
+	}
+	if i < 0 || i >= v.c.NotarizerNb {
+		return fmt.Errorf("invalid share index %d", i)
+	}
+	return bls.Verify(Suite, v.PubShare(i), msg, s.Value())
+}
+
+// VerifyThreshold checks a threshold signature over msg against the group key
+func (v *sigVerifier) VerifyThreshold(msg, sig []byte) error {
+	defer v.timed(time.Now())
+	return bls.Verify(Suite, v.pub.Commit(), msg, sig)
+}
+
+// Submit verifies the partial signature on the worker pool and calls fn with
+// the result. It blocks when the pool is saturated, and drops the job once the
+// verifier is closed.
+func (v *sigVerifier) Submit(msg, sig []byte, fn func(error)) {
+	job := func() {
+		err := v.Verify(msg, sig)
+		if err != nil {
+			v.metrics.InvalidSigs.Inc()
+		}
+		fn(err)
+	}
+	select {
+	case v.jobs <- job:
+	case <-v.quit:
+	}
+}
+
+// Recover reconstructs the threshold signature over msg out of the given
+// partials, indexed by share index, without checking them first. Only when
+// the recovered signature does not verify against the group key, every
+// partial is checked on its own and the indexes of the invalid ones are
+// returned along with the error.
+func (v *sigVerifier) Recover(msg []byte, sigs map[int][]byte) ([]byte, []int, error) {
+	pubShares := make([]*share.PubShare, 0, len(sigs))
+	for i, sig := range sigs {
+		point := Suite.G1().Point()
+		if err := point.UnmarshalBinary(tbls.SigShare(sig).Value()); err != nil {
+			return nil, []int{i}, err
+		}
+		pubShares = append(pubShares, &share.PubShare{I: i, V: point})
+	}
+	start := time.Now()
+	commit, err := share.RecoverCommit(Suite.G1(), pubShares, v.c.Threshold, v.c.N)
+	if err == nil {
+		signature, err := commit.MarshalBinary()
+		if err == nil && bls.Verify(Suite, v.pub.Commit(), msg, signature) == nil {
+			v.timed(start)
+			return signature, nil, nil
+		}
+	}
+	v.timed(start)
+
+	// optimistic recovery failed, look for the culprits
+	var invalids []int
+	for i, err := range v.verifyEach(msg, sigs) {
+		if err != nil {
+			invalids = append(invalids, i)
+		}
+	}
+	if len(invalids) == 0 {
+		return nil, nil, errors.New("recovered signature is invalid")
+	}
+	v.metrics.InvalidSigs.Add(float64(len(invalids)))
+	return nil, invalids, fmt.Errorf("%d invalid partial signatures", len(invalids))
+}
+
+// verifyThreshold checks a threshold signature over msg against the group key
+// of the config, for the nodes which don't run a verifier
+func verifyThreshold(c *Config, msg, sig []byte) error {
+	pub := share.NewPubPoly(G2, G2.Point().Base(), c.Public)
+	return bls.Verify(Suite, pub.Commit(), msg, sig)
+}
+
+// verifySkip checks the skip certificate belongs to the chain of the config and
+// carries the threshold signature of the notarizers
+func verifySkip(c *Config, s *SkipCertificate) error {
+	if s.ChainID != c.ChainID {
+		return errors.New("skip certificate of another chain")
+	}
+	return verifyThreshold(c, SkipMessage(s.ChainID, s.Round), s.Signature)
+}
+
+// timed accounts for the time spent verifying since start
+func (v *sigVerifier) timed(start time.Time) {
+	v.metrics.Verified(time.Since(start))
+}
+
+// verifyEach checks all partial signatures in parallel and returns the
+// failures mapped from their share index. It does not go through the worker
+// pool since it can be called from a worker itself.
+func (v *sigVerifier) verifyEach(msg []byte, sigs map[int][]byte) map[int]error {
+	var mut sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[int]error)
+	for i, sig := range sigs {
+		wg.Add(1)
+		go func(i int, sig []byte) {
+			defer wg.Done()
+			if err := v.Verify(msg, sig); err != nil {
+				mut.Lock()
+				errs[i] = err
+				mut.Unlock()
+			}
+		}(i, sig)
+	}
+	wg.Wait()
+	return errs
+}
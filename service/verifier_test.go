@@ -0,0 +1,88 @@
+package service
+
+import (
+	"testing"
+
+	"go.dedis.ch/kyber/sign/bls"
+	"go.dedis.ch/kyber/sign/tbls"
+)
+
+func TestSigVerifierRecover(t *testing.T) {
+	n := 5
+	threshold := 3
+	shares, public := dkg(threshold, n)
+	_, commits := public.Info()
+	c := &Config{
+		N:           n,
+		NotarizerNb: n,
+		Threshold:   threshold,
+		Public:      commits,
+	}
+	v := newSigVerifier(c)
+	defer v.Close()
+	msg := []byte("block header hash")
+
+	sigs := make(map[int][]byte)
+	for _, s := range shares[:threshold] {
+		sig, err := tbls.Sign(Suite, s, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Verify(msg, sig); err != nil {
+			t.Fatal(err)
+		}
+		sigs[s.I] = sig
+	}
+	signature, invalids, err := v.Recover(msg, sigs)
+	if err != nil || len(invalids) != 0 {
+		t.Fatal("optimistic recovery failed", err, invalids)
+	}
+	if err := bls.Verify(Suite, public.Commit(), msg, signature); err != nil {
+		t.Fatal(err)
+	}
+
+	// a partial signed over another message must be caught by the fallback
+	wrong, err := tbls.Sign(Suite, shares[0], []byte("another message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(msg, wrong); err == nil {
+		t.Fatal("invalid partial signature accepted")
+	}
+	sigs[shares[0].I] = wrong
+	_, invalids, err = v.Recover(msg, sigs)
+	if err == nil {
+		t.Fatal("recovery with an invalid partial should fail")
+	}
+	if len(invalids) != 1 || invalids[0] != shares[0].I {
+		t.Fatal("wrong invalid partials reported:", invalids)
+	}
+}
+
+func TestVerifySkip(t *testing.T) {
+	shares, public := dkg(2, 3)
+	_, commits := public.Info()
+	c := &Config{ChainID: "skip", Public: commits, Threshold: 2}
+	msg := SkipMessage("skip", 4)
+	var sigs [][]byte
+	for _, s := range shares[:2] {
+		sig, err := tbls.Sign(Suite, s, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs = append(sigs, sig)
+	}
+	sig, err := tbls.Recover(Suite, public, msg, sigs, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySkip(c, &SkipCertificate{ChainID: "skip", Round: 4, Signature: sig}); err != nil {
+		t.Fatal(err)
+	}
+	if verifySkip(c, &SkipCertificate{ChainID: "skip", Round: 5, Signature: sig}) == nil {
+		t.Fatal("skip certificate of another round accepted")
+	}
+	if verifySkip(c, &SkipCertificate{ChainID: "other", Round: 4, Signature: sig}) == nil {
+		t.Fatal("skip certificate of another chain accepted")
+	}
+}
@@ -1,13 +1,21 @@
 package simulation
 
 import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/csanti/dfinity_experiments/ledger"
 	dfinity "github.com/csanti/dfinity_experiments/service"
 	"github.com/csanti/onet"
 	"github.com/csanti/onet/log"
 	"github.com/csanti/onet/simul/monitor"
+	"go.dedis.ch/kyber"
+	"go.dedis.ch/kyber/util/key"
 )
 
 // Name is the name of the simulation
@@ -20,20 +28,56 @@ func init() {
 // config being passed down to all nodes, each one takes the relevant
 // information
 type config struct {
+	ChainID      string
 	Seed         int64
 	BeaconNb     int
 	BlockMakerNb int
 	NotarizerNb  int
 	Threshold    int
 	BlockSize    int
-	BlockTime    int
+	BlockTime    int // milliseconds, as all the durations below
 	FinalizeTime int
+	// liveness: extra wait per rank before notarizers sign lower ranked
+	// blocks, and time after which a round is reported stalled
+	RankDelay    int
+	RoundTimeout int
+	// time after which notarizers vote to skip a round without block
+	SkipTimeout int
+	// time block makers wait per rank before proposing
+	ProposalDelay int
+	// time without progress after which the beacon resends its last beacon
+	BeaconResend int
+	// verification of partial signatures
+	VerifyWorkers    int
+	OptimisticVerify bool
+	// application running on every node and number of transactions
+	// submitted each round
+	Application string
+	TxPerRound  int
+	// address on which each node exports its metrics
+	MetricsAddr string
+	// directory where each node writes its protocol events
+	TraceDir string
+	// finalized blocks kept in memory and directory for the older ones
+	Retention int
+	BlockDir  string
+	// finalized blocks between two signed checkpoints
+	CheckpointInterval int
+	// rounds between two resharings of the notarizers' key
+	ReshareEpoch int
+	// stake of each block maker, all equal if empty
+	Stakes []uint64
+	// directory where the root node writes its tree of notarized blocks at
+	// the end of the run, as tree.dot and tree.json
+	TreeDir string
 }
 
 // Simulation runs a simulated version of the dfinity blockchain
 type Simulation struct {
 	onet.SimulationBFTree
 	config
+	// accounts funded in the genesis when running the ledger
+	accounts []*key.Pair
 }
 
 // NewSimulation returns a dfinity simulation out of the given config
@@ -53,28 +97,57 @@ func (s *Simulation) Setup(dir string, hosts []string) (*onet.SimulationConfig,
 
 func (s *Simulation) DistributeConfig(config *onet.SimulationConfig) {
 	shares, public := dkg(s.Threshold, s.NotarizerNb)
-	n := len(config.Roster.List)
 	notIndex := s.BeaconNb + s.BlockMakerNb
 	_, commits := public.Info()
-	for i, si := range config.Roster.List {
-		c := &dfinity.Config{
-			Seed:         s.Seed,
-			Roster:       config.Roster,
-			Index:        i,
-			N:            n,
-			BeaconNb:     s.BeaconNb,
-			BlockMakerNb: s.BlockMakerNb,
-			NotarizerNb:  s.NotarizerNb,
-			Threshold:    s.Threshold,
-			BlockSize:    s.BlockSize,
-			BlockTime:    s.BlockTime,
-			FinalizeTime: s.FinalizeTime,
-			Public:       commits,
-			RoundsToSimulate: s.Rounds,
+	genesis := &dfinity.Genesis{
+		ChainID:      s.ChainID,
+		Time:         time.Now(),
+		Roster:       config.Roster,
+		BeaconNb:     s.BeaconNb,
+		BlockMakerNb: s.BlockMakerNb,
+		NotarizerNb:  s.NotarizerNb,
+		Threshold:    s.Threshold,
+		Public:       commits,
+		BeaconSeed:   s.Seed,
+	}
+	for i, amount := range s.Stakes {
+		if i >= s.BlockMakerNb {
+			break
 		}
+		si := config.Roster.List[s.BeaconNb+i]
+		genesis.Stakes = append(genesis.Stakes, &dfinity.Stake{Public: si.Public, Amount: amount})
+	}
+	if s.Application == ledger.Name {
+		genesis.AppState = s.ledgerGenesis()
+	}
+	for i, si := range config.Roster.List {
+		c := genesis.Config(i)
+		c.BlockSize = s.BlockSize
+		c.BlockTime = ms(s.BlockTime)
+		c.FinalizeTime = ms(s.FinalizeTime)
+		c.RankDelay = ms(s.RankDelay)
+		c.RoundTimeout = ms(s.RoundTimeout)
+		c.SkipTimeout = ms(s.SkipTimeout)
+		c.ProposalDelay = ms(s.ProposalDelay)
+		c.BeaconResend = ms(s.BeaconResend)
+		c.RoundsToSimulate = s.Rounds
+		c.VerifyWorkers = s.VerifyWorkers
+		c.OptimisticVerify = s.OptimisticVerify
+		c.Application = s.Application
+		c.MetricsAddr = s.MetricsAddr
+		c.TraceDir = s.TraceDir
+		c.Retention = s.Retention
+		c.BlockDir = s.BlockDir
+		c.CheckpointInterval = s.CheckpointInterval
+		c.ReshareEpoch = s.ReshareEpoch
+		c.Monitor = true
 		if i >= notIndex {
 			c.Share = shares[i-notIndex]
 		}
+		c.SetDefaults()
+		if err := c.Validate(); err != nil {
+			log.Fatal("simulation: invalid config for node", i, ":", err)
+		}
 		if i == 0 {
 			config.GetService(dfinity.Name).(*dfinity.Dfinity).SetConfig(c)
 		} else {
@@ -102,12 +175,14 @@ func (s *Simulation) Run(config *onet.SimulationConfig) error {
 			done <- true
 		} else {
 			fullRound = monitor.NewTimeMeasure("fullRound")
+			s.submitTxs(dfinity, round)
 		}
 	}
 
 	dfinity.AttachCallback(newRoundCb)
 	fullTime := monitor.NewTimeMeasure("finalizing")
 	fullRound = monitor.NewTimeMeasure("fullRound")
+	s.submitTxs(dfinity, 0)
 	dfinity.Start()
 	select {
 	case <-done:
@@ -117,6 +192,10 @@ func (s *Simulation) Run(config *onet.SimulationConfig) error {
 
 	}
 	fullTime.Record()
+	s.writeTree(dfinity)
+	if err := dfinity.Close(); err != nil {
+		log.Error("simulation: can't close the node:", err)
+	}
 	monitor.RecordSingleMeasure("blocks", float64(roundDone))
 	monitor.RecordSingleMeasure("avgRound", fullTime.Wall.Value / float64(s.Rounds))
 	log.Lvl1(" ---------------------------")
@@ -127,3 +206,96 @@ func (s *Simulation) Run(config *onet.SimulationConfig) error {
 	log.Lvl1(" ---------------------------")
 	return nil
 }
+
+// writeTree writes the tree of notarized blocks of the node in TreeDir, if set
+func (s *Simulation) writeTree(d *dfinity.Dfinity) {
+	if s.TreeDir == "" {
+		return
+	}
+	t := d.BlockTree()
+	if t == nil {
+		return
+	}
+	if err := os.MkdirAll(s.TreeDir, 0755); err != nil {
+		log.Error("simulation: can't write tree:", err)
+		return
+	}
+	js, err := t.JSON()
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(s.TreeDir, "tree.json"), js, 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(s.TreeDir, "tree.dot"), []byte(t.DOT()), 0644)
+	}
+	if err != nil {
+		log.Error("simulation: can't write tree:", err)
+	}
+}
+
+// ms returns the duration of the given number of milliseconds
+func ms(i int) time.Duration {
+	return time.Duration(i) * time.Millisecond
+}
+
+// ledgerGenesis creates TxPerRound accounts and funds them
+func (s *Simulation) ledgerGenesis() []byte {
+	s.accounts = make([]*key.Pair, s.TxPerRound)
+	pubs := make([]kyber.Point, s.TxPerRound)
+	balances := make([]uint64, s.TxPerRound)
+	for i := range s.accounts {
+		s.accounts[i] = key.NewKeyPair(ledger.Suite)
+		pubs[i] = s.accounts[i].Public
+		balances[i] = 1 << 40
+	}
+	state, err := ledger.GenesisState(pubs, balances)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return state
+}
+
+// submitTxs sends TxPerRound transactions of the configured application to the
+// block makers
+func (s *Simulation) submitTxs(d *dfinity.Dfinity, round int) {
+	switch s.Application {
+	case dfinity.KVStoreName:
+		s.submitKVTxs(d, round)
+	case ledger.Name:
+		s.submitTransfers(d)
+	}
+}
+
+// submitTransfers makes every account send one token to the next one, using
+// the nonce of its account as executed by the local node
+func (s *Simulation) submitTransfers(d *dfinity.Dfinity) {
+	l, ok := d.Application().(*ledger.Ledger)
+	if !ok {
+		return
+	}
+	for i, from := range s.accounts {
+		to := s.accounts[(i+1)%len(s.accounts)]
+		buff, _ := from.Public.MarshalBinary()
+		t, err := ledger.NewTransfer(from.Private, to.Public, 1, l.Account(buff).Nonce)
+		if err != nil {
+			log.Error("simulation: can't sign transfer:", err)
+			continue
+		}
+		if err := d.SubmitTx(t.Encode()); err != nil {
+			log.Lvl2("simulation: transfer refused:", err)
+		}
+	}
+}
+
+func (s *Simulation) submitKVTxs(d *dfinity.Dfinity, round int) {
+	for i := 0; i < s.TxPerRound; i++ {
+		tx := &dfinity.KVTx{
+			Op:    dfinity.KVSet,
+			Nonce: rand.Uint64(),
+			Key:   []byte(fmt.Sprintf("key-%d", rand.Intn(s.TxPerRound*10))),
+			Value: []byte(fmt.Sprintf("round-%d", round)),
+		}
+		if err := d.SubmitTx(tx.Encode()); err != nil {
+			log.Error("simulation: can't submit transaction:", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// sweep runs the dfinity simulation over a matrix of parameters and
+// aggregates the results in one CSV file. A sweep file looks like:
+//
+//	Base = "localhost.toml"   # simulation file giving the fixed parameters
+//	Output = "sweep.csv"      # aggregated results
+//
+//	[Sweep]
+//	BlockSize = [100000, 500000, 1000000]
+//	BlockTime = "500:2000:500"    # range start:end:step, end included
+//	NotarizerNb = [10, 20]
+//	Threshold = 6
+//
+// Every combination of values is one run. The number of hosts is derived from
+// the role counts and runs with a threshold above the number of notarizers are
+// skipped. Runs already in the output file are skipped too, so an interrupted
+// sweep can simply be restarted.
+//
+//	sweep -simul ./simul -platform localhost sweep.toml
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"github.com/csanti/onet/log"
+)
+
+type sweepFile struct {
+	Base   string
+	Output string
+	Sweep  map[string]interface{}
+}
+
+func main() {
+	simul := flag.String("simul", "./simul", "simulation binary")
+	platform := flag.String("platform", "localhost", "onet platform to run on")
+	workDir := flag.String("dir", "sweep", "directory for the generated simulation files")
+	results := flag.String("results", "test_data", "directory where onet writes the results")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("usage: sweep [flags] sweep.toml")
+	}
+
+	sf := new(sweepFile)
+	if _, err := toml.DecodeFile(flag.Arg(0), sf); err != nil {
+		log.Fatal(err)
+	}
+	var params []*param
+	swept := make(map[string]bool)
+	for name, v := range sf.Sweep {
+		p, err := parseParam(name, v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		params = append(params, p)
+		swept[name] = true
+	}
+	base, err := os.Open(filepath.Join(filepath.Dir(flag.Arg(0)), sf.Base))
+	if err != nil {
+		log.Fatal(err)
+	}
+	header, values, err := baseHeader(base, swept)
+	base.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	runs := expand(params)
+	names := make([]string, 0, len(swept))
+	for name := range swept {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res, err := openResults(sf.Output, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(*workDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	for i, r := range runs {
+		key := r.key(names)
+		if res.done[key] {
+			log.Lvl1("run", i+1, "/", len(runs), "(", key, ") already done")
+			continue
+		}
+		if err := r.valid(values); err != nil {
+			log.Lvl1("run", i+1, "/", len(runs), "(", key, ") skipped:", err)
+			continue
+		}
+		content := simulationFile(header, r, r.hosts(values))
+		h := sha256.Sum256([]byte(content))
+		name := "sweep_" + hex.EncodeToString(h[:6])
+		path := filepath.Join(*workDir, name+".toml")
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			log.Fatal(err)
+		}
+		log.Lvl1("run", i+1, "/", len(runs), "(", key, ") =>", path)
+		cmd := exec.Command(*simul, "-platform", *platform, path)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Error("run", key, "failed:", err)
+			continue
+		}
+		if err := res.add(r, filepath.Join(*results, name+".csv")); err != nil {
+			log.Error("run", key, ":", err)
+		}
+	}
+}
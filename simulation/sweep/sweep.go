@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sweepable are the simulation parameters that can be given as lists or
+// ranges
+var sweepable = map[string]bool{
+	"BlockSize":     true,
+	"BlockTime":     true,
+	"FinalizeTime":  true,
+	"Threshold":     true,
+	"BeaconNb":      true,
+	"BlockMakerNb":  true,
+	"NotarizerNb":   true,
+	"RankDelay":     true,
+	"ProposalDelay": true,
+}
+
+// param is one swept parameter with all its values
+type param struct {
+	Name   string
+	Values []int
+}
+
+// run is one point of the matrix: a value for every swept parameter
+type run map[string]int
+
+// parseParam reads the values of a parameter given either as a single integer,
+// a list of integers or a range "start:end:step" with end included
+func parseParam(name string, v interface{}) (*param, error) {
+	if !sweepable[name] {
+		return nil, fmt.Errorf("%s can't be swept", name)
+	}
+	p := &param{Name: name}
+	switch val := v.(type) {
+	case int64:
+		p.Values = []int{int(val)}
+	case []interface{}:
+		for _, e := range val {
+			i, ok := e.(int64)
+			if !ok {
+				return nil, fmt.Errorf("%s: %v is not an integer", name, e)
+			}
+			p.Values = append(p.Values, int(i))
+		}
+	case string:
+		parts := strings.Split(val, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("%s: range must be start:end[:step]", name)
+		}
+		bounds := []int{0, 0, 1}
+		for i, part := range parts {
+			n, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			bounds[i] = n
+		}
+		if bounds[2] <= 0 || bounds[1] < bounds[0] {
+			return nil, fmt.Errorf("%s: empty range", name)
+		}
+		for i := bounds[0]; i <= bounds[1]; i += bounds[2] {
+			p.Values = append(p.Values, i)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported value %v", name, v)
+	}
+	if len(p.Values) == 0 {
+		return nil, fmt.Errorf("%s: no values", name)
+	}
+	return p, nil
+}
+
+// expand returns the cartesian product of all the parameters, sorted by name
+// so that the order of the runs is stable
+func expand(params []*param) []run {
+	sort.Slice(params, func(i, j int) bool { return params[i].Name < params[j].Name })
+	runs := []run{{}}
+	for _, p := range params {
+		var next []run
+		for _, r := range runs {
+			for _, v := range p.Values {
+				nr := make(run, len(r)+1)
+				for k, val := range r {
+					nr[k] = val
+				}
+				nr[p.Name] = v
+				next = append(next, nr)
+			}
+		}
+		runs = next
+	}
+	return runs
+}
+
+// valid checks the run with the fixed parameters of the base file gives a
+// consistent configuration
+func (r run) valid(base map[string]int) error {
+	get := func(name string) int {
+		if v, exists := r[name]; exists {
+			return v
+		}
+		return base[name]
+	}
+	if get("Threshold") > get("NotarizerNb") {
+		return errors.New("threshold above the number of notarizers")
+	}
+	if get("BeaconNb") < 1 || get("BlockMakerNb") < 1 || get("NotarizerNb") < 1 {
+		return errors.New("needs at least one node of each role")
+	}
+	return nil
+}
+
+// hosts returns the number of nodes the run needs
+func (r run) hosts(base map[string]int) int {
+	var n int
+	for _, name := range []string{"BeaconNb", "BlockMakerNb", "NotarizerNb"} {
+		if v, exists := r[name]; exists {
+			n += v
+		} else {
+			n += base[name]
+		}
+	}
+	return n
+}
+
+// key identifies the run in the aggregated results
+func (r run) key(names []string) string {
+	vals := make([]string, len(names))
+	for i, name := range names {
+		vals[i] = strconv.Itoa(r[name])
+	}
+	return strings.Join(vals, ",")
+}
+
+// baseHeader reads the global section of a simulation file, i.e. everything
+// before the first empty line. Swept parameters and Hosts are removed, and the
+// integer values are returned for validation.
+func baseHeader(r io.Reader, swept map[string]bool) ([]string, map[string]int, error) {
+	var lines []string
+	values := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		parts := strings.SplitN(line, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) == 2 {
+			if i, err := strconv.Atoi(strings.TrimSpace(parts[1])); err == nil {
+				values[name] = i
+			}
+		}
+		if swept[name] || name == "Hosts" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, values, scanner.Err()
+}
+
+// simulationFile returns the onet simulation file of the run
+func simulationFile(header []string, r run, hosts int) string {
+	var b strings.Builder
+	for _, line := range header {
+		b.WriteString(line + "\n")
+	}
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s = %d\n", name, r[name])
+	}
+	fmt.Fprintf(&b, "\nHosts\n%d\n", hosts)
+	return b.String()
+}
+
+// results is the aggregated CSV: the swept parameters followed by the columns
+// written by onet for each run
+type results struct {
+	path   string
+	params []string
+	header []string
+	done   map[string]bool
+}
+
+// openResults reads the existing results at path, if any, so an interrupted
+// sweep resumes where it stopped
+func openResults(path string, params []string) (*results, error) {
+	res := &results{path: path, params: params, done: make(map[string]bool)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return res, nil
+	}
+	res.header = rows[0]
+	if len(res.header) < len(params) || strings.Join(res.header[:len(params)], ",") != strings.Join(params, ",") {
+		return nil, fmt.Errorf("%s was written by a sweep over other parameters", path)
+	}
+	for _, row := range rows[1:] {
+		res.done[strings.Join(row[:len(params)], ",")] = true
+	}
+	return res, nil
+}
+
+// add appends the rows of the onet CSV of a run, prefixed by its parameters
+func (res *results) add(r run, onetCSV string) error {
+	in, err := os.Open(onetCSV)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	rows, err := csv.NewReader(in).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(rows) < 2 {
+		return fmt.Errorf("%s holds no results", onetCSV)
+	}
+	out, err := os.OpenFile(res.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := csv.NewWriter(out)
+	if res.header == nil {
+		res.header = append(append([]string{}, res.params...), rows[0]...)
+		if err := w.Write(res.header); err != nil {
+			return err
+		}
+	}
+	key := strings.Split(r.key(res.params), ",")
+	for _, row := range rows[1:] {
+		if err := w.Write(append(append([]string{}, key...), row...)); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	res.done[r.key(res.params)] = true
+	return w.Error()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSweepExpand(t *testing.T) {
+	size, err := parseParam("BlockSize", []interface{}{int64(10), int64(20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, err := parseParam("BlockTime", "100:300:100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bt.Values, []int{100, 200, 300}) {
+		t.Fatal("wrong range", bt.Values)
+	}
+	if _, err := parseParam("Rounds", int64(3)); err == nil {
+		t.Fatal("Rounds can't be swept")
+	}
+	if _, err := parseParam("BlockTime", "300:100"); err == nil {
+		t.Fatal("empty range accepted")
+	}
+
+	runs := expand([]*param{size, bt})
+	if len(runs) != 6 {
+		t.Fatal("expected 6 runs, got", len(runs))
+	}
+	if k := runs[0].key([]string{"BlockSize", "BlockTime"}); k != "10,100" {
+		t.Fatal("wrong first run", k)
+	}
+
+	base := map[string]int{"BeaconNb": 1, "BlockMakerNb": 2, "NotarizerNb": 3, "Threshold": 3}
+	if err := (run{}).valid(base); err != nil {
+		t.Fatal(err)
+	}
+	if (run{"NotarizerNb": 2}).valid(base) == nil {
+		t.Fatal("threshold above the notarizers accepted")
+	}
+	if h := (run{"NotarizerNb": 7}).hosts(base); h != 10 {
+		t.Fatal("wrong number of hosts", h)
+	}
+}
+
+func TestSweepResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := "Rounds = 10\nBlockSize = 100\nNotarizerNb = 3\n\nHosts\n6\n"
+	header, values, err := baseHeader(strings.NewReader(base), map[string]bool{"BlockSize": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["BlockSize"] != 100 {
+		t.Fatal("base values not read")
+	}
+	file := simulationFile(header, run{"BlockSize": 200}, 6)
+	if file != "Rounds = 10\nNotarizerNb = 3\nBlockSize = 200\n\nHosts\n6\n" {
+		t.Fatal("wrong simulation file:\n" + file)
+	}
+
+	onetCSV := filepath.Join(dir, "run.csv")
+	if err := ioutil.WriteFile(onetCSV, []byte("hosts,round_wall_avg\n6,1.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "sweep.csv")
+	params := []string{"BlockSize"}
+	res, err := openResults(out, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{100, 200} {
+		if err := res.add(run{"BlockSize": size}, onetCSV); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a restarted sweep sees the runs already done
+	res, err = openResults(out, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.done["100"] || !res.done["200"] || res.done["300"] {
+		t.Fatal("wrong runs done", res.done)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "BlockSize,hosts,round_wall_avg\n100,6,1.5\n200,6,1.5\n" {
+		t.Fatal("wrong aggregated results:\n" + string(data))
+	}
+	if _, err := openResults(out, []string{"BlockTime"}); err == nil {
+		t.Fatal("results of another sweep accepted")
+	}
+}
@@ -0,0 +1,66 @@
+// timeline merges the trace files written by the nodes into one timeline per
+// round. Times are given relative to the first event of each round.
+//
+//	timeline [-json] traces/node-*.jsonl
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	dfinity "github.com/csanti/dfinity_experiments/service"
+)
+
+func main() {
+	asJSON := flag.Bool("json", false, "output the merged timeline as JSON")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: timeline [-json] trace files...")
+		os.Exit(1)
+	}
+	var events []*dfinity.TraceEvent
+	for _, path := range flag.Args() {
+		evs, err := dfinity.ReadTrace(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		events = append(events, evs...)
+	}
+	timeline := dfinity.Timeline(events)
+	rounds := make([]int, 0, len(timeline))
+	for r := range timeline {
+		rounds = append(rounds, r)
+	}
+	sort.Ints(rounds)
+
+	if *asJSON {
+		type round struct {
+			Round  int                   `json:"round"`
+			Events []*dfinity.TraceEvent `json:"events"`
+		}
+		var out []round
+		for _, r := range rounds {
+			out = append(out, round{Round: r, Events: timeline[r]})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	for _, r := range rounds {
+		evs := timeline[r]
+		start := evs[0].Time
+		fmt.Printf("round %d\n", r)
+		for _, e := range evs {
+			fmt.Printf("  +%9.3fms  node %-3d %-10s %-20s %s\n",
+				float64(e.Time.Sub(start).Nanoseconds())/1e6, e.Node, e.Role, e.Event, e.Block)
+		}
+	}
+}